@@ -0,0 +1,228 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+// ConversionDataAnnotation stores the v1beta2 fields that can not be represented in v1,
+// so the IPRanges can be converted back and forth without losing information.
+const ConversionDataAnnotation = "clusterip.allocator.x-k8s.io/conversion-data"
+
+// conversionData contains the v1beta2 fields that don't exist in v1.
+type conversionData struct {
+	Reserved []string                           `json:"reserved,omitempty"`
+	Owners   map[string]*v1beta2.OwnerReference `json:"owners,omitempty"`
+}
+
+// conversionDataFromAnnotations returns the v1beta2 fields kept in the conversion annotation.
+func conversionDataFromAnnotations(annotations map[string]string) (conversionData, error) {
+	data := conversionData{}
+	raw, ok := annotations[ConversionDataAnnotation]
+	if !ok {
+		return data, nil
+	}
+	err := json.Unmarshal([]byte(raw), &data)
+	return data, err
+}
+
+// ReservedFromAnnotations returns the reserved addresses kept in the conversion annotation,
+// the addresses that are never allocated dynamically only exist in v1beta2.
+// The webhook rejects the IPRanges with an invalid annotation, if one is stored anyway
+// no address is reserved.
+func ReservedFromAnnotations(annotations map[string]string) []string {
+	data, err := conversionDataFromAnnotations(annotations)
+	if err != nil {
+		return nil
+	}
+	return data.Reserved
+}
+
+// GetReserved returns the addresses of the range that are never allocated dynamically.
+func (r *IPRange) GetReserved() []string {
+	return ReservedFromAnnotations(r.Annotations)
+}
+
+var _ conversion.Convertible = &IPRange{}
+
+// ConvertTo converts this IPRange to the Hub version (v1beta2).
+func (src *IPRange) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta2.IPRange)
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+
+	// restore the fields that only exist in v1beta2
+	data := conversionData{}
+	if raw, ok := dst.Annotations[ConversionDataAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			return err
+		}
+		delete(dst.Annotations, ConversionDataAnnotation)
+		if len(dst.Annotations) == 0 {
+			dst.Annotations = nil
+		}
+	}
+
+	dst.Spec.Range = src.Spec.Range
+	dst.Spec.AllowedNamespaces = src.Spec.AllowedNamespaces
+	dst.Spec.NamespaceSelector = src.Spec.NamespaceSelector.DeepCopy()
+	dst.Spec.NamespaceQuotas = nil
+	for _, quota := range src.Spec.NamespaceQuotas {
+		dst.Spec.NamespaceQuotas = append(dst.Spec.NamespaceQuotas, v1beta2.NamespaceQuota{
+			Namespace: quota.Namespace,
+			Limit:     quota.Limit,
+		})
+	}
+	dst.Spec.DefaultNamespaceQuota = src.Spec.DefaultNamespaceQuota
+	dst.Spec.ServiceSelector = src.Spec.ServiceSelector.DeepCopy()
+	dst.Spec.Priority = src.Spec.Priority
+	dst.Spec.Reserved = data.Reserved
+	dst.Spec.Addresses = nil
+	owners := src.GetOwners()
+	for _, address := range src.Spec.Addresses {
+		// the owners of the addresses released in v1 are dropped, and the Services
+		// that own the addresses in v1 replace the owners of the annotation
+		owner := data.Owners[address]
+		if service, ok := owners[address]; ok && (owner == nil || owner.Kind != "Service" ||
+			owner.Namespace != service.Namespace || owner.Name != service.Name) {
+			owner = &v1beta2.OwnerReference{Kind: "Service", Namespace: service.Namespace, Name: service.Name}
+		}
+		dst.Spec.Addresses = append(dst.Spec.Addresses, v1beta2.IPAddress{
+			Address: address,
+			Owner:   owner,
+		})
+	}
+
+	dst.Spec.Reservations = nil
+	for _, reservation := range src.Spec.Reservations {
+		dst.Spec.Reservations = append(dst.Spec.Reservations, v1beta2.Reservation{
+			Address:   reservation.Address,
+			Expires:   reservation.Expires,
+			Namespace: reservation.Namespace,
+		})
+	}
+	dst.Spec.StickyReservationTTL = src.Spec.StickyReservationTTL
+	dst.Spec.StickyReservations = nil
+	for _, reservation := range src.Spec.StickyReservations {
+		dst.Spec.StickyReservations = append(dst.Spec.StickyReservations, v1beta2.StickyReservation{
+			Address:   reservation.Address,
+			Namespace: reservation.Namespace,
+			Name:      reservation.Name,
+			Expires:   reservation.Expires.DeepCopy(),
+		})
+	}
+
+	dst.Status.Free = src.Status.Free
+	dst.Status.Conditions = src.Status.Conditions
+	dst.Status.NamespaceUsage = nil
+	for _, usage := range src.Status.NamespaceUsage {
+		dst.Status.NamespaceUsage = append(dst.Status.NamespaceUsage, v1beta2.NamespaceUsage{
+			Namespace: usage.Namespace,
+			Allocated: usage.Allocated,
+			Limit:     usage.Limit,
+		})
+	}
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1beta2) to this version.
+func (dst *IPRange) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta2.IPRange)
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+
+	data := conversionData{
+		Reserved: src.Spec.Reserved,
+	}
+	dst.Spec.Range = src.Spec.Range
+	dst.Spec.AllowedNamespaces = src.Spec.AllowedNamespaces
+	dst.Spec.NamespaceSelector = src.Spec.NamespaceSelector.DeepCopy()
+	dst.Spec.NamespaceQuotas = nil
+	for _, quota := range src.Spec.NamespaceQuotas {
+		dst.Spec.NamespaceQuotas = append(dst.Spec.NamespaceQuotas, NamespaceQuota{
+			Namespace: quota.Namespace,
+			Limit:     quota.Limit,
+		})
+	}
+	dst.Spec.DefaultNamespaceQuota = src.Spec.DefaultNamespaceQuota
+	dst.Spec.ServiceSelector = src.Spec.ServiceSelector.DeepCopy()
+	dst.Spec.Priority = src.Spec.Priority
+	dst.Spec.Addresses = nil
+	dst.Spec.Owners = nil
+	for _, address := range src.Spec.Addresses {
+		dst.Spec.Addresses = append(dst.Spec.Addresses, address.Address)
+		if address.Owner != nil && address.Owner.Kind == "Service" {
+			dst.Spec.Owners = append(dst.Spec.Owners, AddressOwner{
+				Address:   address.Address,
+				Namespace: address.Owner.Namespace,
+				Name:      address.Owner.Name,
+			})
+		}
+		if address.Owner != nil {
+			if data.Owners == nil {
+				data.Owners = map[string]*v1beta2.OwnerReference{}
+			}
+			data.Owners[address.Address] = address.Owner
+		}
+	}
+
+	dst.Spec.Reservations = nil
+	for _, reservation := range src.Spec.Reservations {
+		dst.Spec.Reservations = append(dst.Spec.Reservations, Reservation{
+			Address:   reservation.Address,
+			Expires:   reservation.Expires,
+			Namespace: reservation.Namespace,
+		})
+	}
+	dst.Spec.StickyReservationTTL = src.Spec.StickyReservationTTL
+	dst.Spec.StickyReservations = nil
+	for _, reservation := range src.Spec.StickyReservations {
+		dst.Spec.StickyReservations = append(dst.Spec.StickyReservations, StickyReservation{
+			Address:   reservation.Address,
+			Namespace: reservation.Namespace,
+			Name:      reservation.Name,
+			Expires:   reservation.Expires.DeepCopy(),
+		})
+	}
+
+	// preserve the fields that only exist in v1beta2
+	if len(data.Reserved) > 0 || len(data.Owners) > 0 {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if dst.Annotations == nil {
+			dst.Annotations = map[string]string{}
+		}
+		dst.Annotations[ConversionDataAnnotation] = string(raw)
+	}
+
+	dst.Status.Free = src.Status.Free
+	dst.Status.Conditions = src.Status.Conditions
+	dst.Status.NamespaceUsage = nil
+	for _, usage := range src.Status.NamespaceUsage {
+		dst.Status.NamespaceUsage = append(dst.Status.NamespaceUsage, NamespaceUsage{
+			Namespace: usage.Namespace,
+			Allocated: usage.Allocated,
+			Limit:     usage.Limit,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/conversion"
+
+	"github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+func newHub() *v1beta2.IPRange {
+	return &v1beta2.IPRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "kube-system",
+			Name:        "allocator",
+			Annotations: map[string]string{"foo": "bar"},
+		},
+		Spec: v1beta2.IPRangeSpec{
+			Range:                 "10.96.0.0/24",
+			Reserved:              []string{"10.96.0.10"},
+			AllowedNamespaces:     []string{"tenant-a"},
+			NamespaceSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "b"}},
+			NamespaceQuotas:       []v1beta2.NamespaceQuota{{Namespace: "tenant-a", Limit: 10}},
+			DefaultNamespaceQuota: pointer.Int64Ptr(5),
+			ServiceSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Priority:              10,
+			StickyReservationTTL:  &metav1.Duration{Duration: time.Hour},
+			StickyReservations: []v1beta2.StickyReservation{
+				{Address: "10.96.0.3", Namespace: "default", Name: "web", Expires: &metav1.Time{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}},
+			},
+			Addresses: []v1beta2.IPAddress{
+				{Address: "10.96.0.1", Owner: &v1beta2.OwnerReference{Kind: "Service", Namespace: "default", Name: "kubernetes", UID: "123"}},
+				{Address: "10.96.0.2"},
+			},
+		},
+		Status: v1beta2.IPRangeStatus{
+			Free: 252,
+			NamespaceUsage: []v1beta2.NamespaceUsage{
+				{Namespace: "tenant-a", Allocated: 1, Limit: 10},
+			},
+			Conditions: []metav1.Condition{
+				{Type: IPRangeTerminating, Status: metav1.ConditionFalse, Reason: "Test"},
+			},
+		},
+	}
+}
+
+func TestConvertHubSpokeHub(t *testing.T) {
+	hub := newHub()
+	spoke := &IPRange{}
+	if err := spoke.ConvertFrom(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(spoke.Spec.Addresses, []string{"10.96.0.1", "10.96.0.2"}) {
+		t.Fatalf("unexpected v1 addresses %v", spoke.Spec.Addresses)
+	}
+	if _, ok := spoke.Annotations[ConversionDataAnnotation]; !ok {
+		t.Fatalf("expected conversion data annotation, got %v", spoke.Annotations)
+	}
+	if _, ok := hub.Annotations[ConversionDataAnnotation]; ok {
+		t.Fatalf("conversion must not modify the source object")
+	}
+
+	got := &v1beta2.IPRange{}
+	if err := spoke.ConvertTo(got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(hub, got) {
+		t.Fatalf("expected lossless conversion,\nexpected %#v\ngot %#v", hub, got)
+	}
+}
+
+func TestConvertSpokeHubSpoke(t *testing.T) {
+	spoke := newIPRange("10.96.0.0/24", "10.96.0.1", "10.96.0.2")
+	hub := &v1beta2.IPRange{}
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hub.Spec.Addresses) != 2 || hub.Spec.Addresses[0].Owner != nil {
+		t.Fatalf("unexpected v1beta2 spec %#v", hub.Spec)
+	}
+
+	got := &IPRange{}
+	if err := got.ConvertFrom(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(spoke, got) {
+		t.Fatalf("expected lossless conversion,\nexpected %#v\ngot %#v", spoke, got)
+	}
+}
+
+func TestConvertReleasedAddressOwner(t *testing.T) {
+	spoke := &IPRange{}
+	if err := spoke.ConvertFrom(newHub()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a v1 client releases the address owned by the Service and allocates it again
+	spoke.Spec.Addresses = []string{"10.96.0.2"}
+	hub := &v1beta2.IPRange{}
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	spoke.Spec.Addresses = []string{"10.96.0.1", "10.96.0.2"}
+	if err := spoke.ConvertFrom(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hub.Spec.Addresses[0].Owner != nil {
+		t.Fatalf("expected the owner of the released address to be dropped, got %v", hub.Spec.Addresses[0].Owner)
+	}
+	if len(hub.Spec.Reserved) != 1 {
+		t.Fatalf("expected reserved addresses to be preserved, got %#v", hub.Spec)
+	}
+}
+
+func TestConvertServiceOwner(t *testing.T) {
+	spoke := &IPRange{}
+	if err := spoke.ConvertFrom(newHub()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(spoke.Spec.Owners, []AddressOwner{{Address: "10.96.0.1", Namespace: "default", Name: "kubernetes"}}) {
+		t.Fatalf("unexpected v1 owners %v", spoke.Spec.Owners)
+	}
+	// the v1 controller records the Services that use the addresses
+	spoke.SetOwners(map[string]types.NamespacedName{
+		"10.96.0.1": {Namespace: "default", Name: "kubernetes"},
+		"10.96.0.2": {Namespace: "default", Name: "web"},
+	})
+	hub := &v1beta2.IPRange{}
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if owner := hub.Spec.Addresses[0].Owner; owner == nil || owner.UID != "123" {
+		t.Fatalf("expected the owner of the annotation to be preserved, got %v", owner)
+	}
+	expected := &v1beta2.OwnerReference{Kind: "Service", Namespace: "default", Name: "web"}
+	if owner := hub.Spec.Addresses[1].Owner; !reflect.DeepEqual(owner, expected) {
+		t.Fatalf("expected owner %v, got %v", expected, owner)
+	}
+}
+
+func TestIsConvertible(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(AddToScheme(scheme))
+	utilruntime.Must(v1beta2.AddToScheme(scheme))
+	ok, err := conversion.IsConvertible(scheme, &IPRange{})
+	if err != nil || !ok {
+		t.Fatalf("expected IPRange to be convertible, got %v %v", ok, err)
+	}
+}
@@ -18,8 +18,24 @@ package v1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 )
 
+// ForceDeleteAnnotation allows to delete an IPRange that still has addresses allocated
+// to Services. The controller drains the range, moving the addresses and their owners to the
+// IPRanges the Services could allocate them from; the drain is refused while any of them can not be moved.
+const ForceDeleteAnnotation = "clusterip.allocator.x-k8s.io/force-delete"
+
+// IPRangeFinalizer is added by the controller to the IPRanges so they are not removed
+// while there are Services using addresses of the range.
+const IPRangeFinalizer = "clusterip.allocator.x-k8s.io/services"
+
+// IPRangeTerminating is the condition type set on the IPRanges that are being deleted
+// but still have Services using addresses of the range.
+const IPRangeTerminating = "Terminating"
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -36,6 +52,111 @@ type IPRangeSpec struct {
 	// Each address may be associated to one kubernetes object (i.e. Services)
 	// +listType=set
 	Addresses []string `json:"addresses,omitempty"`
+	// +optional
+	// Reservations are the addresses allocated by the webhook that are not confirmed yet,
+	// the controller releases them if no Service uses them before they expire.
+	// +listType=map
+	// +listMapKey=address
+	Reservations []Reservation `json:"reservations,omitempty"`
+	// +optional
+	// Owners are the Services that use the allocated addresses, the controller keeps them
+	// to know the Service of an address after the Service is deleted.
+	// +listType=map
+	// +listMapKey=address
+	Owners []AddressOwner `json:"owners,omitempty"`
+
+	// AllowedNamespaces are the namespaces of the Services that can allocate addresses from the range.
+	// All the namespaces are allowed if neither AllowedNamespaces nor NamespaceSelector are set.
+	// +optional
+	// +listType=set
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// NamespaceSelector selects by label the namespaces of the Services that can allocate
+	// addresses from the range, in addition to the AllowedNamespaces.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// NamespaceQuotas limit the number of addresses of the range the Services of each namespace can hold.
+	// +optional
+	// +listType=map
+	// +listMapKey=namespace
+	NamespaceQuotas []NamespaceQuota `json:"namespaceQuotas,omitempty"`
+	// DefaultNamespaceQuota limits the number of addresses of the namespaces without NamespaceQuota,
+	// they are not limited if it is not set.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	DefaultNamespaceQuota *int64 `json:"defaultNamespaceQuota,omitempty"`
+	// ServiceSelector selects by label the Services that allocate addresses from the range,
+	// the range is used by all the Services if it is not set.
+	// +optional
+	ServiceSelector *metav1.LabelSelector `json:"serviceSelector,omitempty"`
+	// Priority of the range, the Services allocate addresses from the range with the highest
+	// priority that selects them and has free addresses.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// StickyReservationTTL is the time the address of a deleted Service is held for a new Service with
+	// the same namespace and name, the address is released when the Service is deleted if it is not set.
+	// +optional
+	StickyReservationTTL *metav1.Duration `json:"stickyReservationTTL,omitempty"`
+	// StickyReservations bind addresses of the range to the namespace and name of a Service,
+	// a Service created with that namespace and name gets the address back.
+	// +optional
+	// +listType=map
+	// +listMapKey=address
+	StickyReservations []StickyReservation `json:"stickyReservations,omitempty"`
+}
+
+// Reservation is an address allocated by the webhook that is not confirmed yet
+type Reservation struct {
+	// Address is the reserved IP address
+	Address string `json:"address"`
+	// Expires is the time the reservation is released if it was not confirmed
+	Expires metav1.Time `json:"expires"`
+	// Namespace of the Service the address is reserved for, the reservation counts
+	// against the quota of the namespace until it is confirmed
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// AddressOwner is the Service that uses an allocated address
+type AddressOwner struct {
+	// Address is the allocated IP address
+	Address string `json:"address"`
+	// Namespace of the Service
+	Namespace string `json:"namespace"`
+	// Name of the Service
+	Name string `json:"name"`
+}
+
+// StickyReservation binds an address of the range to the namespace and name of a Service
+type StickyReservation struct {
+	// Address is the reserved IP address
+	Address string `json:"address"`
+	// Namespace of the Service
+	Namespace string `json:"namespace"`
+	// Name of the Service
+	Name string `json:"name"`
+	// Expires is the time the address is released if no Service uses it,
+	// the address is held until the reservation is removed if it is not set.
+	// +optional
+	Expires *metav1.Time `json:"expires,omitempty"`
+}
+
+// NamespaceQuota limits the number of addresses of the range the Services of a namespace can hold
+type NamespaceQuota struct {
+	// Namespace of the Services
+	Namespace string `json:"namespace"`
+	// Limit is the maximum number of addresses
+	// +kubebuilder:validation:Minimum=0
+	Limit int64 `json:"limit"`
+}
+
+// NamespaceUsage is the number of addresses of the range held by the Services of a namespace
+type NamespaceUsage struct {
+	// Namespace of the Services
+	Namespace string `json:"namespace"`
+	// Allocated is the number of addresses held by the Services of the namespace
+	Allocated int64 `json:"allocated"`
+	// Limit is the quota of the namespace
+	Limit int64 `json:"limit"`
 }
 
 // IPRangeStatus defines the observed state of IPRange
@@ -43,9 +164,22 @@ type IPRangeStatus struct {
 	// Free represent the number of IP addresses that are not allocated in the Range
 	// +optional
 	Free int64 `json:"free,omitempty"`
+
+	// NamespaceUsage reports the addresses held by the namespaces with quota
+	// +optional
+	// +listType=map
+	// +listMapKey=namespace
+	NamespaceUsage []NamespaceUsage `json:"namespaceUsage,omitempty"`
+
+	// Conditions represent the latest available observations of the IPRange state
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:storageversion
 // +kubebuilder:subresource:status
 
 // IPRange is the Schema for the ipranges API
@@ -57,6 +191,190 @@ type IPRange struct {
 	Status IPRangeStatus `json:"status,omitempty"`
 }
 
+// IsForceDelete returns true if the IPRange has been marked to be drained and deleted
+// even if it has addresses allocated.
+func (r *IPRange) IsForceDelete() bool {
+	return r.Annotations[ForceDeleteAnnotation] == "true"
+}
+
+// HasNamespacePolicy returns true if the IPRange restricts the namespaces of the Services
+// that can allocate addresses from the range.
+func (r *IPRange) HasNamespacePolicy() bool {
+	return len(r.Spec.AllowedNamespaces) > 0 || r.Spec.NamespaceSelector != nil
+}
+
+// AllowsNamespace returns true if the Services of the namespace, with the given labels,
+// can allocate addresses from the range.
+func (r *IPRange) AllowsNamespace(namespace string, nsLabels map[string]string) (bool, error) {
+	if !r.HasNamespacePolicy() {
+		return true, nil
+	}
+	for _, allowed := range r.Spec.AllowedNamespaces {
+		if allowed == namespace {
+			return true, nil
+		}
+	}
+	if r.Spec.NamespaceSelector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(r.Spec.NamespaceSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(nsLabels)), nil
+}
+
+// QuotaFor returns the maximum number of addresses of the range the Services of the
+// namespace can hold, it returns false if the namespace is not limited.
+func (r *IPRange) QuotaFor(namespace string) (int64, bool) {
+	for _, quota := range r.Spec.NamespaceQuotas {
+		if quota.Namespace == namespace {
+			return quota.Limit, true
+		}
+	}
+	if r.Spec.DefaultNamespaceQuota != nil {
+		return *r.Spec.DefaultNamespaceQuota, true
+	}
+	return 0, false
+}
+
+// SelectsService returns true if the Services with the given labels allocate addresses from the range.
+func (r *IPRange) SelectsService(svcLabels map[string]string) (bool, error) {
+	if r.Spec.ServiceSelector == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(r.Spec.ServiceSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(svcLabels)), nil
+}
+
+// GetRange returns the IP range in CIDR format.
+func (r *IPRange) GetRange() string {
+	return r.Spec.Range
+}
+
+// GetAddresses returns the allocated addresses of the range.
+func (r *IPRange) GetAddresses() []string {
+	return r.Spec.Addresses
+}
+
+// SetAddresses sets the allocated addresses of the range.
+func (r *IPRange) SetAddresses(addresses []string) {
+	r.Spec.Addresses = addresses
+}
+
+// GetReservations returns the expiration time of the reserved addresses of the range.
+func (r *IPRange) GetReservations() map[string]metav1.Time {
+	reservations := map[string]metav1.Time{}
+	for _, reservation := range r.Spec.Reservations {
+		reservations[reservation.Address] = reservation.Expires
+	}
+	return reservations
+}
+
+// SetReservations sets the reserved addresses of the range with their expiration time,
+// the namespaces of the addresses that remain reserved are kept.
+func (r *IPRange) SetReservations(reservations map[string]metav1.Time) {
+	namespaces := map[string]string{}
+	for _, reservation := range r.Spec.Reservations {
+		namespaces[reservation.Address] = reservation.Namespace
+	}
+	r.Spec.Reservations = nil
+	for _, address := range sets.StringKeySet(reservations).List() {
+		r.Spec.Reservations = append(r.Spec.Reservations, Reservation{
+			Address:   address,
+			Expires:   reservations[address],
+			Namespace: namespaces[address],
+		})
+	}
+}
+
+// SetReservationNamespace records the namespace of the Service the address is reserved for.
+func (r *IPRange) SetReservationNamespace(address, namespace string) {
+	for i := range r.Spec.Reservations {
+		if r.Spec.Reservations[i].Address == address {
+			r.Spec.Reservations[i].Namespace = namespace
+		}
+	}
+}
+
+// NamespaceAddresses returns the number of addresses of the range held by the Services of the
+// namespace, the addresses of its Services and the addresses reserved for the namespace.
+func (r *IPRange) NamespaceAddresses(namespace string) int64 {
+	addresses := sets.NewString(r.Spec.Addresses...)
+	reserved := sets.NewString()
+	var allocated int64
+	for _, reservation := range r.Spec.Reservations {
+		reserved.Insert(reservation.Address)
+		if reservation.Namespace == namespace && addresses.Has(reservation.Address) {
+			allocated++
+		}
+	}
+	for _, owner := range r.Spec.Owners {
+		// the owners of the released addresses are removed by the controller
+		if owner.Namespace == namespace && addresses.Has(owner.Address) && !reserved.Has(owner.Address) {
+			allocated++
+		}
+	}
+	return allocated
+}
+
+// GetOwners returns the namespace and name of the Services that use the allocated addresses.
+func (r *IPRange) GetOwners() map[string]types.NamespacedName {
+	owners := map[string]types.NamespacedName{}
+	for _, owner := range r.Spec.Owners {
+		owners[owner.Address] = types.NamespacedName{Namespace: owner.Namespace, Name: owner.Name}
+	}
+	return owners
+}
+
+// SetOwners sets the namespace and name of the Services that use the allocated addresses.
+func (r *IPRange) SetOwners(owners map[string]types.NamespacedName) {
+	r.Spec.Owners = nil
+	for _, address := range sets.StringKeySet(owners).List() {
+		owner := owners[address]
+		r.Spec.Owners = append(r.Spec.Owners, AddressOwner{Address: address, Namespace: owner.Namespace, Name: owner.Name})
+	}
+}
+
+// StickyAddress returns the address bound to the Service namespace/name by a sticky reservation.
+func (r *IPRange) StickyAddress(namespace, name string) (string, bool) {
+	for _, reservation := range r.Spec.StickyReservations {
+		if reservation.Namespace == namespace && reservation.Name == name {
+			return reservation.Address, true
+		}
+	}
+	return "", false
+}
+
+// ExtendStickyReservation makes the sticky reservation of the address not expire before the given time.
+func (r *IPRange) ExtendStickyReservation(address string, expires metav1.Time) {
+	for i := range r.Spec.StickyReservations {
+		reservation := &r.Spec.StickyReservations[i]
+		if reservation.Address == address && reservation.Expires != nil && reservation.Expires.Before(&expires) {
+			reservation.Expires = expires.DeepCopy()
+		}
+	}
+}
+
+// ByPriority sorts the IPRanges from the highest to the lowest priority,
+// the IPRanges with the same priority are sorted by namespace and name.
+type ByPriority []IPRange
+
+func (p ByPriority) Len() int      { return len(p) }
+func (p ByPriority) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p ByPriority) Less(i, j int) bool {
+	if p[i].Spec.Priority != p[j].Spec.Priority {
+		return p[i].Spec.Priority > p[j].Spec.Priority
+	}
+	if p[i].Namespace != p[j].Namespace {
+		return p[i].Namespace < p[j].Namespace
+	}
+	return p[i].Name < p[j].Name
+}
+
 // +kubebuilder:object:root=true
 
 // IPRangeList contains a list of IPRange
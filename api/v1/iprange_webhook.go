@@ -17,20 +17,32 @@ limitations under the License.
 package v1
 
 import (
-	"fmt"
+	"context"
 	"net"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
 	"k8s.io/apimachinery/pkg/runtime"
-	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	"github.com/aojea/clusterip-webhook/internal/services"
+	"github.com/aojea/clusterip-webhook/internal/validation"
 )
 
 // log is for logging in this package.
 var iprangelog = logf.Log.WithName("iprange-resource")
 
+// iprangeClient is used by the webhook to check the Services that are using the IPRange addresses.
+var iprangeClient client.Reader
+
 func (r *IPRange) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	iprangeClient = mgr.GetClient()
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
@@ -43,8 +55,10 @@ var _ webhook.Defaulter = &IPRange{}
 // Default implements webhook.Defaulter so a webhook will be registered for the type
 func (r *IPRange) Default() {
 	iprangelog.Info("default", "name", r.Name)
-
-	// TODO(user): fill in your defaulting logic.
+	// store the Range in its canonical form, i.e. 10.96.0.2/24 -> 10.96.0.0/24
+	if _, ipRange, err := net.ParseCIDR(r.Spec.Range); err == nil {
+		r.Spec.Range = ipRange.String()
+	}
 }
 
 // +kubebuilder:webhook:verbs=create;update;delete,path=/validate-clusterip-allocator-x-k8s-io-v1-iprange,mutating=false,failurePolicy=fail,groups=clusterip.allocator.x-k8s.io,resources=ipranges,versions=v1,name=viprange.kb.io
@@ -54,50 +68,141 @@ var _ webhook.Validator = &IPRange{}
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (r *IPRange) ValidateCreate() error {
 	iprangelog.Info("validate create", "name", r.Name)
-	// Create only allows to set the IP range
-	if len(r.Spec.Addresses) > 0 {
-		return fmt.Errorf("Addresses can not be allocated on creation")
-	}
-	_, ipRange, err := net.ParseCIDR(r.Spec.Range)
-	if err != nil {
-		return err
-	}
-	r.Spec.Range = ipRange.String()
-	return nil
+	return r.toInvalid(ValidateIPRangeCreate(r))
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *IPRange) ValidateUpdate(old runtime.Object) error {
 	oldIPRange := old.(*IPRange)
 	iprangelog.Info("validate update", "name", r.Name)
-	// Range is inmutable after creation
-	if r.Spec.Range != oldIPRange.Spec.Range {
-		return fmt.Errorf("Range can not be changed after creation")
-	}
-	// the Range was already validated on creation
-	_, ipRange, _ := net.ParseCIDR(r.Spec.Range)
-	allErrors := []error{}
-	for _, address := range r.Spec.Addresses {
-		ip := net.ParseIP(address)
-		if ip == nil {
-			allErrors = append(allErrors, fmt.Errorf("invalid ip address %s", address))
-		}
-		if !ipRange.Contains(ip) {
-			allErrors = append(allErrors, fmt.Errorf("ip address %s out of range %s", address, ipRange.String()))
-		}
-		if ip.Equal(ipRange.IP) {
-			allErrors = append(allErrors, fmt.Errorf("ip address %s reserved", ip.String()))
-		}
-	}
-	return utilerrors.NewAggregate(allErrors)
+	return r.toInvalid(ValidateIPRangeUpdate(r, oldIPRange))
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (r *IPRange) ValidateDelete() error {
 	iprangelog.Info("validate delete", "name", r.Name)
-	// An IPRange can not be deleted if there are still ip addresses allocated
+	svcIPs, err := services.ClusterIPs(context.Background(), iprangeClient)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	allErrs := ValidateIPRangeDelete(r, svcIPs)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewForbidden(GroupVersion.WithResource("ipranges").GroupResource(), r.Name, allErrs.ToAggregate())
+}
+
+// toInvalid converts a list of field errors to an Invalid API status error,
+// so clients like kubectl are able to show the errors per field.
+func (r *IPRange) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("IPRange").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateIPRangeCreate validates a new IPRange, only the Range can be set on creation.
+func ValidateIPRangeCreate(r *IPRange) field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+	_, ipRange, err := net.ParseCIDR(r.Spec.Range)
+	if err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("range"), r.Spec.Range, "must be a valid CIDR, i.e. 10.0.0.0/16 or 2001:db2::/64"))
+	}
+	// Create only allows to set the IP range
 	if len(r.Spec.Addresses) > 0 {
-		return fmt.Errorf("IPRange can not be deleted if addresses are allocated")
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("addresses"), "addresses can not be allocated on creation"))
+	}
+	allErrs = append(allErrs, validation.NamespacePolicy(r.Spec.AllowedNamespaces, r.Spec.NamespaceSelector, specPath)...)
+	allErrs = append(allErrs, validation.NamespaceQuotas(namespaceQuotas(r.Spec.NamespaceQuotas), r.Spec.DefaultNamespaceQuota, specPath)...)
+	allErrs = append(allErrs, metav1validation.ValidateLabelSelector(r.Spec.ServiceSelector, specPath.Child("serviceSelector"))...)
+	allErrs = append(allErrs, validation.StickyReservations(stickyReservations(r.Spec.StickyReservations), r.Spec.StickyReservationTTL, ipRange, specPath)...)
+	allErrs = append(allErrs, validateConversionData(r.Annotations, ipRange)...)
+	return allErrs
+}
+
+// ValidateIPRangeUpdate validates the changes on an existing IPRange,
+// the Range is immutable and the Addresses have to belong to the Range.
+func ValidateIPRangeUpdate(r, old *IPRange) field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+	// Range is inmutable after creation
+	allErrs = append(allErrs, apivalidation.ValidateImmutableField(r.Spec.Range, old.Spec.Range, specPath.Child("range"))...)
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+	// the Range was already validated on creation, but the object
+	// may have been created with the webhooks disabled
+	_, ipRange, err := net.ParseCIDR(r.Spec.Range)
+	if err != nil {
+		return append(allErrs, field.Invalid(specPath.Child("range"), r.Spec.Range, "must be a valid CIDR"))
+	}
+	allErrs = append(allErrs, validateAddresses(r.Spec.Addresses, ipRange, specPath.Child("addresses"))...)
+	allErrs = append(allErrs, validation.Reservations(reservedAddresses(r.Spec.Reservations), sets.NewString(r.Spec.Addresses...), specPath.Child("reservations"))...)
+	allErrs = append(allErrs, validation.NamespacePolicy(r.Spec.AllowedNamespaces, r.Spec.NamespaceSelector, specPath)...)
+	allErrs = append(allErrs, validation.NamespaceQuotas(namespaceQuotas(r.Spec.NamespaceQuotas), r.Spec.DefaultNamespaceQuota, specPath)...)
+	allErrs = append(allErrs, metav1validation.ValidateLabelSelector(r.Spec.ServiceSelector, specPath.Child("serviceSelector"))...)
+	allErrs = append(allErrs, validation.StickyReservations(stickyReservations(r.Spec.StickyReservations), r.Spec.StickyReservationTTL, ipRange, specPath)...)
+	allErrs = append(allErrs, validateConversionData(r.Annotations, ipRange)...)
+	return allErrs
+}
+
+// ValidateIPRangeDelete validates that an IPRange can be deleted.
+// svcIPs maps the ClusterIPs of the existing Services to the Service namespace/name,
+// if it is nil all the addresses are considered in use.
+func ValidateIPRangeDelete(r *IPRange, svcIPs map[string]string) field.ErrorList {
+	// the controller drains the range before it is deleted
+	if r.IsForceDelete() {
+		return field.ErrorList{}
+	}
+	// An IPRange can not be deleted if there are still ip addresses allocated to Services
+	return validation.Delete(r.Spec.Addresses, svcIPs, field.NewPath("spec", "addresses"))
+}
+
+// validateConversionData validates the conversion annotation, the allocator never
+// allocates the reserved addresses it keeps so they have to be valid IPs of the range.
+func validateConversionData(annotations map[string]string, ipRange *net.IPNet) field.ErrorList {
+	fldPath := field.NewPath("metadata", "annotations").Key(ConversionDataAnnotation)
+	data, err := conversionDataFromAnnotations(annotations)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, annotations[ConversionDataAnnotation], "must be valid JSON: "+err.Error())}
+	}
+	return validation.Reserved(data.Reserved, ipRange, fldPath.Child("reserved"))
+}
+
+// validateAddresses validates that each address is a valid IP that belongs to the range
+// and is not reserved.
+func validateAddresses(addresses []string, ipRange *net.IPNet, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, address := range addresses {
+		allErrs = append(allErrs, validation.Address(address, ipRange, fldPath.Index(i))...)
+	}
+	return allErrs
+}
+
+// namespaceQuotas returns the quotas of the namespaces to validate them.
+func namespaceQuotas(quotas []NamespaceQuota) []validation.NamespaceQuota {
+	var out []validation.NamespaceQuota
+	for _, quota := range quotas {
+		out = append(out, validation.NamespaceQuota{Namespace: quota.Namespace, Limit: quota.Limit})
+	}
+	return out
+}
+
+// reservedAddresses returns the addresses of the reservations to validate them.
+func reservedAddresses(reservations []Reservation) []string {
+	var out []string
+	for _, reservation := range reservations {
+		out = append(out, reservation.Address)
+	}
+	return out
+}
+
+// stickyReservations returns the sticky reservations to validate them.
+func stickyReservations(reservations []StickyReservation) []validation.StickyReservation {
+	var out []validation.StickyReservation
+	for _, reservation := range reservations {
+		out = append(out, validation.StickyReservation{Address: reservation.Address, Namespace: reservation.Namespace, Name: reservation.Name})
 	}
-	return nil
+	return out
 }
@@ -0,0 +1,437 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/pointer"
+)
+
+func newIPRange(cidr string, addresses ...string) *IPRange {
+	return &IPRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      "allocator",
+		},
+		Spec: IPRangeSpec{
+			Range:     cidr,
+			Addresses: addresses,
+		},
+	}
+}
+
+// checkErrors verifies that the error list contains exactly the expected field paths and types.
+func checkErrors(t *testing.T, allErrs field.ErrorList, expected field.ErrorList) {
+	t.Helper()
+	if len(allErrs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(allErrs), allErrs)
+	}
+	for i := range expected {
+		if allErrs[i].Field != expected[i].Field || allErrs[i].Type != expected[i].Type {
+			t.Errorf("expected error %s %s, got %s %s", expected[i].Type, expected[i].Field, allErrs[i].Type, allErrs[i].Field)
+		}
+	}
+}
+
+func TestValidateIPRangeCreate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ipRange  *IPRange
+		expected field.ErrorList
+	}{
+		{
+			name:    "valid IPv4",
+			ipRange: newIPRange("10.96.0.0/12"),
+		},
+		{
+			name:    "valid IPv6",
+			ipRange: newIPRange("2001:db2::/64"),
+		},
+		{
+			name:     "invalid range",
+			ipRange:  newIPRange("10.96.0.0"),
+			expected: field.ErrorList{field.Invalid(field.NewPath("spec", "range"), "", "")},
+		},
+		{
+			name:     "addresses on creation",
+			ipRange:  newIPRange("10.96.0.0/12", "10.96.0.1"),
+			expected: field.ErrorList{field.Forbidden(field.NewPath("spec", "addresses"), "")},
+		},
+		{
+			name:    "invalid range and addresses on creation",
+			ipRange: newIPRange("bad", "10.96.0.1"),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "range"), "", ""),
+				field.Forbidden(field.NewPath("spec", "addresses"), ""),
+			},
+		},
+		{
+			name: "namespace policy",
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/12")
+				r.Spec.AllowedNamespaces = []string{"tenant-a"}
+				r.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "b"}}
+				return r
+			}(),
+		},
+		{
+			name: "invalid namespace policy",
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/12")
+				r.Spec.AllowedNamespaces = []string{"Tenant_A"}
+				r.Spec.NamespaceSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "tenant", Operator: metav1.LabelSelectorOpIn},
+				}}
+				return r
+			}(),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "allowedNamespaces").Index(0), "", ""),
+				field.Required(field.NewPath("spec", "namespaceSelector", "matchExpressions").Index(0).Child("values"), ""),
+			},
+		},
+		{
+			name: "invalid namespace quotas",
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/12")
+				r.Spec.NamespaceQuotas = []NamespaceQuota{
+					{Namespace: "tenant-a", Limit: 10},
+					{Namespace: "tenant-a", Limit: -1},
+				}
+				r.Spec.DefaultNamespaceQuota = pointer.Int64Ptr(-1)
+				return r
+			}(),
+			expected: field.ErrorList{
+				field.Duplicate(field.NewPath("spec", "namespaceQuotas").Index(1).Child("namespace"), ""),
+				field.Invalid(field.NewPath("spec", "namespaceQuotas").Index(1).Child("limit"), "", ""),
+				field.Invalid(field.NewPath("spec", "defaultNamespaceQuota"), "", ""),
+			},
+		},
+		{
+			name: "invalid service selector",
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/12")
+				r.Spec.ServiceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "not valid"}}
+				return r
+			}(),
+			expected: field.ErrorList{field.Invalid(field.NewPath("spec", "serviceSelector", "matchLabels"), "", "")},
+		},
+		{
+			name: "invalid sticky reservations",
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/24")
+				r.Spec.StickyReservationTTL = &metav1.Duration{Duration: -time.Minute}
+				r.Spec.StickyReservations = []StickyReservation{
+					{Address: "10.96.0.1", Namespace: "default", Name: "web"},
+					{Address: "10.96.1.1", Namespace: "default", Name: "web"},
+					{Address: "10.96.0.0", Namespace: "Default", Name: "db"},
+				}
+				return r
+			}(),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "stickyReservationTTL"), "", ""),
+				field.Invalid(field.NewPath("spec", "stickyReservations").Index(1).Child("address"), "", ""),
+				field.Duplicate(field.NewPath("spec", "stickyReservations").Index(1).Child("name"), ""),
+				field.Invalid(field.NewPath("spec", "stickyReservations").Index(2).Child("address"), "", ""),
+				field.Invalid(field.NewPath("spec", "stickyReservations").Index(2).Child("namespace"), "", ""),
+			},
+		},
+		{
+			name: "invalid conversion annotation",
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/24")
+				r.Annotations = map[string]string{ConversionDataAnnotation: `{"reserved":"10.96.0.1"}`}
+				return r
+			}(),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("metadata", "annotations").Key(ConversionDataAnnotation), "", ""),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkErrors(t, ValidateIPRangeCreate(tc.ipRange), tc.expected)
+		})
+	}
+}
+
+func TestValidateIPRangeUpdate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		old      *IPRange
+		ipRange  *IPRange
+		expected field.ErrorList
+	}{
+		{
+			name:    "allocate addresses",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", "10.96.0.1", "10.96.0.255"),
+		},
+		{
+			name:    "allocate IPv6 addresses",
+			old:     newIPRange("2001:db2::/64"),
+			ipRange: newIPRange("2001:db2::/64", "2001:db2::1"),
+		},
+		{
+			name: "reserve allocated address",
+			old:  newIPRange("10.96.0.0/24"),
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/24", "10.96.0.1")
+				r.Spec.Reservations = []Reservation{{Address: "10.96.0.1"}}
+				return r
+			}(),
+		},
+		{
+			name: "reserve address not allocated",
+			old:  newIPRange("10.96.0.0/24"),
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/24", "10.96.0.1")
+				r.Spec.Reservations = []Reservation{{Address: "10.96.0.1"}, {Address: "10.96.0.2"}}
+				return r
+			}(),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "reservations").Index(1).Child("address"), "", ""),
+			},
+		},
+		{
+			name:     "range changed",
+			old:      newIPRange("10.96.0.0/24"),
+			ipRange:  newIPRange("10.96.0.0/16"),
+			expected: field.ErrorList{field.Invalid(field.NewPath("spec", "range"), "", "")},
+		},
+		{
+			name:     "invalid range stored without webhook",
+			old:      newIPRange("10.96.0.0"),
+			ipRange:  newIPRange("10.96.0.0", "10.96.0.1"),
+			expected: field.ErrorList{field.Invalid(field.NewPath("spec", "range"), "", "")},
+		},
+		{
+			name:    "invalid address",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", "10.96.0.1", "10.96.0.2", "10.96.0.3", "10.96.0"),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "addresses").Index(3), "", ""),
+			},
+		},
+		{
+			name:    "address out of range",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", "10.96.1.1"),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "addresses").Index(0), "", ""),
+			},
+		},
+		{
+			name:    "address of a different family",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", "10.96.0.1", "2001:db2::1"),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "addresses").Index(1), "", ""),
+			},
+		},
+		{
+			name:    "reserved address",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", "10.96.0.0"),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "addresses").Index(0), "", ""),
+			},
+		},
+		{
+			name:    "multiple errors",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", "10.96.0.0", "10.96.0.1", "foo", "10.96.1.1"),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("spec", "addresses").Index(0), "", ""),
+				field.Invalid(field.NewPath("spec", "addresses").Index(2), "", ""),
+				field.Invalid(field.NewPath("spec", "addresses").Index(3), "", ""),
+			},
+		},
+		{
+			name: "reserved addresses out of range",
+			old:  newIPRange("10.96.0.0/24"),
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/24")
+				r.Annotations = map[string]string{ConversionDataAnnotation: `{"reserved":["10.96.0.0","10.96.1.1","bad"]}`}
+				return r
+			}(),
+			expected: field.ErrorList{
+				field.Invalid(field.NewPath("metadata", "annotations").Key(ConversionDataAnnotation).Child("reserved").Index(1), "", ""),
+				field.Invalid(field.NewPath("metadata", "annotations").Key(ConversionDataAnnotation).Child("reserved").Index(2), "", ""),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkErrors(t, ValidateIPRangeUpdate(tc.ipRange, tc.old), tc.expected)
+		})
+	}
+}
+
+func TestValidateIPRangeDelete(t *testing.T) {
+	forced := newIPRange("10.96.0.0/24", "10.96.0.1")
+	forced.Annotations = map[string]string{ForceDeleteAnnotation: "true"}
+
+	testCases := []struct {
+		name     string
+		ipRange  *IPRange
+		svcIPs   map[string]string
+		expected field.ErrorList
+	}{
+		{
+			name:    "no addresses",
+			ipRange: newIPRange("10.96.0.0/24"),
+		},
+		{
+			name:     "addresses without Services information",
+			ipRange:  newIPRange("10.96.0.0/24", "10.96.0.1"),
+			expected: field.ErrorList{field.Forbidden(field.NewPath("spec", "addresses").Index(0), "")},
+		},
+		{
+			name:    "addresses not used by Services",
+			ipRange: newIPRange("10.96.0.0/24", "10.96.0.1", "10.96.0.2"),
+			svcIPs:  map[string]string{"10.96.1.1": "default/kubernetes"},
+		},
+		{
+			name:     "address used by a Service",
+			ipRange:  newIPRange("10.96.0.0/24", "10.96.0.1", "10.96.0.2"),
+			svcIPs:   map[string]string{"10.96.0.2": "default/kubernetes"},
+			expected: field.ErrorList{field.Forbidden(field.NewPath("spec", "addresses").Index(1), "")},
+		},
+		{
+			name:    "forced deletion",
+			ipRange: forced,
+			svcIPs:  map[string]string{"10.96.0.1": "default/kubernetes"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkErrors(t, ValidateIPRangeDelete(tc.ipRange, tc.svcIPs), tc.expected)
+		})
+	}
+}
+
+func TestValidatorStatusErrors(t *testing.T) {
+	if err := newIPRange("10.96.0.0/24").ValidateCreate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := newIPRange("10.96.0.0/24", "10.96.0.1").ValidateCreate()
+	if !apierrors.IsInvalid(err) {
+		t.Fatalf("expected Invalid error on create, got %v", err)
+	}
+	err = newIPRange("10.96.0.0/24", "10.96.1.1").ValidateUpdate(newIPRange("10.96.0.0/24"))
+	if !apierrors.IsInvalid(err) {
+		t.Fatalf("expected Invalid error on update, got %v", err)
+	}
+	causes := err.(apierrors.APIStatus).Status().Details.Causes
+	if len(causes) != 1 || causes[0].Field != "spec.addresses[0]" {
+		t.Fatalf("expected cause on spec.addresses[0], got %v", causes)
+	}
+	err = newIPRange("10.96.0.0/24", "10.96.0.1").ValidateDelete()
+	if !apierrors.IsForbidden(err) {
+		t.Fatalf("expected Forbidden error on delete, got %v", err)
+	}
+}
+
+func TestDefaultCanonicalRange(t *testing.T) {
+	r := newIPRange("10.96.0.2/24")
+	r.Default()
+	if r.Spec.Range != "10.96.0.0/24" {
+		t.Fatalf("expected canonical range 10.96.0.0/24, got %s", r.Spec.Range)
+	}
+}
+
+func TestAllowsNamespace(t *testing.T) {
+	r := newIPRange("10.96.0.0/12")
+	if allowed, err := r.AllowsNamespace("default", nil); err != nil || !allowed {
+		t.Fatalf("expected all the namespaces to be allowed without policy, got %v %v", allowed, err)
+	}
+	r.Spec.AllowedNamespaces = []string{"tenant-a"}
+	r.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "b"}}
+	testCases := []struct {
+		namespace string
+		labels    map[string]string
+		allowed   bool
+	}{
+		{"tenant-a", nil, true},
+		{"tenant-b", map[string]string{"tenant": "b"}, true},
+		{"tenant-c", map[string]string{"tenant": "c"}, false},
+		{"default", nil, false},
+	}
+	for _, tc := range testCases {
+		allowed, err := r.AllowsNamespace(tc.namespace, tc.labels)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if allowed != tc.allowed {
+			t.Errorf("namespace %s expected allowed %v, got %v", tc.namespace, tc.allowed, allowed)
+		}
+	}
+}
+
+func TestQuotaFor(t *testing.T) {
+	r := newIPRange("10.96.0.0/12")
+	if _, limited := r.QuotaFor("default"); limited {
+		t.Fatalf("expected the namespaces not to be limited without quotas")
+	}
+	r.Spec.NamespaceQuotas = []NamespaceQuota{{Namespace: "tenant-a", Limit: 10}}
+	if limit, limited := r.QuotaFor("tenant-a"); !limited || limit != 10 {
+		t.Fatalf("expected quota 10, got %d %v", limit, limited)
+	}
+	if _, limited := r.QuotaFor("default"); limited {
+		t.Fatalf("expected namespace default not to be limited")
+	}
+	r.Spec.DefaultNamespaceQuota = pointer.Int64Ptr(5)
+	if limit, limited := r.QuotaFor("default"); !limited || limit != 5 {
+		t.Fatalf("expected the default quota 5, got %d %v", limit, limited)
+	}
+}
+
+func TestSelectsService(t *testing.T) {
+	r := newIPRange("10.96.0.0/12")
+	if selected, err := r.SelectsService(nil); err != nil || !selected {
+		t.Fatalf("expected all the Services to be selected without selector, got %v %v", selected, err)
+	}
+	r.Spec.ServiceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	for svcLabels, expected := range map[string]bool{"web": true, "db": false, "": false} {
+		selected, err := r.SelectsService(map[string]string{"app": svcLabels})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if selected != expected {
+			t.Errorf("app %q expected selected %v, got %v", svcLabels, expected, selected)
+		}
+	}
+}
+
+func TestByPriority(t *testing.T) {
+	ranges := []IPRange{*newIPRange("10.96.0.0/12"), *newIPRange("10.96.0.0/12"), *newIPRange("10.96.0.0/12")}
+	ranges[0].Name, ranges[0].Spec.Priority = "b", 0
+	ranges[1].Name, ranges[1].Spec.Priority = "a", 0
+	ranges[2].Name, ranges[2].Spec.Priority = "c", 10
+	sort.Sort(ByPriority(ranges))
+	for i, name := range []string{"c", "a", "b"} {
+		if ranges[i].Name != name {
+			t.Fatalf("expected %s at position %d, got %s", name, i, ranges[i].Name)
+		}
+	}
+}
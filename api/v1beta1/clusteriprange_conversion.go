@@ -0,0 +1,113 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+// The scope of a CustomResourceDefinition is the same for all its versions, so the
+// cluster-scoped ClusterIPRange can not be served as a version of the namespaced IPRange.
+// The ClusterIPRange only has the range, the addresses and the reservations of the IPRange,
+// the conversion keeps these fields and drops the rest.
+
+// ConvertFromIPRange converts a namespaced v1 IPRange to a ClusterIPRange.
+// The name, labels, annotations, range, addresses, reservations, free addresses and conditions
+// are preserved. The namespace and the IPRange fields the ClusterIPRange doesn't have are lost:
+// allowedNamespaces, namespaceSelector, namespaceQuotas, defaultNamespaceQuota, serviceSelector,
+// priority, stickyReservationTTL, stickyReservations, owners, the namespace of the reservations
+// and the namespaceUsage of the status.
+// The ClusterIPRange does not share memory with the IPRange.
+func (r *ClusterIPRange) ConvertFromIPRange(src *clusteripv1.IPRange) {
+	r.ObjectMeta = metav1.ObjectMeta{
+		Name:        src.Name,
+		Labels:      copyStringMap(src.Labels),
+		Annotations: copyStringMap(src.Annotations),
+	}
+	r.Spec.Range = src.Spec.Range
+	r.Spec.Addresses = copyStrings(src.Spec.Addresses)
+	r.Spec.Reservations = nil
+	for _, reservation := range src.Spec.Reservations {
+		r.Spec.Reservations = append(r.Spec.Reservations, Reservation{
+			Address: reservation.Address,
+			Expires: reservation.Expires,
+		})
+	}
+	r.Status.Free = src.Status.Free
+	r.Status.Conditions = copyConditions(src.Status.Conditions)
+}
+
+// ConvertToIPRange converts a ClusterIPRange to a v1 IPRange in the given namespace,
+// the IPRange fields the ClusterIPRange doesn't have are left empty. It is used to validate
+// the ClusterIPRanges with the rules of the IPRanges.
+// The IPRange does not share memory with the ClusterIPRange.
+func (r *ClusterIPRange) ConvertToIPRange(dst *clusteripv1.IPRange, namespace string) {
+	dst.ObjectMeta = metav1.ObjectMeta{
+		Namespace:   namespace,
+		Name:        r.Name,
+		Labels:      copyStringMap(r.Labels),
+		Annotations: copyStringMap(r.Annotations),
+	}
+	dst.Spec.Range = r.Spec.Range
+	dst.Spec.Addresses = copyStrings(r.Spec.Addresses)
+	dst.Spec.Reservations = nil
+	for _, reservation := range r.Spec.Reservations {
+		dst.Spec.Reservations = append(dst.Spec.Reservations, clusteripv1.Reservation{
+			Address: reservation.Address,
+			Expires: reservation.Expires,
+		})
+	}
+	dst.Status.Free = r.Status.Free
+	dst.Status.Conditions = copyConditions(r.Status.Conditions)
+}
+
+func copyStringMap(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+func copyStrings(in []string) []string {
+	if in == nil {
+		return nil
+	}
+	return append([]string{}, in...)
+}
+
+func copyConditions(in []metav1.Condition) []metav1.Condition {
+	if in == nil {
+		return nil
+	}
+	out := make([]metav1.Condition, len(in))
+	for i := range in {
+		in[i].DeepCopyInto(&out[i])
+	}
+	return out
+}
+
+// GetReserved returns the addresses of the range that are never allocated dynamically,
+// they are kept in the conversion annotation of the IPRange it was converted from.
+func (r *ClusterIPRange) GetReserved() []string {
+	return clusteripv1.ReservedFromAnnotations(r.Annotations)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+func TestConvertIPRange(t *testing.T) {
+	src := &clusteripv1.IPRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "kube-system",
+			Name:            "allocator",
+			ResourceVersion: "12",
+			Labels:          map[string]string{"family": "ipv4"},
+		},
+		Spec: clusteripv1.IPRangeSpec{
+			Range:     "10.96.0.0/24",
+			Addresses: []string{"10.96.0.1", "10.96.0.10"},
+		},
+		Status: clusteripv1.IPRangeStatus{
+			Free: 252,
+		},
+	}
+
+	dst := &ClusterIPRange{}
+	dst.ConvertFromIPRange(src)
+	if dst.Namespace != "" || dst.ResourceVersion != "" {
+		t.Fatalf("expected cluster-scoped object without resource version, got %v", dst.ObjectMeta)
+	}
+	if dst.Name != src.Name || !reflect.DeepEqual(dst.Labels, src.Labels) {
+		t.Fatalf("expected metadata to be preserved, got %v", dst.ObjectMeta)
+	}
+	if dst.Spec.Range != src.Spec.Range || !reflect.DeepEqual(dst.Spec.Addresses, src.Spec.Addresses) || dst.Status.Free != src.Status.Free {
+		t.Fatalf("expected spec and status to be preserved, got %v %v", dst.Spec, dst.Status)
+	}
+
+	back := &clusteripv1.IPRange{}
+	dst.ConvertToIPRange(back, "kube-system")
+	src.ResourceVersion = ""
+	if !reflect.DeepEqual(src, back) {
+		t.Fatalf("expected round trip conversion of the ClusterIPRange fields to be lossless,\nexpected %v\ngot %v", src, back)
+	}
+
+	// the converted objects do not share memory with the source
+	dst.Labels["family"] = "ipv6"
+	dst.Spec.Addresses[0] = "10.96.0.2"
+	if src.Labels["family"] != "ipv4" || src.Spec.Addresses[0] != "10.96.0.1" {
+		t.Fatalf("expected the IPRange to not be modified, got %v %v", src.Labels, src.Spec.Addresses)
+	}
+	back.Labels["family"] = "ipv6"
+	back.Spec.Addresses[1] = "10.96.0.20"
+	if dst.Labels["family"] != "ipv6" || dst.Spec.Addresses[1] != "10.96.0.10" {
+		t.Fatalf("expected the ClusterIPRange to not be modified, got %v %v", dst.Labels, dst.Spec.Addresses)
+	}
+}
+
+func TestConvertIPRangeDroppedFields(t *testing.T) {
+	src := &clusteripv1.IPRange{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "allocator"},
+		Spec: clusteripv1.IPRangeSpec{
+			Range:             "10.96.0.0/24",
+			Addresses:         []string{"10.96.0.1"},
+			AllowedNamespaces: []string{"tenant-a"},
+			NamespaceQuotas:   []clusteripv1.NamespaceQuota{{Namespace: "tenant-a", Limit: 10}},
+			Priority:          10,
+			Reservations:      []clusteripv1.Reservation{{Address: "10.96.0.1", Namespace: "tenant-a"}},
+			Owners:            []clusteripv1.AddressOwner{{Address: "10.96.0.1", Namespace: "tenant-a", Name: "web"}},
+		},
+		Status: clusteripv1.IPRangeStatus{
+			NamespaceUsage: []clusteripv1.NamespaceUsage{{Namespace: "tenant-a", Allocated: 1, Limit: 10}},
+		},
+	}
+	dst := &ClusterIPRange{}
+	dst.ConvertFromIPRange(src)
+	back := &clusteripv1.IPRange{}
+	dst.ConvertToIPRange(back, "kube-system")
+	expected := clusteripv1.IPRangeSpec{
+		Range:        "10.96.0.0/24",
+		Addresses:    []string{"10.96.0.1"},
+		Reservations: []clusteripv1.Reservation{{Address: "10.96.0.1"}},
+	}
+	if !reflect.DeepEqual(back.Spec, expected) || back.Status.NamespaceUsage != nil {
+		t.Fatalf("expected only the ClusterIPRange fields to be kept, got %#v %#v", back.Spec, back.Status)
+	}
+}
+
+func TestValidateClusterIPRange(t *testing.T) {
+	r := &ClusterIPRange{
+		ObjectMeta: metav1.ObjectMeta{Name: "allocator"},
+		Spec:       ClusterIPRangeSpec{Range: "10.96.0.0/24"},
+	}
+	if err := r.ValidateCreate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated := r.DeepCopy()
+	updated.Spec.Addresses = []string{"10.96.1.1"}
+	if err := updated.ValidateUpdate(r); err == nil {
+		t.Fatalf("expected error for out of range address")
+	}
+	if err := updated.ValidateDelete(); err == nil {
+		t.Fatalf("expected error deleting range with addresses")
+	}
+}
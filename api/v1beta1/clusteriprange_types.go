@@ -0,0 +1,123 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// ClusterIPRangeSpec defines the desired state of ClusterIPRange
+type ClusterIPRangeSpec struct {
+	// Range represent the IP range in CIDR format
+	// i.e. 10.0.0.0/16 or 2001:db2::/64
+	// +kubebuilder:validation:MaxLength=128
+	// +kubebuilder:validation:MinLength=8
+	Range string `json:"range,omitempty"`
+
+	// +optional
+	// Addresses represent the IP addresses of the range and its status.
+	// Each address may be associated to one kubernetes object (i.e. Services)
+	// +listType=set
+	Addresses []string `json:"addresses,omitempty"`
+	// +optional
+	// Reservations are the addresses allocated by the webhook that are not confirmed yet,
+	// the controller releases them if no Service uses them before they expire.
+	// +listType=map
+	// +listMapKey=address
+	Reservations []Reservation `json:"reservations,omitempty"`
+}
+
+// Reservation is an address allocated by the webhook that is not confirmed yet
+type Reservation struct {
+	// Address is the reserved IP address
+	Address string `json:"address"`
+	// Expires is the time the reservation is released if it was not confirmed
+	Expires metav1.Time `json:"expires"`
+}
+
+// ClusterIPRangeStatus defines the observed state of ClusterIPRange
+type ClusterIPRangeStatus struct {
+	// Free represent the number of IP addresses that are not allocated in the Range
+	// +optional
+	Free int64 `json:"free,omitempty"`
+
+	// Conditions represent the latest available observations of the ClusterIPRange state
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+
+// ClusterIPRange is the Schema for the clusteripranges API,
+// the cluster-scoped variant of the namespaced v1 IPRange.
+type ClusterIPRange struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterIPRangeSpec   `json:"spec,omitempty"`
+	Status ClusterIPRangeStatus `json:"status,omitempty"`
+}
+
+// GetRange returns the IP range in CIDR format.
+func (r *ClusterIPRange) GetRange() string {
+	return r.Spec.Range
+}
+
+// GetAddresses returns the allocated addresses of the range.
+func (r *ClusterIPRange) GetAddresses() []string {
+	return r.Spec.Addresses
+}
+
+// SetAddresses sets the allocated addresses of the range.
+func (r *ClusterIPRange) SetAddresses(addresses []string) {
+	r.Spec.Addresses = addresses
+}
+
+// GetReservations returns the expiration time of the reserved addresses of the range.
+func (r *ClusterIPRange) GetReservations() map[string]metav1.Time {
+	reservations := map[string]metav1.Time{}
+	for _, reservation := range r.Spec.Reservations {
+		reservations[reservation.Address] = reservation.Expires
+	}
+	return reservations
+}
+
+// SetReservations sets the reserved addresses of the range with their expiration time.
+func (r *ClusterIPRange) SetReservations(reservations map[string]metav1.Time) {
+	r.Spec.Reservations = nil
+	for _, address := range sets.StringKeySet(reservations).List() {
+		r.Spec.Reservations = append(r.Spec.Reservations, Reservation{Address: address, Expires: reservations[address]})
+	}
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterIPRangeList contains a list of ClusterIPRange
+type ClusterIPRangeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterIPRange `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterIPRange{}, &ClusterIPRangeList{})
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"net"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	"github.com/aojea/clusterip-webhook/internal/services"
+)
+
+// log is for logging in this package.
+var clusteriprangelog = logf.Log.WithName("clusteriprange-resource")
+
+// clusteriprangeClient is used by the webhook to check the Services that are using the ClusterIPRange addresses.
+var clusteriprangeClient client.Reader
+
+func (r *ClusterIPRange) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	clusteriprangeClient = mgr.GetClient()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-clusterip-allocator-x-k8s-io-v1beta1-clusteriprange,mutating=true,failurePolicy=fail,groups=clusterip.allocator.x-k8s.io,resources=clusteripranges,verbs=create;update,versions=v1beta1,name=mclusteriprange.kb.io
+
+var _ webhook.Defaulter = &ClusterIPRange{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *ClusterIPRange) Default() {
+	clusteriprangelog.Info("default", "name", r.Name)
+	// store the Range in its canonical form, i.e. 10.96.0.2/24 -> 10.96.0.0/24
+	if _, ipRange, err := net.ParseCIDR(r.Spec.Range); err == nil {
+		r.Spec.Range = ipRange.String()
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update;delete,path=/validate-clusterip-allocator-x-k8s-io-v1beta1-clusteriprange,mutating=false,failurePolicy=fail,groups=clusterip.allocator.x-k8s.io,resources=clusteripranges,versions=v1beta1,name=vclusteriprange.kb.io
+
+var _ webhook.Validator = &ClusterIPRange{}
+
+// The ClusterIPRange has the same validation rules than the v1 IPRange.
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterIPRange) ValidateCreate() error {
+	clusteriprangelog.Info("validate create", "name", r.Name)
+	return r.toInvalid(clusteripv1.ValidateIPRangeCreate(r.toIPRange()))
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterIPRange) ValidateUpdate(old runtime.Object) error {
+	oldClusterIPRange := old.(*ClusterIPRange)
+	clusteriprangelog.Info("validate update", "name", r.Name)
+	return r.toInvalid(clusteripv1.ValidateIPRangeUpdate(r.toIPRange(), oldClusterIPRange.toIPRange()))
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterIPRange) ValidateDelete() error {
+	clusteriprangelog.Info("validate delete", "name", r.Name)
+	svcIPs, err := services.ClusterIPs(context.Background(), clusteriprangeClient)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	allErrs := clusteripv1.ValidateIPRangeDelete(r.toIPRange(), svcIPs)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewForbidden(GroupVersion.WithResource("clusteripranges").GroupResource(), r.Name, allErrs.ToAggregate())
+}
+
+// toIPRange returns the v1 IPRange equivalent used for validation.
+func (r *ClusterIPRange) toIPRange() *clusteripv1.IPRange {
+	ipRange := &clusteripv1.IPRange{}
+	r.ConvertToIPRange(ipRange, "")
+	return ipRange
+}
+
+// toInvalid converts a list of field errors to an Invalid API status error,
+// so clients like kubectl are able to show the errors per field.
+func (r *ClusterIPRange) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("ClusterIPRange").GroupKind(), r.Name, allErrs)
+}
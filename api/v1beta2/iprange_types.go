@@ -0,0 +1,210 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ForceDeleteAnnotation allows to delete an IPRange that still has addresses allocated
+// to Services. The controller drains the range before it is deleted.
+const ForceDeleteAnnotation = "clusterip.allocator.x-k8s.io/force-delete"
+
+// IPRangeSpec defines the desired state of IPRange
+type IPRangeSpec struct {
+	// Range represent the IP range in CIDR format
+	// i.e. 10.0.0.0/16 or 2001:db2::/64
+	// +kubebuilder:validation:MaxLength=128
+	// +kubebuilder:validation:MinLength=8
+	Range string `json:"range,omitempty"`
+
+	// Reserved addresses of the range are never allocated dynamically,
+	// they can only be allocated explicitly.
+	// +optional
+	// +listType=set
+	Reserved []string `json:"reserved,omitempty"`
+
+	// +optional
+	// Addresses represent the IP addresses allocated from the range and its owner.
+	// +listType=map
+	// +listMapKey=address
+	Addresses []IPAddress `json:"addresses,omitempty"`
+	// +optional
+	// Reservations are the addresses allocated by the webhook that are not confirmed yet,
+	// the controller releases them if no Service uses them before they expire.
+	// +listType=map
+	// +listMapKey=address
+	Reservations []Reservation `json:"reservations,omitempty"`
+
+	// AllowedNamespaces are the namespaces of the Services that can allocate addresses from the range.
+	// All the namespaces are allowed if neither AllowedNamespaces nor NamespaceSelector are set.
+	// +optional
+	// +listType=set
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// NamespaceSelector selects by label the namespaces of the Services that can allocate
+	// addresses from the range, in addition to the AllowedNamespaces.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// NamespaceQuotas limit the number of addresses of the range the Services of each namespace can hold.
+	// +optional
+	// +listType=map
+	// +listMapKey=namespace
+	NamespaceQuotas []NamespaceQuota `json:"namespaceQuotas,omitempty"`
+	// DefaultNamespaceQuota limits the number of addresses of the namespaces without NamespaceQuota,
+	// they are not limited if it is not set.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	DefaultNamespaceQuota *int64 `json:"defaultNamespaceQuota,omitempty"`
+	// ServiceSelector selects by label the Services that allocate addresses from the range,
+	// the range is used by all the Services if it is not set.
+	// +optional
+	ServiceSelector *metav1.LabelSelector `json:"serviceSelector,omitempty"`
+	// Priority of the range, the Services allocate addresses from the range with the highest
+	// priority that selects them and has free addresses.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// StickyReservationTTL is the time the address of a deleted Service is held for a new Service with
+	// the same namespace and name, the address is released when the Service is deleted if it is not set.
+	// +optional
+	StickyReservationTTL *metav1.Duration `json:"stickyReservationTTL,omitempty"`
+	// StickyReservations bind addresses of the range to the namespace and name of a Service,
+	// a Service created with that namespace and name gets the address back.
+	// +optional
+	// +listType=map
+	// +listMapKey=address
+	StickyReservations []StickyReservation `json:"stickyReservations,omitempty"`
+}
+
+// IPAddress represents an allocated IP address
+type IPAddress struct {
+	// Address is the allocated IP address
+	Address string `json:"address"`
+
+	// Owner is the object the address is allocated to, i.e. a Service
+	// +optional
+	Owner *OwnerReference `json:"owner,omitempty"`
+}
+
+// OwnerReference identifies the object an address is allocated to
+type OwnerReference struct {
+	// Kind of the owner object, i.e. Service
+	Kind string `json:"kind"`
+	// Namespace of the owner object
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Name of the owner object
+	Name string `json:"name"`
+	// UID of the owner object
+	// +optional
+	UID types.UID `json:"uid,omitempty"`
+}
+
+// Reservation is an address allocated by the webhook that is not confirmed yet
+type Reservation struct {
+	// Address is the reserved IP address
+	Address string `json:"address"`
+	// Expires is the time the reservation is released if it was not confirmed
+	Expires metav1.Time `json:"expires"`
+	// Namespace of the Service the address is reserved for, the reservation counts
+	// against the quota of the namespace until it is confirmed
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// StickyReservation binds an address of the range to the namespace and name of a Service
+type StickyReservation struct {
+	// Address is the reserved IP address
+	Address string `json:"address"`
+	// Namespace of the Service
+	Namespace string `json:"namespace"`
+	// Name of the Service
+	Name string `json:"name"`
+	// Expires is the time the address is released if no Service uses it,
+	// the address is held until the reservation is removed if it is not set.
+	// +optional
+	Expires *metav1.Time `json:"expires,omitempty"`
+}
+
+// NamespaceQuota limits the number of addresses of the range the Services of a namespace can hold
+type NamespaceQuota struct {
+	// Namespace of the Services
+	Namespace string `json:"namespace"`
+	// Limit is the maximum number of addresses
+	// +kubebuilder:validation:Minimum=0
+	Limit int64 `json:"limit"`
+}
+
+// NamespaceUsage is the number of addresses of the range held by the Services of a namespace
+type NamespaceUsage struct {
+	// Namespace of the Services
+	Namespace string `json:"namespace"`
+	// Allocated is the number of addresses held by the Services of the namespace
+	Allocated int64 `json:"allocated"`
+	// Limit is the quota of the namespace
+	Limit int64 `json:"limit"`
+}
+
+// IPRangeStatus defines the observed state of IPRange
+type IPRangeStatus struct {
+	// Free represent the number of IP addresses that are not allocated in the Range
+	// +optional
+	Free int64 `json:"free,omitempty"`
+
+	// NamespaceUsage reports the addresses held by the namespaces with quota
+	// +optional
+	// +listType=map
+	// +listMapKey=namespace
+	NamespaceUsage []NamespaceUsage `json:"namespaceUsage,omitempty"`
+
+	// Conditions represent the latest available observations of the IPRange state
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// IPRange is the Schema for the ipranges API
+type IPRange struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IPRangeSpec   `json:"spec,omitempty"`
+	Status IPRangeStatus `json:"status,omitempty"`
+}
+
+// IsForceDelete returns true if the IPRange has been marked to be drained and deleted
+// even if it has addresses allocated.
+func (r *IPRange) IsForceDelete() bool {
+	return r.Annotations[ForceDeleteAnnotation] == "true"
+}
+
+// +kubebuilder:object:root=true
+
+// IPRangeList contains a list of IPRange
+type IPRangeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPRange `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IPRange{}, &IPRangeList{})
+}
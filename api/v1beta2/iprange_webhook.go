@@ -0,0 +1,211 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta2
+
+import (
+	"context"
+	"net"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	"github.com/aojea/clusterip-webhook/internal/services"
+	"github.com/aojea/clusterip-webhook/internal/validation"
+)
+
+// log is for logging in this package.
+var iprangelog = logf.Log.WithName("iprange-resource")
+
+// iprangeClient is used by the webhook to check the Services that are using the IPRange addresses.
+var iprangeClient client.Reader
+
+func (r *IPRange) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	iprangeClient = mgr.GetClient()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-clusterip-allocator-x-k8s-io-v1beta2-iprange,mutating=true,failurePolicy=fail,groups=clusterip.allocator.x-k8s.io,resources=ipranges,verbs=create;update,versions=v1beta2,name=miprange-v1beta2.kb.io
+
+var _ webhook.Defaulter = &IPRange{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *IPRange) Default() {
+	iprangelog.Info("default", "name", r.Name)
+	// store the Range in its canonical form, i.e. 10.96.0.2/24 -> 10.96.0.0/24
+	if _, ipRange, err := net.ParseCIDR(r.Spec.Range); err == nil {
+		r.Spec.Range = ipRange.String()
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update;delete,path=/validate-clusterip-allocator-x-k8s-io-v1beta2-iprange,mutating=false,failurePolicy=fail,groups=clusterip.allocator.x-k8s.io,resources=ipranges,versions=v1beta2,name=viprange-v1beta2.kb.io
+
+var _ webhook.Validator = &IPRange{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *IPRange) ValidateCreate() error {
+	iprangelog.Info("validate create", "name", r.Name)
+	return r.toInvalid(ValidateIPRangeCreate(r))
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *IPRange) ValidateUpdate(old runtime.Object) error {
+	oldIPRange := old.(*IPRange)
+	iprangelog.Info("validate update", "name", r.Name)
+	return r.toInvalid(ValidateIPRangeUpdate(r, oldIPRange))
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *IPRange) ValidateDelete() error {
+	iprangelog.Info("validate delete", "name", r.Name)
+	svcIPs, err := services.ClusterIPs(context.Background(), iprangeClient)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	allErrs := ValidateIPRangeDelete(r, svcIPs)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewForbidden(GroupVersion.WithResource("ipranges").GroupResource(), r.Name, allErrs.ToAggregate())
+}
+
+// toInvalid converts a list of field errors to an Invalid API status error,
+// so clients like kubectl are able to show the errors per field.
+func (r *IPRange) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("IPRange").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateIPRangeCreate validates a new IPRange, addresses can not be allocated on creation.
+func ValidateIPRangeCreate(r *IPRange) field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+	_, ipRange, err := net.ParseCIDR(r.Spec.Range)
+	if err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("range"), r.Spec.Range, "must be a valid CIDR, i.e. 10.0.0.0/16 or 2001:db2::/64"))
+	}
+	if len(r.Spec.Addresses) > 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("addresses"), "addresses can not be allocated on creation"))
+	}
+	if ipRange != nil {
+		allErrs = append(allErrs, validation.Reserved(r.Spec.Reserved, ipRange, specPath.Child("reserved"))...)
+	}
+	allErrs = append(allErrs, validation.NamespacePolicy(r.Spec.AllowedNamespaces, r.Spec.NamespaceSelector, specPath)...)
+	allErrs = append(allErrs, validation.NamespaceQuotas(namespaceQuotas(r.Spec.NamespaceQuotas), r.Spec.DefaultNamespaceQuota, specPath)...)
+	allErrs = append(allErrs, metav1validation.ValidateLabelSelector(r.Spec.ServiceSelector, specPath.Child("serviceSelector"))...)
+	allErrs = append(allErrs, validation.StickyReservations(stickyReservations(r.Spec.StickyReservations), r.Spec.StickyReservationTTL, ipRange, specPath)...)
+	return allErrs
+}
+
+// ValidateIPRangeUpdate validates the changes on an existing IPRange,
+// the Range is immutable and the Addresses have to belong to the Range.
+func ValidateIPRangeUpdate(r, old *IPRange) field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+	allErrs = append(allErrs, apivalidation.ValidateImmutableField(r.Spec.Range, old.Spec.Range, specPath.Child("range"))...)
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+	_, ipRange, err := net.ParseCIDR(r.Spec.Range)
+	if err != nil {
+		return append(allErrs, field.Invalid(specPath.Child("range"), r.Spec.Range, "must be a valid CIDR"))
+	}
+	allErrs = append(allErrs, validation.Reserved(r.Spec.Reserved, ipRange, specPath.Child("reserved"))...)
+	allErrs = append(allErrs, validateAddresses(r.Spec.Addresses, ipRange, specPath.Child("addresses"))...)
+	addresses := sets.NewString()
+	for _, address := range r.Spec.Addresses {
+		addresses.Insert(address.Address)
+	}
+	allErrs = append(allErrs, validation.Reservations(reservedAddresses(r.Spec.Reservations), addresses, specPath.Child("reservations"))...)
+	allErrs = append(allErrs, validation.NamespacePolicy(r.Spec.AllowedNamespaces, r.Spec.NamespaceSelector, specPath)...)
+	allErrs = append(allErrs, validation.NamespaceQuotas(namespaceQuotas(r.Spec.NamespaceQuotas), r.Spec.DefaultNamespaceQuota, specPath)...)
+	allErrs = append(allErrs, metav1validation.ValidateLabelSelector(r.Spec.ServiceSelector, specPath.Child("serviceSelector"))...)
+	allErrs = append(allErrs, validation.StickyReservations(stickyReservations(r.Spec.StickyReservations), r.Spec.StickyReservationTTL, ipRange, specPath)...)
+	return allErrs
+}
+
+// ValidateIPRangeDelete validates that an IPRange can be deleted.
+// svcIPs maps the ClusterIPs of the existing Services to the Service namespace/name,
+// if it is nil all the addresses are considered in use.
+func ValidateIPRangeDelete(r *IPRange, svcIPs map[string]string) field.ErrorList {
+	// the controller drains the range before it is deleted
+	if r.IsForceDelete() {
+		return field.ErrorList{}
+	}
+	var addresses []string
+	for _, address := range r.Spec.Addresses {
+		addresses = append(addresses, address.Address)
+	}
+	return validation.Delete(addresses, svcIPs, field.NewPath("spec", "addresses"))
+}
+
+// validateAddresses validates that each address is a valid IP that belongs to the range
+// and is not reserved, and that its owner is complete.
+func validateAddresses(addresses []IPAddress, ipRange *net.IPNet, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, address := range addresses {
+		idxPath := fldPath.Index(i)
+		allErrs = append(allErrs, validation.Address(address.Address, ipRange, idxPath.Child("address"))...)
+		if address.Owner != nil {
+			if address.Owner.Kind == "" {
+				allErrs = append(allErrs, field.Required(idxPath.Child("owner", "kind"), ""))
+			}
+			if address.Owner.Name == "" {
+				allErrs = append(allErrs, field.Required(idxPath.Child("owner", "name"), ""))
+			}
+		}
+	}
+	return allErrs
+}
+
+// namespaceQuotas returns the quotas of the namespaces to validate them.
+func namespaceQuotas(quotas []NamespaceQuota) []validation.NamespaceQuota {
+	var out []validation.NamespaceQuota
+	for _, quota := range quotas {
+		out = append(out, validation.NamespaceQuota{Namespace: quota.Namespace, Limit: quota.Limit})
+	}
+	return out
+}
+
+// reservedAddresses returns the addresses of the reservations to validate them.
+func reservedAddresses(reservations []Reservation) []string {
+	var out []string
+	for _, reservation := range reservations {
+		out = append(out, reservation.Address)
+	}
+	return out
+}
+
+// stickyReservations returns the sticky reservations to validate them.
+func stickyReservations(reservations []StickyReservation) []validation.StickyReservation {
+	var out []validation.StickyReservation
+	for _, reservation := range reservations {
+		out = append(out, validation.StickyReservation{Address: reservation.Address, Namespace: reservation.Namespace, Name: reservation.Name})
+	}
+	return out
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta2
+
+import (
+	"net"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func newIPRange(cidr string, addresses ...IPAddress) *IPRange {
+	return &IPRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      "allocator",
+		},
+		Spec: IPRangeSpec{
+			Range:     cidr,
+			Addresses: addresses,
+		},
+	}
+}
+
+func TestValidateIPRange(t *testing.T) {
+	specPath := field.NewPath("spec")
+	testCases := []struct {
+		name     string
+		old      *IPRange
+		ipRange  *IPRange
+		expected []string
+	}{
+		{
+			name:    "valid creation",
+			ipRange: newIPRange("10.96.0.0/24"),
+		},
+		{
+			name: "reserved address out of range",
+			ipRange: func() *IPRange {
+				r := newIPRange("10.96.0.0/24")
+				r.Spec.Reserved = []string{"10.96.0.10", "10.96.1.10"}
+				return r
+			}(),
+			expected: []string{specPath.Child("reserved").Index(1).String()},
+		},
+		{
+			name:    "valid allocation with owner",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", IPAddress{Address: "10.96.0.1", Owner: &OwnerReference{Kind: "Service", Name: "kubernetes"}}),
+		},
+		{
+			name:    "invalid allocations",
+			old:     newIPRange("10.96.0.0/24"),
+			ipRange: newIPRange("10.96.0.0/24", IPAddress{Address: "10.96.0.0"}, IPAddress{Address: "10.96.0.2", Owner: &OwnerReference{}}),
+			expected: []string{
+				specPath.Child("addresses").Index(0).Child("address").String(),
+				specPath.Child("addresses").Index(1).Child("owner", "kind").String(),
+				specPath.Child("addresses").Index(1).Child("owner", "name").String(),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var allErrs field.ErrorList
+			if tc.old == nil {
+				allErrs = ValidateIPRangeCreate(tc.ipRange)
+			} else {
+				allErrs = ValidateIPRangeUpdate(tc.ipRange, tc.old)
+			}
+			if len(allErrs) != len(tc.expected) {
+				t.Fatalf("expected errors %v, got %v", tc.expected, allErrs)
+			}
+			for i := range allErrs {
+				if allErrs[i].Field != tc.expected[i] {
+					t.Errorf("expected error on %s, got %v", tc.expected[i], allErrs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultRange(t *testing.T) {
+	r := newIPRange("10.96.0.2/24")
+	r.Default()
+	if r.Spec.Range != "10.96.0.0/24" {
+		t.Fatalf("unexpected defaults %#v", r.Spec)
+	}
+}
+
+func TestServiceIPName(t *testing.T) {
+	testCases := []struct {
+		ip   string
+		name string
+	}{
+		{ip: "10.96.0.1", name: "10.96.0.1"},
+		{ip: "::ffff:10.96.0.1", name: "10.96.0.1"},
+		{ip: "2001:db2::1", name: "2001-0db2-0000-0000-0000-0000-0000-0001"},
+		{ip: "::1", name: "0000-0000-0000-0000-0000-0000-0000-0001"},
+	}
+	for _, tc := range testCases {
+		ip := net.ParseIP(tc.ip)
+		name := ServiceIPName(ip)
+		if name != tc.name {
+			t.Errorf("expected name %s for %s, got %s", tc.name, tc.ip, name)
+		}
+		if !ParseServiceIPName(name).Equal(ip) {
+			t.Errorf("expected %s to be parsed as %s, got %v", name, tc.ip, ParseServiceIPName(name))
+		}
+	}
+}
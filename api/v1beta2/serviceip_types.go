@@ -0,0 +1,99 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta2
+
+import (
+	"net"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ServiceIPRangeLabel is set on the ServiceIPs with the name of the range they were allocated from.
+const ServiceIPRangeLabel = "clusterip.allocator.x-k8s.io/range"
+
+// ServiceIPExpiresAnnotation is set on the ServiceIPs reserved for a Service that does not exist yet,
+// with the RFC3339 time the reservation expires if no Service uses the address.
+const ServiceIPExpiresAnnotation = "clusterip.allocator.x-k8s.io/expires"
+
+// ServiceIPSpec defines the desired state of ServiceIP
+type ServiceIPSpec struct {
+	// Range is the IP range in CIDR format the address was allocated from
+	// +kubebuilder:validation:MaxLength=128
+	// +kubebuilder:validation:MinLength=8
+	Range string `json:"range"`
+
+	// Owner is the object the address is allocated to, i.e. a Service.
+	// ServiceIPs are cluster-scoped so they can not use an ownerReference to a namespaced object,
+	// the controller releases the ServiceIPs whose owner no longer exists.
+	// +optional
+	Owner *OwnerReference `json:"owner,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// ServiceIP is the Schema for the serviceips API, each object represents an allocated IP address
+// and is named after it, so the apiserver guarantees that an address is not allocated twice.
+type ServiceIP struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ServiceIPSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ServiceIPList contains a list of ServiceIP
+type ServiceIPList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ServiceIP `json:"items"`
+}
+
+// ServiceIPName returns the object name for the IP address. Object names have to be
+// DNS subdomains, so IPv6 addresses are expanded and the colons replaced by dashes,
+// i.e. 2001:db2::1 -> 2001-0db2-0000-0000-0000-0000-0000-0001
+func ServiceIPName(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.To4().String()
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	groups := make([]string, 0, 8)
+	for i := 0; i < len(ip); i += 2 {
+		groups = append(groups, hexByte(ip[i])+hexByte(ip[i+1]))
+	}
+	return strings.Join(groups, "-")
+}
+
+// ParseServiceIPName returns the IP address represented by the ServiceIP name,
+// or nil if the name does not represent an IP address.
+func ParseServiceIPName(name string) net.IP {
+	return net.ParseIP(strings.ReplaceAll(name, "-", ":"))
+}
+
+func hexByte(b byte) string {
+	const digits = "0123456789abcdef"
+	return string([]byte{digits[b>>4], digits[b&0x0f]})
+}
+
+func init() {
+	SchemeBuilder.Register(&ServiceIP{}, &ServiceIPList{})
+}
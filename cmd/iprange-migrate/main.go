@@ -0,0 +1,106 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// iprange-migrate creates the IPRanges of the Services range configured in the apiserver,
+// with the ClusterIPs of the existing Services allocated, and reports the ClusterIPs that
+// can not be migrated.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	"github.com/aojea/clusterip-webhook/pkg/migrate"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+}
+
+func main() {
+	var serviceCIDRs string
+	var namespace, name string
+	var dryRun bool
+	flag.StringVar(&serviceCIDRs, "service-cluster-ip-range", "",
+		"The value of the apiserver --service-cluster-ip-range flag, one CIDR per IP family separated by commas.")
+	flag.StringVar(&namespace, "namespace", "kube-system", "The namespace of the IPRanges.")
+	flag.StringVar(&name, "name", "allocator",
+		"The name of the IPRange of the first range, the other range is named <name>-ipv4 or <name>-ipv6.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only report the migration, the IPRanges are not created.")
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New())
+
+	var cidrs []*net.IPNet
+	for _, value := range strings.Split(serviceCIDRs, ",") {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(value))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --service-cluster-ip-range %q: %v\n", serviceCIDRs, err)
+			os.Exit(2)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	ctx := context.Background()
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create client: %v\n", err)
+		os.Exit(1)
+	}
+	var svcList v1.ServiceList
+	if err := c.List(ctx, &svcList); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to list Services: %v\n", err)
+		os.Exit(1)
+	}
+	plan, err := migrate.NewPlan(client.ObjectKey{Namespace: namespace, Name: name}, cidrs, svcList.Items)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for _, r := range plan.Ranges {
+		fmt.Printf("IPRange %s range %s: %d addresses\n", r.Key, r.CIDR, r.Addresses.Len())
+	}
+	for _, conflict := range plan.Conflicts {
+		fmt.Printf("Service %s ClusterIP %s can not be migrated: %s\n", conflict.Service, conflict.ClusterIP, conflict.Reason)
+	}
+	if !dryRun {
+		if err := plan.Apply(ctx, c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if len(plan.Conflicts) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// iprange-snapshot saves the addresses allocated from an IPRange, or a ClusterIPRange,
+// to a file and restores them, i.e. after a cluster rebuild or an etcd restore.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta1.AddToScheme(scheme))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] save|restore
+
+  save     writes the addresses allocated from the IPRange to the file
+  restore  restores the addresses of the file in the IPRange, it is created if it doesn't exist
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	var file string
+	var force bool
+	var namespace, name string
+	flag.StringVar(&file, "f", "-", "The snapshot file, - for the standard input or output.")
+	flag.StringVar(&namespace, "namespace", "kube-system", "The namespace of the IPRange, the ClusterIPRange is used if empty.")
+	flag.StringVar(&name, "name", "allocator", "The name of the IPRange or the ClusterIPRange.")
+	flag.BoolVar(&force, "force", false,
+		"Restore the snapshot even if its addresses don't match the ClusterIPs of the existing Services.")
+	flag.Usage = usage
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New())
+
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create client: %v\n", err)
+		os.Exit(1)
+	}
+
+	key := client.ObjectKey{Namespace: namespace, Name: name}
+	switch flag.Arg(0) {
+	case "save":
+		err = save(c, key, file)
+	case "restore":
+		err = restore(c, key, file, force)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newAllocator returns the allocator of the IPRange, or of the ClusterIPRange if the key has no namespace
+func newAllocator(c client.Client, key client.ObjectKey) *allocator.Range {
+	if key.Namespace == "" {
+		return allocator.NewClusterIPRangeAllocator(key.Name, c, c)
+	}
+	return allocator.NewIPRangeAllocator(key, c, c)
+}
+
+func save(c client.Client, key client.ObjectKey, file string) error {
+	snapshot, err := newAllocator(c, key).Snapshot()
+	if err != nil {
+		return fmt.Errorf("unable to take snapshot: %v", err)
+	}
+	w := io.Writer(os.Stdout)
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return allocator.WriteSnapshot(w, snapshot)
+}
+
+func restore(c client.Client, key client.ObjectKey, file string, force bool) error {
+	r := io.Reader(os.Stdin)
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	snapshot, err := allocator.ReadSnapshot(r)
+	if err != nil {
+		return fmt.Errorf("unable to read snapshot: %v", err)
+	}
+
+	// validate the snapshot against the live Services
+	var svcList v1.ServiceList
+	if err := c.List(context.Background(), &svcList); err != nil {
+		return fmt.Errorf("unable to list Services: %v", err)
+	}
+	missing, orphan, err := snapshot.CompareServices(svcList.Items)
+	if err != nil {
+		return err
+	}
+	for ip, svc := range missing {
+		fmt.Fprintf(os.Stderr, "address %s of Service %s is not in the snapshot\n", ip, svc)
+	}
+	for _, ip := range orphan {
+		fmt.Fprintf(os.Stderr, "address %s of the snapshot is not used by any Service\n", ip)
+	}
+	if (len(missing) > 0 || len(orphan) > 0) && !force {
+		return fmt.Errorf("the snapshot does not match the Services, use --force to restore it")
+	}
+
+	// restore into a new IPRange if it doesn't exist
+	_, cidr, err := net.ParseCIDR(snapshot.Range)
+	if err != nil {
+		return fmt.Errorf("invalid range %q in the snapshot: %v", snapshot.Range, err)
+	}
+	if key.Namespace == "" {
+		_, err = allocator.NewClusterAllocatorCIDRRange(key.Name, cidr, c)
+	} else {
+		_, err = allocator.NewAllocatorCIDRRange(key, cidr, c)
+	}
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("unable to create IPRange: %v", err)
+	}
+	if err := newAllocator(c, key).Restore(snapshot); err != nil {
+		return fmt.Errorf("unable to restore snapshot: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "restored %d addresses in %s\n", len(snapshot.Addresses), key)
+	return nil
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-iprange is a kubectl plugin to inspect and manage the IPRanges,
+// it is invoked as "kubectl iprange" when the binary is in the PATH.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+	"github.com/aojea/clusterip-webhook/pkg/inspect"
+)
+
+var (
+	scheme     = runtime.NewScheme()
+	defaultKey = client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
+)
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta2.AddToScheme(scheme))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: kubectl iprange [--kubeconfig file] command [flags] [args]
+
+Commands:
+  list                      lists the IPRanges of all the namespaces
+  describe [namespace/name] shows the utilisation, owners and fragmentation of the IPRange
+  who-has <ip>              shows the IPRanges and the Services that hold the address
+  reserve <ip>              reserves the address until a Service uses it or the reservation expires
+  release <ip>              releases the address
+  check [namespace/name]    compares the IPRange with the ClusterIPs of the live Services
+  audit                     reports the inconsistencies of all the IPRanges, ClusterIPRanges, ServiceIPs and Services in JSON,
+                            -f reads the objects from a "kubectl get -o json" List instead of the cluster
+
+The IPRange is kube-system/allocator if it is not specified.
+`)
+}
+
+// parseArgs parses the flags of the command, they can be before or after the arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseKey returns the IPRange namespace/name, or the default IPRange if it is not specified
+func parseKey(args []string) (client.ObjectKey, error) {
+	if len(args) == 0 {
+		return defaultKey, nil
+	}
+	if len(args) > 1 {
+		return client.ObjectKey{}, fmt.Errorf("only one IPRange can be specified")
+	}
+	parts := strings.Split(args[0], "/")
+	switch len(parts) {
+	case 1:
+		return client.ObjectKey{Namespace: defaultKey.Namespace, Name: parts[0]}, nil
+	case 2:
+		return client.ObjectKey{Namespace: parts[0], Name: parts[1]}, nil
+	}
+	return client.ObjectKey{}, fmt.Errorf("invalid IPRange %q, it must be namespace/name", args[0])
+}
+
+// parseIP returns the address of the only argument
+func parseIP(args []string) (net.IP, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("one IP address is required")
+	}
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", args[0])
+	}
+	return ip, nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New())
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	command, args := flag.Arg(0), flag.Args()[1:]
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	var output, rangeName, file string
+	var ttl time.Duration
+	var force bool
+	switch command {
+	case "describe", "check":
+		fs.StringVar(&output, "o", "", "Output format, empty or json.")
+	case "reserve":
+		fs.StringVar(&rangeName, "range", defaultKey.String(), "The IPRange namespace/name.")
+		fs.DurationVar(&ttl, "ttl", time.Hour, "The time the address is reserved if no Service uses it.")
+	case "release":
+		fs.StringVar(&rangeName, "range", defaultKey.String(), "The IPRange namespace/name.")
+		fs.BoolVar(&force, "force", false, "Release the address even if a Service uses it.")
+	case "audit":
+		fs.StringVar(&file, "f", "", "The JSON List with the IPRanges and the Services, - for the standard input.")
+	case "list", "who-has":
+	default:
+		usage()
+		os.Exit(2)
+	}
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// the offline audit doesn't connect to the cluster
+	if command == "audit" && file != "" {
+		if err := audit(context.Background(), nil, file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create client: %v\n", err)
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	switch command {
+	case "audit":
+		err = audit(ctx, c, "")
+	case "list":
+		err = list(ctx, c)
+	case "describe":
+		err = describe(ctx, c, args, output)
+	case "who-has":
+		err = whoHas(ctx, c, args)
+	case "reserve":
+		err = reserve(ctx, c, rangeName, args, ttl)
+	case "release":
+		err = release(ctx, c, rangeName, args, force)
+	case "check":
+		err = check(ctx, c, args, output)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func listServices(ctx context.Context, c client.Client) ([]v1.Service, error) {
+	var svcList v1.ServiceList
+	if err := c.List(ctx, &svcList); err != nil {
+		return nil, fmt.Errorf("unable to list Services: %v", err)
+	}
+	return svcList.Items, nil
+}
+
+func getRange(ctx context.Context, c client.Client, args []string) (*clusteripv1.IPRange, error) {
+	key, err := parseKey(args)
+	if err != nil {
+		return nil, err
+	}
+	ipRange := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, key, ipRange); err != nil {
+		return nil, fmt.Errorf("unable to get IPRange %s: %v", key, err)
+	}
+	return ipRange, nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func list(ctx context.Context, c client.Client) error {
+	var rangeList clusteripv1.IPRangeList
+	if err := c.List(ctx, &rangeList); err != nil {
+		return fmt.Errorf("unable to list IPRanges: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tRANGE\tALLOCATED\tRESERVED\tFREE")
+	for i := range rangeList.Items {
+		usage, err := inspect.Describe(&rangeList.Items[i], nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", usage.Namespace, usage.Name, usage.Range, usage.Allocated, usage.Reserved, usage.Free)
+	}
+	return w.Flush()
+}
+
+func describe(ctx context.Context, c client.Client, args []string, output string) error {
+	ipRange, err := getRange(ctx, c, args)
+	if err != nil {
+		return err
+	}
+	services, err := listServices(ctx, c)
+	if err != nil {
+		return err
+	}
+	usage, err := inspect.Describe(ipRange, services)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return printJSON(usage)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s/%s\n", usage.Namespace, usage.Name)
+	fmt.Fprintf(w, "Range:\t%s\n", usage.Range)
+	fmt.Fprintf(w, "Size:\t%d\n", usage.Size)
+	fmt.Fprintf(w, "Allocated:\t%d (%.2f%%)\n", usage.Allocated, usage.Utilisation)
+	fmt.Fprintf(w, "Reserved:\t%d\n", usage.Reserved)
+	fmt.Fprintf(w, "Free:\t%d\n", usage.Free)
+	fmt.Fprintf(w, "Free blocks:\t%d (largest %d, fragmentation %.2f%%)\n", usage.FreeBlocks, usage.LargestFreeBlock, usage.Fragmentation)
+	fmt.Fprintln(w, "Addresses:")
+	fmt.Fprintln(w, "  ADDRESS\tOWNER")
+	for _, address := range usage.Addresses {
+		owner := address.Service
+		switch {
+		case owner == "" && address.Expires != nil:
+			owner = "<reserved until " + address.Expires.UTC().Format(time.RFC3339) + ">"
+		case owner == "":
+			owner = "<none>"
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", address.Address, owner)
+	}
+	return w.Flush()
+}
+
+func whoHas(ctx context.Context, c client.Client, args []string) error {
+	ip, err := parseIP(args)
+	if err != nil {
+		return err
+	}
+	var rangeList clusteripv1.IPRangeList
+	if err := c.List(ctx, &rangeList); err != nil {
+		return fmt.Errorf("unable to list IPRanges: %v", err)
+	}
+	services, err := listServices(ctx, c)
+	if err != nil {
+		return err
+	}
+	allocatedBy, usedBy := inspect.WhoHas(ip, rangeList.Items, services)
+	if len(allocatedBy) == 0 && len(usedBy) == 0 {
+		return fmt.Errorf("address %s is not allocated", ip)
+	}
+	for _, name := range allocatedBy {
+		fmt.Printf("IPRange %s\n", name)
+	}
+	for _, name := range usedBy {
+		fmt.Printf("Service %s\n", name)
+	}
+	return nil
+}
+
+func reserve(ctx context.Context, c client.Client, rangeName string, args []string, ttl time.Duration) error {
+	ip, err := parseIP(args)
+	if err != nil {
+		return err
+	}
+	key, err := parseKey([]string{rangeName})
+	if err != nil {
+		return err
+	}
+	// the controller releases the reservation if no Service uses the address before it expires
+	if err := allocator.NewIPRangeAllocator(key, c, c).Reserve(ip, ttl); err != nil {
+		return fmt.Errorf("unable to reserve %s: %v", ip, err)
+	}
+	fmt.Printf("address %s reserved in %s for %s\n", ip, key, ttl)
+	return nil
+}
+
+func release(ctx context.Context, c client.Client, rangeName string, args []string, force bool) error {
+	ip, err := parseIP(args)
+	if err != nil {
+		return err
+	}
+	key, err := parseKey([]string{rangeName})
+	if err != nil {
+		return err
+	}
+	if !force {
+		services, err := listServices(ctx, c)
+		if err != nil {
+			return err
+		}
+		if _, usedBy := inspect.WhoHas(ip, nil, services); len(usedBy) > 0 {
+			return fmt.Errorf("address %s is used by Service %s, use --force to release it", ip, strings.Join(usedBy, ", "))
+		}
+	}
+	if err := allocator.NewIPRangeAllocator(key, c, c).Release(ip); err != nil {
+		return fmt.Errorf("unable to release %s: %v", ip, err)
+	}
+	fmt.Printf("address %s released from %s\n", ip, key)
+	return nil
+}
+
+func check(ctx context.Context, c client.Client, args []string, output string) error {
+	ipRange, err := getRange(ctx, c, args)
+	if err != nil {
+		return err
+	}
+	services, err := listServices(ctx, c)
+	if err != nil {
+		return err
+	}
+	diff, err := inspect.Check(ipRange, services)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		if err := printJSON(diff); err != nil {
+			return err
+		}
+	} else {
+		for _, ip := range sets.StringKeySet(diff.Missing).List() {
+			fmt.Printf("address %s of Service %s is not allocated\n", ip, diff.Missing[ip])
+		}
+		for _, ip := range diff.Orphan {
+			fmt.Printf("address %s is allocated but not used by any Service\n", ip)
+		}
+	}
+	if !diff.Empty() {
+		return fmt.Errorf("IPRange %s/%s is not in sync with the Services", ipRange.Namespace, ipRange.Name)
+	}
+	return nil
+}
+
+func audit(ctx context.Context, c client.Client, file string) error {
+	objects := &inspect.Objects{}
+	if file != "" {
+		r := io.Reader(os.Stdin)
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		if objects, err = inspect.ReadObjects(r); err != nil {
+			return fmt.Errorf("unable to read objects: %v", err)
+		}
+	} else {
+		var rangeList clusteripv1.IPRangeList
+		if err := c.List(ctx, &rangeList); err != nil {
+			return fmt.Errorf("unable to list IPRanges: %v", err)
+		}
+		// the ClusterIPRanges and the ServiceIPs are optional, their CRDs may not be installed
+		var clusterRangeList clusteripv1beta1.ClusterIPRangeList
+		if err := c.List(ctx, &clusterRangeList); err != nil && !meta.IsNoMatchError(err) {
+			return fmt.Errorf("unable to list ClusterIPRanges: %v", err)
+		}
+		var serviceIPList clusteripv1beta2.ServiceIPList
+		if err := c.List(ctx, &serviceIPList); err != nil && !meta.IsNoMatchError(err) {
+			return fmt.Errorf("unable to list ServiceIPs: %v", err)
+		}
+		services, err := listServices(ctx, c)
+		if err != nil {
+			return err
+		}
+		objects = &inspect.Objects{
+			IPRanges:        rangeList.Items,
+			ClusterIPRanges: clusterRangeList.Items,
+			ServiceIPs:      serviceIPList.Items,
+			Services:        services,
+		}
+	}
+	report := inspect.Audit(objects)
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if !report.Consistent() {
+		return fmt.Errorf("the IPRanges are not consistent with the Services")
+	}
+	return nil
+}
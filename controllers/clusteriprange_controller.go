@@ -0,0 +1,233 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	utilnet "k8s.io/utils/net"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+)
+
+// ClusterIPRangeReconciler reconciles a ClusterIPRange object. The ClusterIPRange tracks all
+// the ClusterIPs of its range: it commits and expires the reservations of the Service webhook,
+// releases the addresses of the deleted Services, protects the range with a finalizer while
+// Services use it and drains it when it is force deleted.
+type ClusterIPRangeReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=clusteripranges,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=clusteripranges/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=clusteripranges/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func (r *ClusterIPRangeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("clusteriprange", req.Name)
+
+	ipRange := &clusteripv1beta1.ClusterIPRange{}
+	if err := r.Get(ctx, req.NamespacedName, ipRange); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// protect the ClusterIPRange from being removed while it is used by Services
+	if ipRange.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(ipRange, clusteripv1.IPRangeFinalizer) {
+		controllerutil.AddFinalizer(ipRange, clusteripv1.IPRangeFinalizer)
+		if err := r.Update(ctx, ipRange); err != nil {
+			log.Error(err, "unable to add finalizer to ClusterIPRange")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Range is validated by the webhook
+	_, cidr, err := net.ParseCIDR(ipRange.Spec.Range)
+	if err != nil {
+		log.Error(err, "invalid range")
+		return ctrl.Result{}, nil
+	}
+	var svcList v1.ServiceList
+	if err := r.List(ctx, &svcList); err != nil {
+		log.Error(err, "unable to list services")
+		return ctrl.Result{}, err
+	}
+	services := map[string]*v1.Service{}
+	for i := range svcList.Items {
+		svc := &svcList.Items[i]
+		if ip := net.ParseIP(svc.Spec.ClusterIP); ip != nil && cidr.Contains(ip) {
+			services[ip.String()] = svc
+		}
+	}
+
+	forceDelete := ipRange.Annotations[clusteripv1.ForceDeleteAnnotation] == "true"
+	if forceDelete && (len(ipRange.Spec.Addresses) > 0 || len(ipRange.Spec.Reservations) > 0) {
+		log.Info("draining ClusterIPRange", "addresses", len(ipRange.Spec.Addresses))
+		for _, address := range ipRange.Spec.Addresses {
+			if svc, ok := services[address]; ok {
+				r.recorder().Eventf(svc, v1.EventTypeWarning, ReasonAddressCleared, "ClusterIP %s is no longer allocated, ClusterIPRange %s is being force deleted", address, ipRange.Name)
+				r.recorder().Eventf(ipRange, v1.EventTypeWarning, ReasonAddressCleared, "Address %s of Service %s/%s cleared", address, svc.Namespace, svc.Name)
+			}
+		}
+		ipRange.Spec.Addresses = nil
+		ipRange.Spec.Reservations = nil
+		if err := r.Update(ctx, ipRange); err != nil {
+			log.Error(err, "unable to update ClusterIPRange")
+			return ctrl.Result{}, err
+		}
+		r.recorder().Event(ipRange, v1.EventTypeNormal, ReasonIPRangeDrained, "All addresses released, the ClusterIPRange can be deleted")
+		return ctrl.Result{}, nil
+	}
+
+	if !ipRange.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(ipRange, clusteripv1.IPRangeFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		// wait until there are no Services using the range, the drained ranges don't hold addresses anymore
+		if !forceDelete && len(services) > 0 {
+			log.Info("ClusterIPRange still in use", "services", len(services))
+			meta.SetStatusCondition(&ipRange.Status.Conditions, metav1.Condition{
+				Type:    clusteripv1.IPRangeTerminating,
+				Status:  metav1.ConditionTrue,
+				Reason:  "ServicesRemaining",
+				Message: fmt.Sprintf("%d Services still reference the ClusterIPRange", len(services)),
+			})
+			if err := r.Status().Update(ctx, ipRange); err != nil {
+				log.Error(err, "unable to update ClusterIPRange status")
+				return ctrl.Result{}, err
+			}
+			// the ClusterIPRange is requeued when the Services are deleted
+			return ctrl.Result{}, nil
+		}
+		controllerutil.RemoveFinalizer(ipRange, clusteripv1.IPRangeFinalizer)
+		if err := r.Update(ctx, ipRange); err != nil {
+			log.Error(err, "unable to remove finalizer from ClusterIPRange")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// reservations are committed once a Service uses the address,
+	// and aborted when they expire
+	now := metav1.Now()
+	var requeueAfter time.Duration
+	desired := sets.StringKeySet(services)
+	committed := sets.NewString()
+	expired := sets.NewString()
+	reservations := ipRange.GetReservations()
+	for address, expires := range reservations {
+		if _, ok := services[address]; ok {
+			delete(reservations, address)
+			committed.Insert(address)
+			continue
+		}
+		if !now.Before(&expires) {
+			delete(reservations, address)
+			expired.Insert(address)
+			continue
+		}
+		desired.Insert(address)
+		if wait := expires.Sub(now.Time); requeueAfter == 0 || wait < requeueAfter {
+			requeueAfter = wait
+		}
+	}
+
+	free := utilnet.RangeSize(cidr) - int64(desired.Len())
+	if ipRange.Status.Free != free {
+		ipRange.Status.Free = free
+		if err := r.Status().Update(ctx, ipRange); err != nil {
+			log.Error(err, "unable to update ClusterIPRange status")
+			return ctrl.Result{}, err
+		}
+	}
+	addresses := sets.NewString(ipRange.Spec.Addresses...)
+	if desired.Equal(addresses) && len(reservations) == len(ipRange.Spec.Reservations) {
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	unused := addresses.Difference(desired).Difference(expired)
+	missing := desired.Difference(addresses)
+	ipRange.Spec.Addresses = desired.List()
+	ipRange.SetReservations(reservations)
+	if err := r.Update(ctx, ipRange); err != nil {
+		log.Error(err, "unable to update ClusterIPRange")
+		return ctrl.Result{}, err
+	}
+	for _, address := range committed.List() {
+		r.recorder().Eventf(services[address], v1.EventTypeNormal, ReasonAddressAllocated, "ClusterIP %s allocated from ClusterIPRange %s", address, ipRange.Name)
+	}
+	for _, address := range expired.List() {
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonReservationExpired, "Reservation of address %s expired, no Service uses it", address)
+	}
+	for _, address := range unused.List() {
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonAddressReleased, "Address %s released, no Service uses it", address)
+	}
+	for _, address := range missing.List() {
+		if svc, ok := services[address]; ok {
+			r.recorder().Eventf(svc, v1.EventTypeWarning, ReasonAddressRecovered, "ClusterIP %s was not allocated in ClusterIPRange %s", address, ipRange.Name)
+		}
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// clusterIPRanges maps a Service to all the ClusterIPRanges, so their addresses are
+// reconciled when the Services change.
+func (r *ClusterIPRangeReconciler) clusterIPRanges(obj client.Object) []reconcile.Request {
+	var rangeList clusteripv1beta1.ClusterIPRangeList
+	if err := r.List(context.Background(), &rangeList); err != nil {
+		r.Log.Error(err, "unable to list ClusterIPRanges")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, ipRange := range rangeList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKey{Name: ipRange.Name}})
+	}
+	return requests
+}
+
+// recorder returns the event recorder of the reconciler, the events are discarded if it has none.
+func (r *ClusterIPRangeReconciler) recorder() record.EventRecorder {
+	return eventRecorder(r.Recorder)
+}
+
+func (r *ClusterIPRangeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&clusteripv1beta1.ClusterIPRange{}).
+		Watches(&source.Kind{Type: &v1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.clusterIPRanges)).
+		Complete(r)
+}
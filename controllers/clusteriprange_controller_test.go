@@ -0,0 +1,158 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+)
+
+func newClusterIPRange(name, cidr string, addresses ...string) *clusteripv1beta1.ClusterIPRange {
+	return &clusteripv1beta1.ClusterIPRange{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: clusteripv1beta1.ClusterIPRangeSpec{
+			Range:     cidr,
+			Addresses: addresses,
+		},
+	}
+}
+
+func TestClusterIPRangeReconciler(t *testing.T) {
+	ctx := context.Background()
+	ipRange := newClusterIPRange("default", "10.96.0.0/24", "10.96.0.1", "10.96.0.2", "10.96.0.3", "10.96.0.4")
+	ipRange.Spec.Reservations = []clusteripv1beta1.Reservation{
+		// committed, the Service exists
+		{Address: "10.96.0.3", Expires: metav1.NewTime(time.Now().Add(time.Minute))},
+		// expired, no Service uses it
+		{Address: "10.96.0.4", Expires: metav1.NewTime(time.Now().Add(-time.Minute))},
+	}
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		ipRange,
+		newService("default", "svc1", "10.96.0.1"),
+		newService("default", "svc3", "10.96.0.3"),
+		// not allocated
+		newService("default", "svc5", "10.96.0.5"),
+		// out of the range
+		newService("default", "svc6", "10.97.0.1"),
+	).Build()
+	r := &ClusterIPRangeReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	// the first reconcile adds the finalizer
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Name: "default"}}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	got := &clusteripv1beta1.ClusterIPRange{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !controllerutil.ContainsFinalizer(got, clusteripv1.IPRangeFinalizer) {
+		t.Fatalf("expected finalizer on ClusterIPRange, got %v", got.Finalizers)
+	}
+	// the address of the deleted Service and the expired reservation are released
+	expected := []string{"10.96.0.1", "10.96.0.3", "10.96.0.5"}
+	if !reflect.DeepEqual(got.Spec.Addresses, expected) {
+		t.Fatalf("expected addresses %v, got %v", expected, got.Spec.Addresses)
+	}
+	if len(got.Spec.Reservations) != 0 {
+		t.Fatalf("expected no reservations, got %v", got.Spec.Reservations)
+	}
+	if got.Status.Free != 253 {
+		t.Fatalf("expected 253 free addresses, got %d", got.Status.Free)
+	}
+}
+
+func TestClusterIPRangeReconcilerDelete(t *testing.T) {
+	ctx := context.Background()
+	now := metav1.Now()
+	deleted := newClusterIPRange("deleted", "10.96.0.0/24", "10.96.0.1")
+	deleted.Finalizers = []string{clusteripv1.IPRangeFinalizer}
+	deleted.DeletionTimestamp = &now
+	drained := newClusterIPRange("drained", "10.97.0.0/24", "10.97.0.1")
+	drained.Finalizers = []string{clusteripv1.IPRangeFinalizer}
+	drained.Annotations = map[string]string{clusteripv1.ForceDeleteAnnotation: "true"}
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		deleted,
+		drained,
+		newService("default", "svc1", "10.96.0.1"),
+		newService("default", "svc2", "10.97.0.1"),
+	).Build()
+	r := &ClusterIPRangeReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	// the ClusterIPRange being deleted keeps the finalizer while Services use it
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Name: "deleted"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := &clusteripv1beta1.ClusterIPRange{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !controllerutil.ContainsFinalizer(got, clusteripv1.IPRangeFinalizer) {
+		t.Fatalf("expected finalizer on ClusterIPRange, got %v", got.Finalizers)
+	}
+	if err := c.Delete(ctx, newService("default", "svc1", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = &clusteripv1beta1.ClusterIPRange{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if controllerutil.ContainsFinalizer(got, clusteripv1.IPRangeFinalizer) {
+		t.Fatalf("expected finalizer to be removed, got %v", got.Finalizers)
+	}
+
+	// the ClusterIPRange marked to be force deleted is drained
+	req = ctrl.Request{NamespacedName: client.ObjectKey{Name: "drained"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = &clusteripv1beta1.ClusterIPRange{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Spec.Addresses) != 0 {
+		t.Fatalf("expected drained ClusterIPRange, got addresses %v", got.Spec.Addresses)
+	}
+}
@@ -0,0 +1,332 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-logr/logr"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	"github.com/aojea/clusterip-webhook/pkg/webhook"
+)
+
+// Event reasons emitted when draining an IPRange.
+const (
+	ReasonAddressRehomed = "AddressRehomed"
+	ReasonAddressCleared = "AddressCleared"
+	ReasonDrainBlocked   = "DrainBlocked"
+	ReasonIPRangeDrained = "IPRangeDrained"
+)
+
+// IPRangeReconciler reconciles an IPRange object
+type IPRangeReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=ipranges,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=ipranges/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=ipranges/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func (r *IPRangeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("iprange", req.NamespacedName)
+
+	ipRange := &clusteripv1.IPRange{}
+	if err := r.Get(ctx, req.NamespacedName, ipRange); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// protect the IPRange from being removed while it is used by Services
+	if ipRange.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(ipRange, clusteripv1.IPRangeFinalizer) {
+		controllerutil.AddFinalizer(ipRange, clusteripv1.IPRangeFinalizer)
+		if err := r.Update(ctx, ipRange); err != nil {
+			log.Error(err, "unable to add finalizer to IPRange")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// only the IPRanges marked to be force deleted and the IPRanges being deleted need more work
+	if !ipRange.IsForceDelete() && ipRange.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// get all services
+	var svcList v1.ServiceList
+	if err := r.List(ctx, &svcList); err != nil {
+		log.Error(err, "unable to list services")
+		return ctrl.Result{}, err
+	}
+	// get the other IPRanges that may hold the addresses
+	var ipRangeList clusteripv1.IPRangeList
+	if err := r.List(ctx, &ipRangeList); err != nil {
+		log.Error(err, "unable to list IPRanges")
+		return ctrl.Result{}, err
+	}
+
+	if ipRange.IsForceDelete() && len(ipRange.Spec.Addresses) > 0 {
+		log.Info("draining IPRange", "addresses", len(ipRange.Spec.Addresses))
+		blocked, err := r.drain(ctx, ipRange, svcList.Items, ipRangeList.Items)
+		if err != nil {
+			log.Error(err, "unable to drain IPRange")
+			return ctrl.Result{}, err
+		}
+		// the IPRange keeps its addresses and its finalizer until all the Services can be moved,
+		// it is requeued when the Services or the other IPRanges change
+		if len(blocked) > 0 {
+			log.Info("IPRange can not be drained", "services", len(blocked))
+			for _, svc := range blocked {
+				r.recorder().Eventf(svc, v1.EventTypeWarning, ReasonDrainBlocked, "ClusterIP %s can not be moved from IPRange %s/%s, no other IPRange can hold it", svc.Spec.ClusterIP, ipRange.Namespace, ipRange.Name)
+			}
+			r.recorder().Eventf(ipRange, v1.EventTypeWarning, ReasonDrainBlocked, "%d Services can not be moved to other IPRange", len(blocked))
+			meta.SetStatusCondition(&ipRange.Status.Conditions, metav1.Condition{
+				Type:    clusteripv1.IPRangeTerminating,
+				Status:  metav1.ConditionTrue,
+				Reason:  "AddressesNotRehomed",
+				Message: fmt.Sprintf("%d Services can not be moved to other IPRange", len(blocked)),
+			})
+			if err := r.Status().Update(ctx, ipRange); err != nil {
+				log.Error(err, "unable to update IPRange status")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, nil
+		}
+		if err := r.Update(ctx, ipRange); err != nil {
+			log.Error(err, "unable to update IPRange")
+			return ctrl.Result{}, err
+		}
+		// drop the condition of a previously refused drain
+		if cond := meta.FindStatusCondition(ipRange.Status.Conditions, clusteripv1.IPRangeTerminating); cond != nil && cond.Reason == "AddressesNotRehomed" {
+			meta.RemoveStatusCondition(&ipRange.Status.Conditions, clusteripv1.IPRangeTerminating)
+			if err := r.Status().Update(ctx, ipRange); err != nil {
+				log.Error(err, "unable to update IPRange status")
+				return ctrl.Result{}, err
+			}
+		}
+		r.recorder().Event(ipRange, v1.EventTypeNormal, ReasonIPRangeDrained, "All addresses released, the IPRange can be deleted")
+		return ctrl.Result{}, nil
+	}
+
+	if ipRange.DeletionTimestamp.IsZero() || !controllerutil.ContainsFinalizer(ipRange, clusteripv1.IPRangeFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	// the IPRange is being deleted, wait until there are no Services using it,
+	// the drained IPRanges don't hold addresses for Services anymore.
+	if !ipRange.IsForceDelete() {
+		services := servicesInRange(ipRange, svcList.Items, ipRangeList.Items)
+		if services > 0 {
+			log.Info("IPRange still in use", "services", services)
+			meta.SetStatusCondition(&ipRange.Status.Conditions, metav1.Condition{
+				Type:    clusteripv1.IPRangeTerminating,
+				Status:  metav1.ConditionTrue,
+				Reason:  "ServicesRemaining",
+				Message: fmt.Sprintf("%d Services still reference the IPRange", services),
+			})
+			if err := r.Status().Update(ctx, ipRange); err != nil {
+				log.Error(err, "unable to update IPRange status")
+				return ctrl.Result{}, err
+			}
+			// the IPRange is requeued when the Services are deleted
+			return ctrl.Result{}, nil
+		}
+	}
+
+	controllerutil.RemoveFinalizer(ipRange, clusteripv1.IPRangeFinalizer)
+	if err := r.Update(ctx, ipRange); err != nil {
+		log.Error(err, "unable to remove finalizer from IPRange")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// drain releases all the addresses of the IPRange, the addresses allocated to Services are moved,
+// with their owners, to the IPRanges the webhook would allocate them from, recording an event in the
+// Service and the IPRange. If any of them can not be moved nothing is updated, and the Services
+// blocking the drain are returned. The caller is responsible of updating the drained IPRange.
+func (r *IPRangeReconciler) drain(ctx context.Context, ipRange *clusteripv1.IPRange, services []v1.Service, ipRanges []clusteripv1.IPRange) ([]*v1.Service, error) {
+	svcByIP := map[string]*v1.Service{}
+	for i := range services {
+		ip := net.ParseIP(services[i].Spec.ClusterIP)
+		if ip != nil {
+			svcByIP[ip.String()] = &services[i]
+		}
+	}
+
+	// the moves are planned on copies of the other IPRanges, so the namespace
+	// quotas account for the addresses already moved
+	var targets []clusteripv1.IPRange
+	for i := range ipRanges {
+		if ipRanges[i].UID == ipRange.UID || ipRanges[i].IsForceDelete() {
+			continue
+		}
+		targets = append(targets, *ipRanges[i].DeepCopy())
+	}
+	moved := map[string]types.NamespacedName{}
+	updated := sets.NewString()
+	var blocked []*v1.Service
+	for _, address := range ipRange.Spec.Addresses {
+		svc, ok := svcByIP[address]
+		// the address is not used by any Service, it can be dropped
+		if !ok {
+			continue
+		}
+		target, err := r.rehome(ctx, targets, svc, address)
+		if err != nil {
+			return nil, err
+		}
+		if target == nil {
+			blocked = append(blocked, svc)
+			continue
+		}
+		moved[address] = client.ObjectKeyFromObject(target)
+		updated.Insert(string(target.UID))
+	}
+	if len(blocked) > 0 {
+		return blocked, nil
+	}
+
+	for i := range targets {
+		if !updated.Has(string(targets[i].UID)) {
+			continue
+		}
+		// on conflict the reconcile is retried with fresh copies of the IPRanges,
+		// the addresses already moved are found in their new IPRange
+		if err := r.Update(ctx, &targets[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, address := range ipRange.Spec.Addresses {
+		target, ok := moved[address]
+		if !ok {
+			continue
+		}
+		svc := svcByIP[address]
+		r.recorder().Eventf(svc, v1.EventTypeNormal, ReasonAddressRehomed, "ClusterIP %s moved from IPRange %s/%s to IPRange %s", address, ipRange.Namespace, ipRange.Name, target)
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonAddressRehomed, "Address %s of Service %s/%s moved to IPRange %s", address, svc.Namespace, svc.Name, target)
+	}
+	ipRange.Spec.Addresses = nil
+	ipRange.Spec.Owners = nil
+	return nil, nil
+}
+
+// servicesInRange returns the number of Services with a ClusterIP that belongs to the IPRange,
+// the Services whose ClusterIP is held by other IPRange are not considered.
+func servicesInRange(ipRange *clusteripv1.IPRange, services []v1.Service, ipRanges []clusteripv1.IPRange) int {
+	_, cidr, err := net.ParseCIDR(ipRange.Spec.Range)
+	if err != nil {
+		return 0
+	}
+	others := sets.NewString()
+	for _, other := range ipRanges {
+		if other.UID == ipRange.UID || !other.DeletionTimestamp.IsZero() {
+			continue
+		}
+		others.Insert(other.Spec.Addresses...)
+	}
+	count := 0
+	for _, svc := range services {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil || !cidr.Contains(ip) || others.Has(ip.String()) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// rehome allocates the address of the Service in the first IPRange, by priority, that selects the
+// Service, contains the address and allows the Service namespace within its quota, and records the
+// Service as owner of the address. It returns the IPRange that holds the address now or nil if there is none.
+func (r *IPRangeReconciler) rehome(ctx context.Context, ipRanges []clusteripv1.IPRange, svc *v1.Service, address string) (*clusteripv1.IPRange, error) {
+	ip := net.ParseIP(address)
+	for _, target := range webhook.SelectRanges(ipRanges, svc, r.Log) {
+		_, cidr, err := net.ParseCIDR(target.Spec.Range)
+		if err != nil || !cidr.Contains(ip) {
+			continue
+		}
+		addresses := sets.NewString(target.Spec.Addresses...)
+		if !addresses.Has(address) {
+			err := webhook.CheckNamespace(ctx, r.Client, target, svc.Namespace)
+			if errors.Is(err, webhook.ErrNamespaceNotAllowed) || errors.Is(err, webhook.ErrQuotaExceeded) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			addresses.Insert(address)
+			target.Spec.Addresses = addresses.List()
+		}
+		owners := target.GetOwners()
+		owners[address] = types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+		target.SetOwners(owners)
+		return target, nil
+	}
+	return nil, nil
+}
+
+// terminatingIPRanges maps a Service or an IPRange to the IPRanges being deleted or drained, so they
+// are reconciled when the Services that may be blocking their deletion or the IPRanges that may
+// receive their addresses change.
+func (r *IPRangeReconciler) terminatingIPRanges(obj client.Object) []reconcile.Request {
+	var ipRangeList clusteripv1.IPRangeList
+	if err := r.List(context.Background(), &ipRangeList); err != nil {
+		r.Log.Error(err, "unable to list IPRanges")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, ipRange := range ipRangeList.Items {
+		if !ipRange.DeletionTimestamp.IsZero() || ipRange.IsForceDelete() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ipRange)})
+		}
+	}
+	return requests
+}
+
+// recorder returns the event recorder of the reconciler, the events are discarded if it has none.
+func (r *IPRangeReconciler) recorder() record.EventRecorder {
+	return eventRecorder(r.Recorder)
+}
+
+func (r *IPRangeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&clusteripv1.IPRange{}).
+		Watches(&source.Kind{Type: &v1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.terminatingIPRanges)).
+		Watches(&source.Kind{Type: &clusteripv1.IPRange{}}, handler.EnqueueRequestsFromMapFunc(r.terminatingIPRanges)).
+		Complete(r)
+}
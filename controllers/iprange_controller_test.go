@@ -0,0 +1,255 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+)
+
+func newScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta1.AddToScheme(scheme))
+	return scheme
+}
+
+func newService(namespace, name, clusterIP string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       v1.ServiceSpec{ClusterIP: clusterIP},
+	}
+}
+
+func newIPRange(name, cidr string, addresses ...string) *clusteripv1.IPRange {
+	return &clusteripv1.IPRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      name,
+			UID:       types.UID(name),
+		},
+		Spec: clusteripv1.IPRangeSpec{
+			Range:     cidr,
+			Addresses: addresses,
+		},
+	}
+}
+
+func TestIPRangeReconcilerDrain(t *testing.T) {
+	ctx := context.Background()
+	drained := newIPRange("drained", "10.96.0.0/16", "10.96.0.1", "10.96.0.2", "10.96.1.1", "10.96.2.1")
+	drained.Annotations = map[string]string{clusteripv1.ForceDeleteAnnotation: "true"}
+	drained.Spec.Owners = []clusteripv1.AddressOwner{
+		{Address: "10.96.0.1", Namespace: "default", Name: "web"},
+		{Address: "10.96.0.2", Namespace: "default", Name: "db"},
+	}
+	// the quota of the target only allows one of the Services of the namespace
+	target := newIPRange("target", "10.96.0.0/24")
+	target.Spec.Priority = 1
+	quota := int64(1)
+	target.Spec.DefaultNamespaceQuota = &quota
+	spill := newIPRange("spill", "10.96.0.0/24")
+	// the IPRanges that contain 10.96.1.1 don't accept the Service
+	selected := newIPRange("selected", "10.96.1.0/24")
+	selected.Spec.ServiceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "dns"}}
+	restricted := newIPRange("restricted", "10.96.1.0/24")
+	restricted.Spec.AllowedNamespaces = []string{"kube-system"}
+	blocking := newService("default", "blocking", "10.96.1.1")
+
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		drained,
+		target,
+		spill,
+		selected,
+		restricted,
+		newService("default", "web", "10.96.0.1"),
+		newService("default", "db", "10.96.0.2"),
+		blocking,
+	).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &IPRangeReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: recorder,
+	}
+
+	// the first reconcile adds the finalizer
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(drained)}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// the drain is refused while a Service can not be moved
+	got := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Spec.Addresses) != 4 || len(got.Spec.Owners) != 2 {
+		t.Errorf("expected IPRange not drained, got addresses %v owners %v", got.Spec.Addresses, got.Spec.Owners)
+	}
+	if !controllerutil.ContainsFinalizer(got, clusteripv1.IPRangeFinalizer) {
+		t.Errorf("expected finalizer on IPRange, got %v", got.Finalizers)
+	}
+	cond := meta.FindStatusCondition(got.Status.Conditions, clusteripv1.IPRangeTerminating)
+	if cond == nil || cond.Reason != "AddressesNotRehomed" {
+		t.Errorf("expected Terminating condition with reason AddressesNotRehomed, got %v", cond)
+	}
+	for _, ipRange := range []*clusteripv1.IPRange{target, spill, selected, restricted} {
+		got := &clusteripv1.IPRange{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got.Spec.Addresses) != 0 {
+			t.Errorf("expected no addresses in IPRange %s, got %v", ipRange.Name, got.Spec.Addresses)
+		}
+	}
+	// a warning for the blocking Service and one for the IPRange
+	if len(recorder.Events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(recorder.Events))
+	}
+	for len(recorder.Events) > 0 {
+		<-recorder.Events
+	}
+
+	// the IPRange is drained once the blocking Service is deleted
+	if err := c.Delete(ctx, blocking); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = &clusteripv1.IPRange{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Spec.Addresses) != 0 || len(got.Spec.Owners) != 0 {
+		t.Errorf("expected drained IPRange, got addresses %v owners %v", got.Spec.Addresses, got.Spec.Owners)
+	}
+	if cond := meta.FindStatusCondition(got.Status.Conditions, clusteripv1.IPRangeTerminating); cond != nil {
+		t.Errorf("expected no Terminating condition, got %v", cond)
+	}
+	expected := map[string]string{"target": "10.96.0.1", "spill": "10.96.0.2"}
+	for _, ipRange := range []*clusteripv1.IPRange{target, spill} {
+		got := &clusteripv1.IPRange{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		address := expected[ipRange.Name]
+		if len(got.Spec.Addresses) != 1 || got.Spec.Addresses[0] != address {
+			t.Errorf("expected re-homed address %s in IPRange %s, got addresses %v", address, ipRange.Name, got.Spec.Addresses)
+		}
+		if owner, ok := got.GetOwners()[address]; !ok || owner.Namespace != "default" {
+			t.Errorf("expected owner of address %s in IPRange %s, got %v", address, ipRange.Name, got.Spec.Owners)
+		}
+	}
+	// 2 events per re-homed address plus the drained event
+	if len(recorder.Events) != 5 {
+		t.Errorf("expected 5 events, got %d", len(recorder.Events))
+	}
+}
+
+func TestIPRangeReconcilerFinalizer(t *testing.T) {
+	ctx := context.Background()
+	now := metav1.Now()
+	deleted := newIPRange("deleted", "10.96.0.0/24")
+	deleted.Finalizers = []string{clusteripv1.IPRangeFinalizer}
+	deleted.DeletionTimestamp = &now
+	other := newIPRange("other", "10.96.0.0/16", "10.96.0.3")
+
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		deleted,
+		other,
+		newService("default", "svc1", "10.96.0.1"),
+		newService("default", "svc2", "10.96.0.2"),
+		// held by the other IPRange
+		newService("default", "svc3", "10.96.0.3"),
+		// out of the range
+		newService("default", "svc4", "10.96.1.1"),
+	).Build()
+	r := &IPRangeReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	// the IPRange without finalizer gets one
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(other)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(other), got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !controllerutil.ContainsFinalizer(got, clusteripv1.IPRangeFinalizer) {
+		t.Fatalf("expected finalizer on IPRange, got %v", got.Finalizers)
+	}
+
+	// the IPRange being deleted keeps the finalizer while Services use it
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(deleted)}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !controllerutil.ContainsFinalizer(got, clusteripv1.IPRangeFinalizer) {
+		t.Fatalf("expected finalizer on IPRange, got %v", got.Finalizers)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, clusteripv1.IPRangeTerminating)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Message != "2 Services still reference the IPRange" {
+		t.Fatalf("unexpected Terminating condition %v", condition)
+	}
+
+	// the finalizer is removed once the Services are gone
+	for _, name := range []string{"svc1", "svc2"} {
+		if err := c.Delete(ctx, newService("default", name, "")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = &clusteripv1.IPRange{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if controllerutil.ContainsFinalizer(got, clusteripv1.IPRangeFinalizer) {
+		t.Fatalf("expected finalizer to be removed, got %v", got.Finalizers)
+	}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// noopRecorder discards the events of the reconcilers created without Recorder.
+type noopRecorder struct{}
+
+var _ record.EventRecorder = noopRecorder{}
+
+func (noopRecorder) Event(object runtime.Object, eventtype, reason, message string) {}
+
+func (noopRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+func (noopRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+// eventRecorder returns the recorder, or a recorder that discards the events if it is not set.
+func eventRecorder(recorder record.EventRecorder) record.EventRecorder {
+	if recorder == nil {
+		return noopRecorder{}
+	}
+	return recorder
+}
@@ -19,90 +19,416 @@ package controllers
 import (
 	"context"
 	"net"
+	"sort"
+	"time"
 
 	"github.com/go-logr/logr"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
 	utilnet "k8s.io/utils/net"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
 )
 
+// Event reasons emitted when reconciling the Services with the IPRange.
+const (
+	ReasonAddressAllocated   = "AddressAllocated"
+	ReasonAddressReleased    = "AddressReleased"
+	ReasonReservationExpired = "ReservationExpired"
+	ReasonLeakRepaired       = "LeakRepaired"
+	ReasonAddressRecovered   = "AddressRecovered"
+	ReasonOutOfSync          = "OutOfSync"
+	ReasonRangeFull          = "IPRangeFull"
+	ReasonAddressHeld        = "AddressHeld"
+	ReasonAddressRestored    = "AddressRestored"
+	ReasonStickyExpired      = "StickyReservationExpired"
+	ReasonStickyReplaced     = "StickyReservationReplaced"
+)
+
 // ServiceReconciler reconciles a Service object
 type ServiceReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=ipranges,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=ipranges/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("service", req.NamespacedName)
 	log.Info("Starting reconcile", "request", req)
 	defer log.Info("Finishing reconcile", "request", req)
+	// obtain all the IPRanges in priority order
+	var rangeList clusteripv1.IPRangeList
+	if err := r.List(ctx, &rangeList); err != nil {
+		log.Error(err, "unable to list IPRanges")
+		return ctrl.Result{}, err
+	}
+	sort.Sort(clusteripv1.ByPriority(rangeList.Items))
+
 	// get all services
 	var svcList v1.ServiceList
 	if err := r.List(ctx, &svcList); err != nil {
 		log.Error(err, "unable to list services")
 		return ctrl.Result{}, err
 	}
-	// obtain all assigned clusterIPs
+	owners := rangeOwners(rangeList.Items, svcList.Items)
+
+	var result ctrl.Result
+	for i := range rangeList.Items {
+		ipRange := &rangeList.Items[i]
+		// the IPRange is being drained by the IPRange controller
+		if ipRange.IsForceDelete() {
+			log.Info("IPRange is being force deleted, skipping", "iprange", client.ObjectKeyFromObject(ipRange))
+			continue
+		}
+		requeueAfter, err := r.reconcileRange(ctx, req, ipRange, svcList.Items, owners)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if requeueAfter > 0 && (result.RequeueAfter == 0 || requeueAfter < result.RequeueAfter) {
+			result.RequeueAfter = requeueAfter
+		}
+	}
+	return result, nil
+}
+
+// reconcileRange reconciles the addresses of the IPRange with the ClusterIPs of the Services it owns,
+// it returns the time until the next reservation of the IPRange expires.
+func (r *ServiceReconciler) reconcileRange(ctx context.Context, req ctrl.Request,
+	ipRange *clusteripv1.IPRange, svcList []v1.Service, owners map[string]client.ObjectKey) (time.Duration, error) {
+	key := client.ObjectKeyFromObject(ipRange)
+	log := r.Log.WithValues("service", req.NamespacedName, "iprange", key)
+	// Range is validated by the webhook
+	_, cidr, err := net.ParseCIDR(ipRange.Spec.Range)
+	if err != nil {
+		log.Error(err, "invalid range")
+		return 0, nil
+	}
+
+	// obtain all assigned clusterIPs that belong to the range
 	svcIPs := sets.NewString()
-	for _, svc := range svcList.Items {
+	services := map[string]*v1.Service{}
+	for i := range svcList {
+		svc := &svcList[i]
 		ip := net.ParseIP(svc.Spec.ClusterIP)
-		if ip != nil {
-			svcIPs.Insert(svc.Spec.ClusterIP)
+		if ip != nil && cidr.Contains(ip) && owners[ip.String()] == key {
+			svcIPs.Insert(ip.String())
+			services[ip.String()] = svc
 		}
 	}
 
-	// obtain current allocator addresses
-	ipRange := &clusteripv1.IPRange{}
-	// TODO hardcoded to kube-system allocator object by now
-	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
-	if err := r.Get(ctx, key, ipRange); err != nil {
-		log.Error(err, "unable to fetch IPRange")
-		// don't retry, just log only
-		return ctrl.Result{}, nil
+	// reservations are committed once a Service uses the address,
+	// and aborted when they expire
+	now := metav1.Now()
+	var requeueAfter time.Duration
+	desired := sets.NewString(svcIPs.List()...)
+	committed := sets.NewString()
+	expired := sets.NewString()
+	reservations := ipRange.GetReservations()
+	for address, expires := range reservations {
+		if svcIPs.Has(address) {
+			log.Info("committing reservation", "address", address)
+			delete(reservations, address)
+			committed.Insert(address)
+			continue
+		}
+		if !now.Before(&expires) {
+			log.Info("aborting expired reservation", "address", address)
+			delete(reservations, address)
+			expired.Insert(address)
+			continue
+		}
+		desired.Insert(address)
+		if wait := expires.Sub(now.Time); requeueAfter == 0 || wait < requeueAfter {
+			requeueAfter = wait
+		}
 	}
 
-	// update the status
-	// Range is validated by the webhook
-	_, cidr, _ := net.ParseCIDR(ipRange.Spec.Range)
+	// sticky reservations hold the address until a Service uses it or they expire
+	var sticky []clusteripv1.StickyReservation
+	held := sets.NewString()
+	restored := map[string]*v1.Service{}
+	stickyExpired := map[string]string{}
+	for _, reservation := range ipRange.Spec.StickyReservations {
+		service := reservation.Namespace + "/" + reservation.Name
+		if svc, ok := services[reservation.Address]; ok {
+			if svc.Namespace+"/"+svc.Name == service {
+				log.Info("restoring sticky address", "address", reservation.Address, "service", service)
+				restored[reservation.Address] = svc
+			} else {
+				log.Info("sticky address used by another Service", "address", reservation.Address, "service", service)
+			}
+			continue
+		}
+		if reservation.Expires != nil && !now.Before(reservation.Expires) {
+			log.Info("releasing expired sticky address", "address", reservation.Address, "service", service)
+			stickyExpired[reservation.Address] = service
+			continue
+		}
+		sticky = append(sticky, reservation)
+		held.Insert(reservation.Address)
+		desired.Insert(reservation.Address)
+		if reservation.Expires == nil {
+			continue
+		}
+		if wait := reservation.Expires.Sub(now.Time); requeueAfter == 0 || wait < requeueAfter {
+			requeueAfter = wait
+		}
+	}
+
+	// update the status, only if it changed since all the Service events reconcile all the IPRanges
 	max := utilnet.RangeSize(cidr)
-	ipRange.Status.Free = max - int64(svcIPs.Len())
-	if err := r.Status().Update(ctx, ipRange); err != nil {
-		log.Error(err, "unable to update ipRange status")
-		return ctrl.Result{}, err
+	// the network address is never allocated
+	full := int64(desired.Len()) >= max-1 && int64(len(ipRange.Spec.Addresses)) < max-1
+	free := max - int64(desired.Len())
+	usage := namespaceUsage(ipRange, services)
+	if ipRange.Status.Free != free || !equality.Semantic.DeepEqual(ipRange.Status.NamespaceUsage, usage) {
+		ipRange.Status.Free = free
+		ipRange.Status.NamespaceUsage = usage
+		if err := r.Status().Update(ctx, ipRange); err != nil {
+			log.Error(err, "unable to update ipRange status")
+			return 0, err
+		}
+	}
+	if full {
+		r.recorder().Eventf(ipRange, v1.EventTypeWarning, ReasonRangeFull, "IPRange %s has no free addresses", ipRange.Spec.Range)
 	}
 	// reconcile the differences
 	addresses := sets.NewString(ipRange.Spec.Addresses...)
-	if svcIPs.Equal(addresses) {
-		return ctrl.Result{}, nil
+	previousOwners := ipRange.GetOwners()
+	serviceOwners := map[string]types.NamespacedName{}
+	for address, svc := range services {
+		serviceOwners[address] = types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+	}
+	if desired.Equal(addresses) && len(reservations) == len(ipRange.Spec.Reservations) &&
+		len(sticky) == len(ipRange.Spec.StickyReservations) && equality.Semantic.DeepEqual(previousOwners, serviceOwners) {
+		return requeueAfter, nil
 	}
 
-	log.Info("allocator is not synced", "Difference IPRange", addresses.Difference(svcIPs))
-	log.Info("allocator is not synced", "Difference Services", svcIPs.Difference(addresses))
+	unused := addresses.Difference(desired)
+	missing := desired.Difference(addresses)
+	log.Info("allocator is not synced", "Difference IPRange", unused)
+	log.Info("allocator is not synced", "Difference Services", missing)
+	unused = unused.Difference(expired).Difference(sets.StringKeySet(stickyExpired))
+	// the addresses of the sticky reservations are allocated by the controller
+	missing = missing.Difference(held)
+	// the addresses of the Services that don't use them anymore are released, any other difference
+	// means that the IPRange was modified without the webhook or a Service update was lost
+	released := map[string]types.NamespacedName{}
+	leaked := sets.NewString()
+	for _, address := range unused.List() {
+		if owner, ok := previousOwners[address]; ok {
+			released[address] = owner
+		} else {
+			leaked.Insert(address)
+		}
+	}
+	if missing.Len() > 0 || leaked.Len() > 0 {
+		r.recorder().Eventf(ipRange, v1.EventTypeWarning, ReasonOutOfSync,
+			"IPRange is not in sync with the Services: %d addresses not used by any Service, %d ClusterIPs not allocated", leaked.Len(), missing.Len())
+	}
+	// the addresses of the deleted Services are held for a Service with the same namespace and name
+	stickyAddresses := map[string]types.NamespacedName{}
+	// the addresses of the replaced sticky reservations mapped to the address held instead
+	replaced := map[string]string{}
+	var stickyUntil metav1.Time
+	if ipRange.Spec.StickyReservationTTL != nil && ipRange.Spec.StickyReservationTTL.Duration > 0 && len(released) > 0 {
+		existing := sets.NewString()
+		for _, svc := range svcList {
+			existing.Insert(svc.Namespace + "/" + svc.Name)
+		}
+		stickyUntil = metav1.NewTime(now.Add(ipRange.Spec.StickyReservationTTL.Duration))
+		for _, address := range sets.StringKeySet(released).List() {
+			owner := released[address]
+			// the Service was not deleted, it uses another address
+			if existing.Has(owner.String()) {
+				continue
+			}
+			// a Service holds only one address of the range, the previous reservation is replaced
+			// unless it doesn't expire, those are added by hand and kept until they are removed
+			permanent := false
+			for i := range sticky {
+				if sticky[i].Namespace != owner.Namespace || sticky[i].Name != owner.Name {
+					continue
+				}
+				if sticky[i].Expires == nil {
+					permanent = true
+					break
+				}
+				desired.Delete(sticky[i].Address)
+				if _, ok := stickyAddresses[sticky[i].Address]; ok {
+					delete(stickyAddresses, sticky[i].Address)
+				} else {
+					replaced[sticky[i].Address] = address
+				}
+				sticky = append(sticky[:i], sticky[i+1:]...)
+				break
+			}
+			if permanent {
+				log.Info("not holding address, the Service has a sticky address without expiration", "address", address, "service", owner)
+				continue
+			}
+			expires := stickyUntil
+			sticky = append(sticky, clusteripv1.StickyReservation{
+				Address:   address,
+				Namespace: owner.Namespace,
+				Name:      owner.Name,
+				Expires:   &expires,
+			})
+			desired.Insert(address)
+			stickyAddresses[address] = owner
+			delete(released, address)
+		}
+		if len(stickyAddresses) > 0 {
+			if wait := stickyUntil.Sub(now.Time); requeueAfter == 0 || wait < requeueAfter {
+				requeueAfter = wait
+			}
+		}
+	}
 
-	ipRange.Spec.Addresses = svcIPs.List()
+	ipRange.Spec.Addresses = desired.List()
+	ipRange.SetReservations(reservations)
+	ipRange.SetOwners(serviceOwners)
+	ipRange.Spec.StickyReservations = sticky
 	if err := r.Update(ctx, ipRange); err != nil {
 		log.Error(err, "unable to update IPRange")
-		return ctrl.Result{}, err
+		return 0, err
+	}
+	for _, address := range committed.List() {
+		r.recorder().Eventf(services[address], v1.EventTypeNormal, ReasonAddressAllocated, "ClusterIP %s allocated from IPRange %s/%s", address, ipRange.Namespace, ipRange.Name)
+	}
+	for _, address := range expired.List() {
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonReservationExpired, "Reservation of address %s expired, no Service uses it", address)
+	}
+	for _, address := range sets.StringKeySet(restored).List() {
+		r.recorder().Eventf(restored[address], v1.EventTypeNormal, ReasonAddressRestored, "ClusterIP %s restored from the sticky reservation of IPRange %s/%s", address, ipRange.Namespace, ipRange.Name)
+	}
+	for _, address := range sets.StringKeySet(stickyExpired).List() {
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonStickyExpired, "Sticky reservation of address %s for Service %s expired", address, stickyExpired[address])
+	}
+	for _, address := range sets.StringKeySet(replaced).List() {
+		by := replaced[address]
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonStickyReplaced, "Sticky reservation of address %s for Service %s replaced by address %s", address, stickyAddresses[by], by)
+	}
+	for _, address := range sets.StringKeySet(stickyAddresses).List() {
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonAddressHeld, "Address %s held for Service %s until %s", address, stickyAddresses[address], stickyUntil.UTC().Format(time.RFC3339))
+	}
+	for _, address := range sets.StringKeySet(released).List() {
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonAddressReleased, "Address %s released, Service %s was deleted", address, released[address])
+	}
+	for _, address := range leaked.List() {
+		r.recorder().Eventf(ipRange, v1.EventTypeNormal, ReasonLeakRepaired, "Address %s released, no Service uses it", address)
+	}
+	for _, address := range missing.List() {
+		if svc, ok := services[address]; ok {
+			r.recorder().Eventf(svc, v1.EventTypeWarning, ReasonAddressRecovered, "ClusterIP %s was not allocated in IPRange %s/%s", address, ipRange.Namespace, ipRange.Name)
+		}
+	}
+
+	return requeueAfter, nil
+}
+
+// rangeOwners maps the ClusterIPs of the Services to the IPRange that tracks them: the IPRange that
+// already allocates the address, or else the IPRange with the highest priority that contains it and
+// selects the Service. The addresses that no selecting IPRange contains are tracked by the IPRange
+// with the highest priority that contains them, so they are never allocated to other Service.
+// The ranges are sorted by priority.
+func rangeOwners(ranges []clusteripv1.IPRange, services []v1.Service) map[string]client.ObjectKey {
+	allocatedBy := map[string]client.ObjectKey{}
+	cidrs := make([]*net.IPNet, len(ranges))
+	for i := range ranges {
+		key := client.ObjectKeyFromObject(&ranges[i])
+		_, cidrs[i], _ = net.ParseCIDR(ranges[i].Spec.Range)
+		for _, address := range ranges[i].Spec.Addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				continue
+			}
+			if _, ok := allocatedBy[ip.String()]; !ok {
+				allocatedBy[ip.String()] = key
+			}
+		}
+	}
+	owners := map[string]client.ObjectKey{}
+	for _, svc := range services {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil {
+			continue
+		}
+		if key, ok := allocatedBy[ip.String()]; ok {
+			owners[ip.String()] = key
+			continue
+		}
+		var owner *clusteripv1.IPRange
+		for i := range ranges {
+			if cidrs[i] == nil || !cidrs[i].Contains(ip) {
+				continue
+			}
+			// the selector is validated by the IPRange webhook
+			if selected, err := ranges[i].SelectsService(svc.Labels); err == nil && selected {
+				owner = &ranges[i]
+				break
+			}
+			if owner == nil {
+				owner = &ranges[i]
+			}
+		}
+		if owner != nil {
+			owners[ip.String()] = client.ObjectKeyFromObject(owner)
+		}
+	}
+	return owners
+}
+
+// namespaceUsage returns the addresses held by the Services of the namespaces with quota,
+// services maps the addresses of the range to the Service that uses them.
+func namespaceUsage(ipRange *clusteripv1.IPRange, services map[string]*v1.Service) []clusteripv1.NamespaceUsage {
+	allocated := map[string]int64{}
+	for _, svc := range services {
+		allocated[svc.Namespace]++
 	}
+	namespaces := sets.StringKeySet(allocated)
+	for _, quota := range ipRange.Spec.NamespaceQuotas {
+		namespaces.Insert(quota.Namespace)
+	}
+	var usage []clusteripv1.NamespaceUsage
+	for _, namespace := range namespaces.List() {
+		if limit, ok := ipRange.QuotaFor(namespace); ok {
+			usage = append(usage, clusteripv1.NamespaceUsage{
+				Namespace: namespace,
+				Allocated: allocated[namespace],
+				Limit:     limit,
+			})
+		}
+	}
+	return usage
+}
 
-	return ctrl.Result{}, nil
+// recorder returns the event recorder of the reconciler, the events are discarded if it has none.
+func (r *ServiceReconciler) recorder() record.EventRecorder {
+	return eventRecorder(r.Recorder)
 }
 
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1.Service{}).
-		Owns(&clusteripv1.IPRange{}).
+		// reconcile the reservations of the IPRange
+		Watches(&source.Kind{Type: &clusteripv1.IPRange{}}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
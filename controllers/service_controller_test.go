@@ -0,0 +1,452 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+func TestServiceReconcilerReservations(t *testing.T) {
+	ctx := context.Background()
+	ipRange := newIPRange("allocator", "10.96.0.0/24", "10.96.0.1", "10.96.0.2", "10.96.0.3", "10.96.0.4")
+	ipRange.SetReservations(map[string]metav1.Time{
+		// the Service was created
+		"10.96.0.2": metav1.NewTime(time.Now().Add(time.Minute)),
+		// the Service was not created yet
+		"10.96.0.3": metav1.NewTime(time.Now().Add(time.Minute)),
+		// the Service creation failed
+		"10.96.0.4": metav1.NewTime(time.Now().Add(-time.Minute)),
+	})
+
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		ipRange,
+		newService("default", "committed", "10.96.0.1"),
+		newService("default", "reserved", "10.96.0.2"),
+	).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &ServiceReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: recorder,
+	}
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "reserved"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.RequeueAfter <= 0 || result.RequeueAfter > time.Minute {
+		t.Fatalf("expected to requeue when the reservation expires, got %v", result.RequeueAfter)
+	}
+
+	got := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"10.96.0.1", "10.96.0.2", "10.96.0.3"}
+	if len(got.Spec.Addresses) != len(expected) {
+		t.Fatalf("expected addresses %v, got %v", expected, got.Spec.Addresses)
+	}
+	for i := range expected {
+		if got.Spec.Addresses[i] != expected[i] {
+			t.Fatalf("expected addresses %v, got %v", expected, got.Spec.Addresses)
+		}
+	}
+	if len(got.Spec.Reservations) != 1 || got.Spec.Reservations[0].Address != "10.96.0.3" {
+		t.Fatalf("expected only 10.96.0.3 to be reserved, got %v", got.Spec.Reservations)
+	}
+	if got.Status.Free != 256-3 {
+		t.Fatalf("expected %d free addresses, got %d", 256-3, got.Status.Free)
+	}
+	expectEvents(t, recorder,
+		"Normal "+ReasonAddressAllocated+" ClusterIP 10.96.0.2 allocated from IPRange kube-system/allocator",
+		"Normal "+ReasonReservationExpired+" Reservation of address 10.96.0.4 expired, no Service uses it",
+	)
+}
+
+func TestServiceReconcilerEvents(t *testing.T) {
+	ctx := context.Background()
+	ipRange := newIPRange("allocator", "10.96.0.0/30", "10.96.0.1", "10.96.0.3")
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		ipRange,
+		newService("default", "a", "10.96.0.1"),
+		newService("default", "b", "10.96.0.2"),
+	).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &ServiceReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: recorder,
+	}
+
+	// 10.96.0.3 is leaked and 10.96.0.2 is not allocated
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "a"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectEvents(t, recorder,
+		"Warning "+ReasonOutOfSync+" IPRange is not in sync with the Services: 1 addresses not used by any Service, 1 ClusterIPs not allocated",
+		"Normal "+ReasonLeakRepaired+" Address 10.96.0.3 released, no Service uses it",
+		"Warning "+ReasonAddressRecovered+" ClusterIP 10.96.0.2 was not allocated in IPRange kube-system/allocator",
+	)
+
+	// the Service b is deleted
+	if err := c.Delete(ctx, newService("default", "b", "10.96.0.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "b"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectEvents(t, recorder,
+		"Normal "+ReasonAddressReleased+" Address 10.96.0.2 released, Service default/b was deleted",
+	)
+
+	// the range is full
+	if err := c.Create(ctx, newService("default", "c", "10.96.0.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Create(ctx, newService("default", "d", "10.96.0.3")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "d"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event := <-recorder.Events; event != "Warning "+ReasonRangeFull+" IPRange 10.96.0.0/30 has no free addresses" {
+		t.Fatalf("unexpected event %q", event)
+	}
+}
+
+func TestServiceReconcilerWithoutRecorder(t *testing.T) {
+	ipRange := newIPRange("allocator", "10.96.0.0/24", "10.96.0.3")
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		ipRange,
+		newService("default", "a", "10.96.0.1"),
+	).Build()
+	r := &ServiceReconciler{
+		Client: c,
+		Log:    ctrl.Log.WithName("test"),
+		Scheme: c.Scheme(),
+	}
+	// the events of the leaked and the missing addresses are discarded
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "a"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServiceReconcilerStickyReservations(t *testing.T) {
+	ctx := context.Background()
+	ipRange := newIPRange("allocator", "10.96.0.0/24", "10.96.0.1", "10.96.0.7")
+	ipRange.Spec.StickyReservationTTL = &metav1.Duration{Duration: time.Hour}
+	expired := metav1.NewTime(time.Now().Add(-time.Minute))
+	ipRange.Spec.StickyReservations = []clusteripv1.StickyReservation{
+		{Address: "10.96.0.7", Namespace: "default", Name: "old", Expires: &expired},
+	}
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		ipRange,
+		newService("default", "web", "10.96.0.1"),
+	).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &ServiceReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: recorder,
+	}
+	reconcile := func(name string) (ctrl.Result, *clusteripv1.IPRange) {
+		result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: name}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := &clusteripv1.IPRange{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return result, got
+	}
+
+	// the expired sticky reservation is released
+	_, got := reconcile("web")
+	if !reflect.DeepEqual(got.Spec.Addresses, []string{"10.96.0.1"}) || len(got.Spec.StickyReservations) != 0 {
+		t.Fatalf("expected only 10.96.0.1 to be allocated, got %v %v", got.Spec.Addresses, got.Spec.StickyReservations)
+	}
+	expectEvents(t, recorder,
+		"Normal "+ReasonStickyExpired+" Sticky reservation of address 10.96.0.7 for Service default/old expired",
+	)
+
+	// the address of the deleted Service is held
+	if err := c.Delete(ctx, newService("default", "web", "10.96.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, got := reconcile("web")
+	if !reflect.DeepEqual(got.Spec.Addresses, []string{"10.96.0.1"}) {
+		t.Fatalf("expected 10.96.0.1 to be held, got %v", got.Spec.Addresses)
+	}
+	if len(got.Spec.StickyReservations) != 1 || got.Spec.StickyReservations[0].Name != "web" || got.Spec.StickyReservations[0].Expires == nil {
+		t.Fatalf("expected a sticky reservation for default/web, got %v", got.Spec.StickyReservations)
+	}
+	if result.RequeueAfter <= 0 || result.RequeueAfter > time.Hour {
+		t.Fatalf("expected to requeue when the sticky reservation expires, got %v", result.RequeueAfter)
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Normal "+ReasonAddressHeld+" Address 10.96.0.1 held for Service default/web until ") {
+		t.Fatalf("unexpected event %q", event)
+	}
+
+	// the Service is recreated with the same address
+	if err := c.Create(ctx, newService("default", "web", "10.96.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, got = reconcile("web")
+	if !reflect.DeepEqual(got.Spec.Addresses, []string{"10.96.0.1"}) || len(got.Spec.StickyReservations) != 0 {
+		t.Fatalf("expected 10.96.0.1 to be allocated, got %v %v", got.Spec.Addresses, got.Spec.StickyReservations)
+	}
+	expectEvents(t, recorder,
+		"Normal "+ReasonAddressRestored+" ClusterIP 10.96.0.1 restored from the sticky reservation of IPRange kube-system/allocator",
+	)
+}
+
+func TestServiceReconcilerStickyReservationsBatchDelete(t *testing.T) {
+	ctx := context.Background()
+	ipRange := newIPRange("allocator", "10.96.0.0/24", "10.96.0.1", "10.96.0.2", "10.96.0.3")
+	ipRange.Spec.StickyReservationTTL = &metav1.Duration{Duration: time.Hour}
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		ipRange,
+		newService("default", "a", "10.96.0.1"),
+		newService("default", "b", "10.96.0.2"),
+		newService("default", "c", "10.96.0.3"),
+	).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &ServiceReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: recorder,
+	}
+
+	// the owners of the addresses are recorded
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "a"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Spec.Owners) != 3 || got.Spec.Owners[1] != (clusteripv1.AddressOwner{Address: "10.96.0.2", Namespace: "default", Name: "b"}) {
+		t.Fatalf("unexpected owners %v", got.Spec.Owners)
+	}
+
+	// the Services a and b are deleted before the controller reconciles, the IPRange is requeued
+	if err := c.Delete(ctx, newService("default", "a", "10.96.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Delete(ctx, newService("default", "b", "10.96.0.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ipRange)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = &clusteripv1.IPRange{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Spec.Addresses, []string{"10.96.0.1", "10.96.0.2", "10.96.0.3"}) {
+		t.Fatalf("expected the addresses to be held, got %v", got.Spec.Addresses)
+	}
+	if len(got.Spec.StickyReservations) != 2 ||
+		got.Spec.StickyReservations[0].Address != "10.96.0.1" || got.Spec.StickyReservations[0].Name != "a" ||
+		got.Spec.StickyReservations[1].Address != "10.96.0.2" || got.Spec.StickyReservations[1].Name != "b" {
+		t.Fatalf("expected sticky reservations for default/a and default/b, got %v", got.Spec.StickyReservations)
+	}
+	if len(got.Spec.Owners) != 1 || got.Spec.Owners[0].Name != "c" {
+		t.Fatalf("expected only the owner of 10.96.0.3, got %v", got.Spec.Owners)
+	}
+	for _, address := range []string{"10.96.0.1", "10.96.0.2"} {
+		event := <-recorder.Events
+		if !strings.HasPrefix(event, "Normal "+ReasonAddressHeld+" Address "+address+" held for Service ") {
+			t.Fatalf("unexpected event %q", event)
+		}
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Fatalf("unexpected event %q", event)
+	default:
+	}
+}
+
+func TestServiceReconcilerStickyReservationsReplaced(t *testing.T) {
+	ctx := context.Background()
+	ipRange := newIPRange("allocator", "10.96.0.0/24", "10.96.0.1", "10.96.0.2", "10.96.0.5", "10.96.0.6")
+	ipRange.Spec.StickyReservationTTL = &metav1.Duration{Duration: time.Hour}
+	ipRange.Spec.Owners = []clusteripv1.AddressOwner{
+		{Address: "10.96.0.1", Namespace: "default", Name: "web"},
+		{Address: "10.96.0.2", Namespace: "default", Name: "db"},
+	}
+	expires := metav1.NewTime(time.Now().Add(time.Minute))
+	ipRange.Spec.StickyReservations = []clusteripv1.StickyReservation{
+		{Address: "10.96.0.5", Namespace: "default", Name: "web", Expires: &expires},
+		// added by hand, it is kept until it is removed
+		{Address: "10.96.0.6", Namespace: "default", Name: "db"},
+	}
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(ipRange).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &ServiceReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: recorder,
+	}
+
+	// the Services web and db were deleted
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ipRange)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Spec.Addresses, []string{"10.96.0.1", "10.96.0.6"}) {
+		t.Fatalf("expected 10.96.0.1 and 10.96.0.6 to be held, got %v", got.Spec.Addresses)
+	}
+	if len(got.Spec.StickyReservations) != 2 ||
+		got.Spec.StickyReservations[0].Address != "10.96.0.6" || got.Spec.StickyReservations[0].Expires != nil ||
+		got.Spec.StickyReservations[1].Address != "10.96.0.1" || got.Spec.StickyReservations[1].Name != "web" {
+		t.Fatalf("expected the sticky reservation of default/db kept and the one of default/web replaced, got %v", got.Spec.StickyReservations)
+	}
+	if event := <-recorder.Events; event != "Normal "+ReasonStickyReplaced+" Sticky reservation of address 10.96.0.5 for Service default/web replaced by address 10.96.0.1" {
+		t.Fatalf("unexpected event %q", event)
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Normal "+ReasonAddressHeld+" Address 10.96.0.1 held for Service default/web until ") {
+		t.Fatalf("unexpected event %q", event)
+	}
+	expectEvents(t, recorder,
+		"Normal "+ReasonAddressReleased+" Address 10.96.0.2 released, Service default/db was deleted",
+	)
+}
+
+func TestServiceReconcilerRanges(t *testing.T) {
+	ctx := context.Background()
+	low := newIPRange("low", "10.96.0.0/24", "10.96.0.5")
+	high := newIPRange("high", "10.96.0.0/25")
+	high.Spec.Priority = 10
+	other := newIPRange("other", "10.97.0.0/24")
+	web := newIPRange("web", "10.96.0.0/26")
+	web.Spec.Priority = 20
+	web.Spec.ServiceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	webService := newService("default", "d", "10.96.0.7")
+	webService.Labels = map[string]string{"app": "web"}
+	c := fake.NewClientBuilder().WithScheme(newScheme()).WithObjects(
+		low, high, other, web,
+		// allocated by the low range
+		newService("default", "a", "10.96.0.5"),
+		// not allocated, recovered in the range with the highest priority that selects the Service
+		newService("default", "b", "10.96.0.6"),
+		newService("default", "c", "10.97.0.1"),
+		webService,
+	).Build()
+	r := &ServiceReconciler{
+		Client:   c,
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   c.Scheme(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "b"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resourceVersions := map[string]string{}
+	for ipRange, expected := range map[*clusteripv1.IPRange][]string{
+		low:   {"10.96.0.5"},
+		high:  {"10.96.0.6"},
+		other: {"10.97.0.1"},
+		web:   {"10.96.0.7"},
+	} {
+		got := &clusteripv1.IPRange{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(got.Spec.Addresses, expected) {
+			t.Fatalf("IPRange %s expected addresses %v, got %v", ipRange.Name, expected, got.Spec.Addresses)
+		}
+		resourceVersions[ipRange.Name] = got.ResourceVersion
+	}
+
+	// the IPRanges in sync are not updated
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "b"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, resourceVersion := range resourceVersions {
+		got := &clusteripv1.IPRange{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "kube-system", Name: name}, got); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.ResourceVersion != resourceVersion {
+			t.Fatalf("IPRange %s was updated", name)
+		}
+	}
+}
+
+func expectEvents(t *testing.T, recorder *record.FakeRecorder, expected ...string) {
+	t.Helper()
+	for _, event := range expected {
+		if got := <-recorder.Events; got != event {
+			t.Fatalf("expected event %q, got %q", event, got)
+		}
+	}
+	if len(recorder.Events) != 0 {
+		t.Fatalf("unexpected event %q", <-recorder.Events)
+	}
+}
+
+func TestNamespaceUsage(t *testing.T) {
+	ipRange := newIPRange("allocator", "10.96.0.0/24")
+	ipRange.Spec.NamespaceQuotas = []clusteripv1.NamespaceQuota{
+		{Namespace: "tenant-a", Limit: 2},
+		{Namespace: "tenant-b", Limit: 3},
+	}
+	services := map[string]*v1.Service{
+		"10.96.0.1": newService("tenant-a", "a", "10.96.0.1"),
+		"10.96.0.2": newService("tenant-a", "b", "10.96.0.2"),
+		"10.96.0.3": newService("default", "c", "10.96.0.3"),
+	}
+	expected := []clusteripv1.NamespaceUsage{
+		{Namespace: "tenant-a", Allocated: 2, Limit: 2},
+		{Namespace: "tenant-b", Allocated: 0, Limit: 3},
+	}
+	if got := namespaceUsage(ipRange, services); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// the namespaces with Services are limited by the default quota
+	ipRange.Spec.DefaultNamespaceQuota = pointer.Int64Ptr(1)
+	expected = append([]clusteripv1.NamespaceUsage{{Namespace: "default", Allocated: 1, Limit: 1}}, expected...)
+	if got := namespaceUsage(ipRange, services); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
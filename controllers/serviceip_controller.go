@@ -0,0 +1,168 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+// ServiceIPReconciler commits the ServiceIPs to the Service that uses their address,
+// and releases the ServiceIPs whose Service no longer exists
+type ServiceIPReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// GracePeriod is the time the ServiceIPs without owner are kept if no Service uses their address,
+	// the reserved ServiceIPs are kept until their reservation expires.
+	GracePeriod time.Duration
+}
+
+// +kubebuilder:rbac:groups=clusterip.allocator.x-k8s.io,resources=serviceips,verbs=get;list;watch;create;update;patch;delete
+
+func (r *ServiceIPReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("serviceip", req.Name)
+
+	serviceIP := &clusteripv1beta2.ServiceIP{}
+	if err := r.Get(ctx, req.NamespacedName, serviceIP); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	owner := serviceIP.Spec.Owner
+	if owner != nil && owner.Kind != "Service" {
+		return ctrl.Result{}, nil
+	}
+
+	svc, err := r.serviceFor(ctx, serviceIP)
+	if err != nil {
+		log.Error(err, "unable to fetch Service")
+		return ctrl.Result{}, err
+	}
+	if svc != nil {
+		// the Service still owns the address
+		if owner != nil && owner.UID != "" {
+			return ctrl.Result{}, nil
+		}
+		// the address was allocated before the Service existed, it is committed to the Service
+		serviceIP.Spec.Owner = &clusteripv1beta2.OwnerReference{
+			Kind:      "Service",
+			Namespace: svc.Namespace,
+			Name:      svc.Name,
+			UID:       svc.UID,
+		}
+		delete(serviceIP.Annotations, clusteripv1beta2.ServiceIPExpiresAnnotation)
+		if err := r.Update(ctx, serviceIP); err != nil {
+			log.Error(err, "unable to commit ServiceIP")
+			return ctrl.Result{}, err
+		}
+		log.Info("committed ServiceIP", "owner", svc.Namespace+"/"+svc.Name)
+		return ctrl.Result{}, nil
+	}
+
+	// the Service may not be created yet, the ServiceIPs not committed are kept until they expire
+	if owner == nil || owner.UID == "" {
+		if wait := time.Until(r.expires(serviceIP)); wait > 0 {
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+
+	log.Info("releasing ServiceIP, no Service uses the address")
+	if err := r.Delete(ctx, serviceIP); err != nil && !apierrors.IsNotFound(err) {
+		log.Error(err, "unable to delete ServiceIP")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// serviceFor returns the Service that uses the address of the ServiceIP: its owner if it has one,
+// or else any Service with the address as ClusterIP. It returns nil if no Service uses the address.
+func (r *ServiceIPReconciler) serviceFor(ctx context.Context, serviceIP *clusteripv1beta2.ServiceIP) (*v1.Service, error) {
+	if owner := serviceIP.Spec.Owner; owner != nil {
+		svc := &v1.Service{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: owner.Namespace, Name: owner.Name}, svc)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if (owner.UID == "" || owner.UID == svc.UID) && sameIP(svc.Spec.ClusterIP, serviceIP.Name) {
+			return svc, nil
+		}
+		return nil, nil
+	}
+	var svcList v1.ServiceList
+	if err := r.List(ctx, &svcList); err != nil {
+		return nil, err
+	}
+	for i := range svcList.Items {
+		if sameIP(svcList.Items[i].Spec.ClusterIP, serviceIP.Name) {
+			return &svcList.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// expires returns the time the ServiceIP not committed is released if no Service uses its address,
+// the expiration of the reservation or else the grace period after the ServiceIP was created
+func (r *ServiceIPReconciler) expires(serviceIP *clusteripv1beta2.ServiceIP) time.Time {
+	if value, ok := serviceIP.Annotations[clusteripv1beta2.ServiceIPExpiresAnnotation]; ok {
+		if expires, err := time.Parse(time.RFC3339, value); err == nil {
+			return expires
+		}
+	}
+	return serviceIP.CreationTimestamp.Add(r.GracePeriod)
+}
+
+// sameIP returns true if the ServiceIP name represents the ClusterIP
+func sameIP(clusterIP, name string) bool {
+	ip := net.ParseIP(clusterIP)
+	return ip != nil && ip.Equal(clusteripv1beta2.ParseServiceIPName(name))
+}
+
+// serviceIPForService maps a Service to the ServiceIP of its ClusterIP
+func (r *ServiceIPReconciler) serviceIPForService(obj client.Object) []reconcile.Request {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		return nil
+	}
+	ip := net.ParseIP(svc.Spec.ClusterIP)
+	if ip == nil {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: clusteripv1beta2.ServiceIPName(ip)}}}
+}
+
+func (r *ServiceIPReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&clusteripv1beta2.ServiceIP{}).
+		Watches(&source.Kind{Type: &v1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.serviceIPForService)).
+		Complete(r)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+func newServiceIP(name, svcName string) *clusteripv1beta2.ServiceIP {
+	return &clusteripv1beta2.ServiceIP{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: clusteripv1beta2.ServiceIPSpec{
+			Range: "10.96.0.0/24",
+			Owner: &clusteripv1beta2.OwnerReference{Kind: "Service", Namespace: "default", Name: svcName},
+		},
+	}
+}
+
+func TestServiceIPReconciler(t *testing.T) {
+	ctx := context.Background()
+	scheme := newScheme()
+	utilruntime.Must(clusteripv1beta2.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newServiceIP("10.96.0.1", "live"),
+		newServiceIP("10.96.0.2", "deleted"),
+		// the Service was recreated with other ClusterIP
+		newServiceIP("10.96.0.3", "recreated"),
+		newService("default", "live", "10.96.0.1"),
+		newService("default", "recreated", "10.96.0.4"),
+	).Build()
+	r := &ServiceIPReconciler{
+		Client: c,
+		Log:    ctrl.Log.WithName("test"),
+		Scheme: scheme,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		exists bool
+	}{
+		{name: "10.96.0.1", exists: true},
+		{name: "10.96.0.2", exists: false},
+		{name: "10.96.0.3", exists: false},
+	} {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: tc.name}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err := c.Get(ctx, client.ObjectKey{Name: tc.name}, &clusteripv1beta2.ServiceIP{})
+		if tc.exists && err != nil {
+			t.Errorf("expected ServiceIP %s to exist, got %v", tc.name, err)
+		}
+		if !tc.exists && !apierrors.IsNotFound(err) {
+			t.Errorf("expected ServiceIP %s to be released, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestServiceIPReconcilerReservations(t *testing.T) {
+	ctx := context.Background()
+	scheme := newScheme()
+	utilruntime.Must(clusteripv1beta2.AddToScheme(scheme))
+	reserved := func(name string, expires time.Time) *clusteripv1beta2.ServiceIP {
+		serviceIP := newServiceIP(name, "")
+		serviceIP.Spec.Owner = nil
+		serviceIP.Annotations = map[string]string{
+			clusteripv1beta2.ServiceIPExpiresAnnotation: expires.UTC().Format(time.RFC3339),
+		}
+		return serviceIP
+	}
+	svc := newService("default", "created", "10.96.0.1")
+	svc.UID = "123"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		// the Service was created after the webhook reserved the address
+		reserved("10.96.0.1", time.Now().Add(time.Minute)),
+		// the Service is not created yet
+		reserved("10.96.0.2", time.Now().Add(time.Minute)),
+		// the Service create failed
+		reserved("10.96.0.3", time.Now().Add(-time.Minute)),
+		// the address was allocated without owner and the grace period passed
+		&clusteripv1beta2.ServiceIP{ObjectMeta: metav1.ObjectMeta{Name: "10.96.0.4"}, Spec: clusteripv1beta2.ServiceIPSpec{Range: "10.96.0.0/24"}},
+		svc,
+	).Build()
+	r := &ServiceIPReconciler{
+		Client:      c,
+		Log:         ctrl.Log.WithName("test"),
+		Scheme:      scheme,
+		GracePeriod: time.Minute,
+	}
+
+	for _, tc := range []struct {
+		name    string
+		exists  bool
+		requeue bool
+	}{
+		{name: "10.96.0.1", exists: true},
+		{name: "10.96.0.2", exists: true, requeue: true},
+		{name: "10.96.0.3", exists: false},
+		{name: "10.96.0.4", exists: false},
+	} {
+		result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: tc.name}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if tc.requeue != (result.RequeueAfter > 0) {
+			t.Errorf("ServiceIP %s: expected requeue %v, got %v", tc.name, tc.requeue, result.RequeueAfter)
+		}
+		err = c.Get(ctx, client.ObjectKey{Name: tc.name}, &clusteripv1beta2.ServiceIP{})
+		if tc.exists && err != nil {
+			t.Errorf("expected ServiceIP %s to exist, got %v", tc.name, err)
+		}
+		if !tc.exists && !apierrors.IsNotFound(err) {
+			t.Errorf("expected ServiceIP %s to be released, got %v", tc.name, err)
+		}
+	}
+
+	committed := &clusteripv1beta2.ServiceIP{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "10.96.0.1"}, committed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if owner := committed.Spec.Owner; owner == nil || owner.Name != "created" || owner.UID != "123" {
+		t.Fatalf("expected the ServiceIP to be committed to the Service, got owner %v", owner)
+	}
+	if _, ok := committed.Annotations[clusteripv1beta2.ServiceIPExpiresAnnotation]; ok {
+		t.Fatalf("expected the reservation to be removed")
+	}
+}
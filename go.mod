@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/go-logr/logr v0.3.0
 	github.com/stretchr/testify v1.6.1 // indirect
+	go.uber.org/zap v1.15.0
 	k8s.io/api v0.19.2
 	k8s.io/apimachinery v0.19.2
 	k8s.io/client-go v0.19.2
@@ -0,0 +1,31 @@
+// Package services holds the helpers over the Services shared by the API versions.
+package services
+
+import (
+	"context"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ClusterIPs returns the ClusterIPs of the existing Services mapped to the Service namespace/name.
+// It returns nil if there is no client to obtain the Services.
+func ClusterIPs(ctx context.Context, c client.Reader) (map[string]string, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var svcList corev1.ServiceList
+	if err := c.List(ctx, &svcList); err != nil {
+		return nil, err
+	}
+	svcIPs := map[string]string{}
+	for _, svc := range svcList.Items {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil {
+			continue
+		}
+		svcIPs[ip.String()] = svc.Namespace + "/" + svc.Name
+	}
+	return svcIPs, nil
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestClusterIPs(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kubernetes"},
+			Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.1"},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "headless"},
+			Spec:       corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone},
+		},
+	).Build()
+	svcIPs, err := ClusterIPs(context.Background(), c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(svcIPs) != 1 || svcIPs["10.96.0.1"] != "default/kubernetes" {
+		t.Fatalf("unexpected Services ClusterIPs %v", svcIPs)
+	}
+	if svcIPs, err := ClusterIPs(context.Background(), nil); svcIPs != nil || err != nil {
+		t.Fatalf("expected no ClusterIPs without client, got %v %v", svcIPs, err)
+	}
+}
@@ -0,0 +1,152 @@
+// Package validation holds the validation of the IPRange fields shared by the API versions.
+package validation
+
+import (
+	"fmt"
+	"net"
+
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// NamespaceQuota is the quota of a namespace of any API version.
+type NamespaceQuota struct {
+	Namespace string
+	Limit     int64
+}
+
+// StickyReservation is the sticky reservation of a Service of any API version.
+type StickyReservation struct {
+	Address   string
+	Namespace string
+	Name      string
+}
+
+// Address validates that the address is a valid IP that belongs to the range and is not
+// the network address. The range is not checked if it is nil.
+func Address(address string, ipRange *net.IPNet, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		allErrs = append(allErrs, field.Invalid(fldPath, address, "must be a valid IP address"))
+	case ipRange == nil:
+		// the range is invalid
+	case !ipRange.Contains(ip):
+		allErrs = append(allErrs, field.Invalid(fldPath, address, "out of range "+ipRange.String()))
+	case ip.Equal(ipRange.IP):
+		allErrs = append(allErrs, field.Invalid(fldPath, address, "reserved address"))
+	}
+	return allErrs
+}
+
+// Reserved validates that each address never allocated dynamically is a valid IP that belongs
+// to the range, the network address is allowed. The range is not checked if it is nil.
+func Reserved(reserved []string, ipRange *net.IPNet, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, address := range reserved {
+		ip := net.ParseIP(address)
+		switch {
+		case ip == nil:
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), address, "must be a valid IP address"))
+		case ipRange == nil:
+			// the range is invalid
+		case !ipRange.Contains(ip):
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), address, "out of range "+ipRange.String()))
+		}
+	}
+	return allErrs
+}
+
+// NamespacePolicy validates the namespaces and the namespace selector allowed to allocate from the range.
+func NamespacePolicy(namespaces []string, selector *metav1.LabelSelector, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, namespace := range namespaces {
+		for _, msg := range apivalidation.ValidateNamespaceName(namespace, false) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("allowedNamespaces").Index(i), namespace, msg))
+		}
+	}
+	allErrs = append(allErrs, metav1validation.ValidateLabelSelector(selector, specPath.Child("namespaceSelector"))...)
+	return allErrs
+}
+
+// NamespaceQuotas validates the quotas of the namespaces, the limits can not be negative.
+func NamespaceQuotas(quotas []NamespaceQuota, defaultQuota *int64, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	fldPath := specPath.Child("namespaceQuotas")
+	namespaces := sets.NewString()
+	for i, quota := range quotas {
+		for _, msg := range apivalidation.ValidateNamespaceName(quota.Namespace, false) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("namespace"), quota.Namespace, msg))
+		}
+		if namespaces.Has(quota.Namespace) {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i).Child("namespace"), quota.Namespace))
+		}
+		namespaces.Insert(quota.Namespace)
+		if quota.Limit < 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("limit"), quota.Limit, "must be greater than or equal to 0"))
+		}
+	}
+	if defaultQuota != nil && *defaultQuota < 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("defaultNamespaceQuota"), *defaultQuota, "must be greater than or equal to 0"))
+	}
+	return allErrs
+}
+
+// Reservations validates that the address of each reservation is allocated.
+func Reservations(reserved []string, addresses sets.String, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, address := range reserved {
+		if !addresses.Has(address) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("address"), address, "reserved address must be allocated"))
+		}
+	}
+	return allErrs
+}
+
+// StickyReservations validates that each sticky address belongs to the range
+// and that each Service holds at most one sticky address of the range.
+func StickyReservations(reservations []StickyReservation, ttl *metav1.Duration, ipRange *net.IPNet, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if ttl != nil && ttl.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("stickyReservationTTL"), ttl.Duration.String(), "must be greater than or equal to 0"))
+	}
+	fldPath := specPath.Child("stickyReservations")
+	services := sets.NewString()
+	for i, reservation := range reservations {
+		idxPath := fldPath.Index(i)
+		allErrs = append(allErrs, Address(reservation.Address, ipRange, idxPath.Child("address"))...)
+		for _, msg := range apivalidation.ValidateNamespaceName(reservation.Namespace, false) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("namespace"), reservation.Namespace, msg))
+		}
+		for _, msg := range apivalidation.NameIsDNS1035Label(reservation.Name, false) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("name"), reservation.Name, msg))
+		}
+		service := reservation.Namespace + "/" + reservation.Name
+		if services.Has(service) {
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("name"), service))
+		}
+		services.Insert(service)
+	}
+	return allErrs
+}
+
+// Delete validates that the addresses of a range being deleted are not allocated to Services.
+// svcIPs maps the ClusterIPs of the existing Services to the Service namespace/name,
+// if it is nil all the addresses are considered in use.
+func Delete(addresses []string, svcIPs map[string]string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, address := range addresses {
+		if svcIPs == nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Index(i), "IPRange can not be deleted if addresses are allocated"))
+			continue
+		}
+		if svc, ok := svcIPs[address]; ok {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Index(i), fmt.Sprintf("address %s is allocated to Service %s", address, svc)))
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,83 @@
+package validation
+
+import (
+	"net"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestAddress(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.96.0.0/24")
+	fldPath := field.NewPath("address")
+	testCases := []struct {
+		address string
+		ipRange *net.IPNet
+		valid   bool
+	}{
+		{address: "10.96.0.1", ipRange: ipRange, valid: true},
+		{address: "10.96.0.0", ipRange: ipRange},
+		{address: "10.96.1.1", ipRange: ipRange},
+		{address: "not-an-ip", ipRange: ipRange},
+		{address: "10.96.1.1", valid: true},
+		{address: "not-an-ip"},
+	}
+	for _, tc := range testCases {
+		allErrs := Address(tc.address, tc.ipRange, fldPath)
+		if tc.valid != (len(allErrs) == 0) {
+			t.Errorf("address %s in range %v: expected valid %v, got %v", tc.address, tc.ipRange, tc.valid, allErrs)
+		}
+	}
+}
+
+func TestReserved(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.96.0.0/24")
+	fldPath := field.NewPath("reserved")
+	allErrs := Reserved([]string{"10.96.0.0", "10.96.0.10", "10.96.1.10", "not-an-ip"}, ipRange, fldPath)
+	if len(allErrs) != 2 || allErrs[0].Field != fldPath.Index(2).String() || allErrs[1].Field != fldPath.Index(3).String() {
+		t.Fatalf("expected errors on the addresses out of range and invalid, got %v", allErrs)
+	}
+	if allErrs := Reserved([]string{"10.96.1.10", "not-an-ip"}, nil, fldPath); len(allErrs) != 1 {
+		t.Fatalf("expected only the invalid address without range, got %v", allErrs)
+	}
+}
+
+func TestStickyReservations(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.96.0.0/24")
+	specPath := field.NewPath("spec")
+	reservations := []StickyReservation{
+		{Address: "10.96.0.10", Namespace: "default", Name: "web"},
+		{Address: "10.96.0.11", Namespace: "default", Name: "web"},
+		{Address: "10.96.1.10", Namespace: "default", Name: "db"},
+	}
+	allErrs := StickyReservations(reservations, &metav1.Duration{Duration: -1}, ipRange, specPath)
+	expected := []string{
+		specPath.Child("stickyReservationTTL").String(),
+		specPath.Child("stickyReservations").Index(1).Child("name").String(),
+		specPath.Child("stickyReservations").Index(2).Child("address").String(),
+	}
+	if len(allErrs) != len(expected) {
+		t.Fatalf("expected errors %v, got %v", expected, allErrs)
+	}
+	for i := range allErrs {
+		if allErrs[i].Field != expected[i] {
+			t.Errorf("expected error on %s, got %v", expected[i], allErrs[i])
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	fldPath := field.NewPath("spec", "addresses")
+	addresses := []string{"10.96.0.1", "10.96.0.2"}
+	if allErrs := Delete(addresses, nil, fldPath); len(allErrs) != 2 {
+		t.Fatalf("expected all the addresses in use without Services, got %v", allErrs)
+	}
+	allErrs := Delete(addresses, map[string]string{"10.96.0.2": "default/web"}, fldPath)
+	if len(allErrs) != 1 || allErrs[0].Field != fldPath.Index(1).String() {
+		t.Fatalf("expected the address of the Service in use, got %v", allErrs)
+	}
+	if allErrs := Delete(addresses, map[string]string{}, fldPath); len(allErrs) != 0 {
+		t.Fatalf("unexpected errors %v", allErrs)
+	}
+}
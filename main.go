@@ -17,18 +17,35 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlhealthz "sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
 	"github.com/aojea/clusterip-webhook/controllers"
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+	"github.com/aojea/clusterip-webhook/pkg/certs"
+	"github.com/aojea/clusterip-webhook/pkg/healthz"
+	"github.com/aojea/clusterip-webhook/pkg/webhook"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -37,50 +54,218 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// Modes of the manager, the webhook replicas scale horizontally and
+// the controllers only run in the leader when leader election is enabled.
+const (
+	modeWebhook    = "webhook"
+	modeController = "controller"
+	modeAll        = "all"
+)
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta2.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var reservationTTL time.Duration
+	var mode string
+	var probeAddr, leaderElectionID string
+	var webhookHost, webhookCertDir string
+	var webhookPort int
+	var logLevel, logFormat string
+	var selfSignedCerts bool
+	var certSecret, webhookService string
+	var mutatingWebhooks, validatingWebhooks, conversionCRDs string
+	var certValidity time.Duration
+	var clusterIPRange, serviceIPRange string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&reservationTTL, "reservation-ttl", time.Minute,
+		"The time a ClusterIP reserved by the Service webhook is kept if the Service is not created.")
+	flag.StringVar(&probeAddr, "health-probe-addr", ":8081", "The address the /healthz and /readyz endpoints bind to.")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "b3df72c2.allocator.x-k8s.io",
+		"The name of the resource used for leader election, the replicas of the same deployment must use the same.")
+	flag.StringVar(&webhookHost, "webhook-host", "", "The address the webhook server binds to, all the addresses if empty.")
+	flag.IntVar(&webhookPort, "webhook-port", 9443, "The port the webhook server binds to.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "",
+		"The directory with the tls.crt and tls.key files of the webhook server, /tmp/k8s-webhook-server/serving-certs if empty.")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level of the logs: debug, info or error.")
+	flag.StringVar(&logFormat, "log-format", "console", "The format of the logs: console or json.")
+	flag.StringVar(&clusterIPRange, "cluster-ip-range", "",
+		"The name of the ClusterIPRange all the Services allocate their ClusterIP from, the IPRanges are used if empty.")
+	flag.StringVar(&serviceIPRange, "service-ip-range", "",
+		"The CIDR all the Services allocate their ClusterIP from, storing each address in a ServiceIP object. "+
+			"The IPRanges are used if empty.")
+	flag.StringVar(&mode, "mode", modeAll,
+		"The components to run: webhook, controller or all. "+
+			"The webhook can run in several replicas, the controllers only run in the elected leader.")
+	flag.BoolVar(&selfSignedCerts, "self-signed-certs", false,
+		"Generate and rotate a self-signed certificate for the webhook server instead of using cert-manager.")
+	flag.StringVar(&certSecret, "cert-secret", "alloc-system/alloc-webhook-self-signed-cert",
+		"The namespace/name of the Secret with the self-signed CA and certificate.")
+	flag.StringVar(&webhookService, "webhook-service", "alloc-system/alloc-webhook-service",
+		"The namespace/name of the Service of the webhook server, the names of the self-signed certificate.")
+	flag.StringVar(&mutatingWebhooks, "mutating-webhook-configurations", "alloc-mutating-webhook-configuration",
+		"Comma separated MutatingWebhookConfigurations the self-signed CA is injected in.")
+	flag.StringVar(&validatingWebhooks, "validating-webhook-configurations", "alloc-validating-webhook-configuration",
+		"Comma separated ValidatingWebhookConfigurations the self-signed CA is injected in.")
+	flag.StringVar(&conversionCRDs, "conversion-crds", "ipranges.clusterip.allocator.x-k8s.io",
+		"Comma separated CRDs with a conversion webhook the self-signed CA is injected in.")
+	flag.DurationVar(&certValidity, "cert-validity", 90*24*time.Hour,
+		"The validity of the self-signed CA and certificate, they are rotated when less than a third remains.")
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	logger, err := newLogger(logLevel, logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid flags: %v\n", err)
+		os.Exit(1)
+	}
+	ctrl.SetLogger(logger)
+
+	runWebhooks := mode == modeWebhook || mode == modeAll
+	runControllers := mode == modeController || mode == modeAll
+	if !runWebhooks && !runControllers {
+		setupLog.Error(fmt.Errorf("unknown mode %q", mode), "invalid flags", "modes", []string{modeWebhook, modeController, modeAll})
+		os.Exit(1)
+	}
+	// the webhook replicas don't run the controllers, so they don't take part in the election
+	if mode == modeWebhook && enableLeaderElection {
+		setupLog.Info("leader election is not used in webhook mode")
+		enableLeaderElection = false
+	}
+	if clusterIPRange != "" && serviceIPRange != "" {
+		setupLog.Error(fmt.Errorf("--cluster-ip-range and --service-ip-range are mutually exclusive"), "invalid flags")
+		os.Exit(1)
+	}
+	var serviceIPCIDR *net.IPNet
+	if serviceIPRange != "" {
+		if _, serviceIPCIDR, err = net.ParseCIDR(serviceIPRange); err != nil {
+			setupLog.Error(err, "invalid flags", "service-ip-range", serviceIPRange)
+			os.Exit(1)
+		}
+	}
+	setupLog.Info("starting components", "mode", mode, "leaderElection", enableLeaderElection)
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		LeaderElection:     enableLeaderElection,
-		LeaderElectionID:   "b3df72c2.allocator.x-k8s.io",
+		Scheme:                 scheme,
+		MetricsBindAddress:     metricsAddr,
+		HealthProbeBindAddress: probeAddr,
+		Host:                   webhookHost,
+		Port:                   webhookPort,
+		CertDir:                webhookCertDir,
+		LeaderElection:         enableLeaderElection,
+		LeaderElectionID:       leaderElectionID,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+	if err := mgr.AddHealthzCheck("ping", ctrlhealthz.Ping); err != nil {
+		setupLog.Error(err, "unable to add health check")
+		os.Exit(1)
+	}
+	// the apiserver is read directly, the cache is not synced before the manager starts
+	if err := mgr.AddReadyzCheck("iprange", healthz.IPRangeChecker(mgr.GetAPIReader())); err != nil {
+		setupLog.Error(err, "unable to add readiness check")
+		os.Exit(1)
+	}
+
+	if runWebhooks && os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err := mgr.AddReadyzCheck("webhook", healthz.WebhookTLSChecker(webhookHost, webhookPort)); err != nil {
+			setupLog.Error(err, "unable to add readiness check")
+			os.Exit(1)
+		}
 		if err = (&clusteripv1.IPRange{}).SetupWebhookWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "IPRange")
 			os.Exit(1)
 		}
+		if err = (&clusteripv1beta2.IPRange{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "IPRange")
+			os.Exit(1)
+		}
+		if err = (&clusteripv1beta1.ClusterIPRange{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterIPRange")
+			os.Exit(1)
+		}
+		// the allocator reads the IPRange from the cache and writes it directly to the apiserver
+		directClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+		if err != nil {
+			setupLog.Error(err, "unable to create client", "webhook", "Service")
+			os.Exit(1)
+		}
+		if selfSignedCerts {
+			if err := setupSelfSignedCerts(mgr, directClient, certSecret, webhookService, webhookCertDir,
+				mutatingWebhooks, validatingWebhooks, conversionCRDs, certValidity); err != nil {
+				setupLog.Error(err, "unable to set up the self-signed certificates")
+				os.Exit(1)
+			}
+		}
+		// the addresses are reserved from the ClusterIPRange or the ServiceIPs if they are set,
+		// or else from the IPRanges that select the Services
+		serviceAllocator := &webhook.ServiceAllocator{
+			Client:   directClient,
+			TTL:      reservationTTL,
+			Log:      ctrl.Log.WithName("webhooks").WithName("Service"),
+			Recorder: mgr.GetEventRecorderFor("service-webhook"),
+			Reader:   mgr.GetClient(),
+		}
+		if clusterIPRange != "" {
+			serviceAllocator.Allocator = allocator.NewClusterIPRangeAllocator(clusterIPRange, directClient, mgr.GetClient())
+		}
+		if serviceIPCIDR != nil {
+			serviceAllocator.Allocator = allocator.NewServiceIPRange(serviceIPRangeName(serviceIPCIDR), serviceIPCIDR, directClient)
+		}
+		serviceAllocator.SetupWithManager(mgr)
 	}
 
-	if err = (&controllers.ServiceReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Service"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Service")
-		os.Exit(1)
+	// the controllers repair the IPRanges, so only one replica runs them
+	if runControllers {
+		if err = (&controllers.ServiceReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("Service"),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("service-controller"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Service")
+			os.Exit(1)
+		}
+		if err = (&controllers.IPRangeReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("IPRange"),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("iprange-controller"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "IPRange")
+			os.Exit(1)
+		}
+		if err = (&controllers.ClusterIPRangeReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("ClusterIPRange"),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("clusteriprange-controller"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ClusterIPRange")
+			os.Exit(1)
+		}
+		if err = (&controllers.ServiceIPReconciler{
+			Client:      mgr.GetClient(),
+			Log:         ctrl.Log.WithName("controllers").WithName("ServiceIP"),
+			Scheme:      mgr.GetScheme(),
+			GracePeriod: reservationTTL,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ServiceIP")
+			os.Exit(1)
+		}
 	}
 	// +kubebuilder:scaffold:builder
 
@@ -90,3 +275,92 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// serviceIPRangeName returns the name the ServiceIPs of the CIDR are labeled with,
+// the label values can not contain slashes or colons
+func serviceIPRangeName(cidr *net.IPNet) string {
+	return strings.NewReplacer("/", "-", ":", "-").Replace(cidr.String())
+}
+
+// setupSelfSignedCerts writes the certificate of the webhook server before the manager starts
+// it, and adds the rotator of the certificates to the manager
+func setupSelfSignedCerts(mgr ctrl.Manager, c client.Client, secret, service, certDir string,
+	mutatingWebhooks, validatingWebhooks, crds string, validity time.Duration) error {
+	secretKey, err := parseNamespacedName(secret)
+	if err != nil {
+		return fmt.Errorf("invalid --cert-secret: %v", err)
+	}
+	serviceKey, err := parseNamespacedName(service)
+	if err != nil {
+		return fmt.Errorf("invalid --webhook-service: %v", err)
+	}
+	// the certificates must not expire between two checks
+	if validity < 3*certs.DefaultInterval {
+		return fmt.Errorf("invalid --cert-validity: it must be at least %v", 3*certs.DefaultInterval)
+	}
+	// the default directory of the webhook server
+	if certDir == "" {
+		certDir = filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
+	}
+	rotator := &certs.Rotator{
+		Client:                          c,
+		Log:                             ctrl.Log.WithName("certs"),
+		Secret:                          secretKey,
+		Service:                         serviceKey,
+		CertDir:                         certDir,
+		MutatingWebhookConfigurations:   splitList(mutatingWebhooks),
+		ValidatingWebhookConfigurations: splitList(validatingWebhooks),
+		CRDs:                            splitList(crds),
+		Validity:                        validity,
+	}
+	// the webhook server fails to start without a certificate
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := rotator.Sync(ctx); err != nil {
+		return err
+	}
+	return mgr.Add(rotator)
+}
+
+// parseNamespacedName parses a namespace/name string
+func parseNamespacedName(s string) (types.NamespacedName, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, fmt.Errorf("%q is not namespace/name", s)
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+// splitList returns the non empty items of a comma separated list
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newLogger returns a logger that writes the logs of the given level or above in the given format
+func newLogger(level, format string) (logr.Logger, error) {
+	var zapLevel zapcore.Level
+	switch level {
+	case "debug", "info", "error":
+		if err := zapLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	opts := []zap.Opts{zap.Level(zapLevel)}
+	switch format {
+	case "console":
+		opts = append(opts, zap.ConsoleEncoder())
+	case "json":
+		opts = append(opts, zap.JSONEncoder())
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return zap.New(opts...), nil
+}
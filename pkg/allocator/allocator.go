@@ -3,17 +3,19 @@ package allocator
 import (
 	"context"
 	"errors"
-	"fmt"
 	"math/rand"
 	"net"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/retry"
 	utilnet "k8s.io/utils/net"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
 	"github.com/go-logr/logr"
 )
 
@@ -31,77 +33,231 @@ type Interface interface {
 	Has(ip net.IP) bool
 }
 
-var (
-	ErrFull              = errors.New("range is full")
-	ErrAllocated         = errors.New("provided IP is already allocated")
-	ErrMismatchedNetwork = errors.New("the provided network does not match the current range")
-)
-
-// assume that the IPRange object is well-known for the moment
-// namespace kube-system name ipv4range
+// rangeObject is the API object that stores the allocated addresses of a range,
+// it is implemented by the namespaced v1 IPRange and the cluster-scoped v1beta1 ClusterIPRange.
+type rangeObject interface {
+	client.Object
+	GetRange() string
+	GetAddresses() []string
+	SetAddresses([]string)
+	// GetReserved returns the addresses that are only allocated explicitly
+	GetReserved() []string
+	GetReservations() map[string]metav1.Time
+	SetReservations(map[string]metav1.Time)
+}
 
 type Range struct {
 	client client.Client
+	// reader is used to get the object that stores the range, it is the client
+	// unless the Range is backed by an informer cache
+	reader client.Reader
 	Log    logr.Logger
+	// key of the object that stores the range
+	key client.ObjectKey
+	// newObject returns an empty object of the kind that stores the range
+	newObject func() rangeObject
 }
 
 var _ Interface = &Range{}
 
-// NewAllocatorCDRRange creates a Range over a net.IPNet
-func NewAllocatorCIDRRange(cidr *net.IPNet, client client.Client) (*Range, error) {
+// NewAllocatorCIDRRange creates a Range over a net.IPNet
+// stored in a new IPRange object with the given namespace and name
+func NewAllocatorCIDRRange(key client.ObjectKey, cidr *net.IPNet, c client.Client) (*Range, error) {
 	ctx := context.Background()
 	// create IPRange object
 	ipRange := clusteripv1.IPRange{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: "kube-system",
-			Name:      "allocator",
+			Namespace: key.Namespace,
+			Name:      key.Name,
 		},
 		Spec: clusteripv1.IPRangeSpec{
 			Range: cidr.String(),
 		},
 	}
-	err := client.Create(ctx, &ipRange)
+	err := c.Create(ctx, &ipRange)
+	return NewIPRangeAllocator(key, c, c), err
+}
+
+// NewClusterAllocatorCIDRRange creates a Range over a net.IPNet
+// stored in the cluster-scoped ClusterIPRange object with the given name
+func NewClusterAllocatorCIDRRange(name string, cidr *net.IPNet, c client.Client) (*Range, error) {
+	ctx := context.Background()
+	// create ClusterIPRange object
+	ipRange := clusteripv1beta1.ClusterIPRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: clusteripv1beta1.ClusterIPRangeSpec{
+			Range: cidr.String(),
+		},
+	}
+	err := c.Create(ctx, &ipRange)
+	return NewClusterIPRangeAllocator(name, c, c), err
+}
+
+// NewClusterIPRangeAllocator returns a Range stored in an existing ClusterIPRange object,
+// the reads are served from the reader and the writes use the client.
+func NewClusterIPRangeAllocator(name string, c client.Client, reader client.Reader) *Range {
+	return &Range{
+		client:    c,
+		reader:    reader,
+		Log:       ctrl.Log.WithName("clusteriprange"),
+		key:       client.ObjectKey{Name: name},
+		newObject: func() rangeObject { return &clusteripv1beta1.ClusterIPRange{} },
+	}
+}
+
+// NewIPRangeAllocator returns a Range stored in an existing IPRange object,
+// the reads are served from the reader and the writes use the client.
+func NewIPRangeAllocator(key client.ObjectKey, c client.Client, reader client.Reader) *Range {
 	return &Range{
-		client: client,
-		Log:    ctrl.Log.WithName("iprange"),
-	}, err
+		client:    c,
+		reader:    reader,
+		Log:       ctrl.Log.WithName("iprange"),
+		key:       key,
+		newObject: func() rangeObject { return &clusteripv1.IPRange{} },
+	}
+}
+
+// NewCachedAllocatorCIDRRange creates a Range over a net.IPNet stored in a new IPRange
+// object with the given namespace and name that serves the reads from the informer cache,
+// i.e. the manager cache, and only uses the client to write.
+func NewCachedAllocatorCIDRRange(key client.ObjectKey, cidr *net.IPNet, client client.Client, cache client.Reader) (*Range, error) {
+	r, err := NewAllocatorCIDRRange(key, cidr, client)
+	r.reader = cache
+	return r, err
+}
+
+// validateAddress returns an error if the address can not be allocated from the range,
+// so the object that stores the range is never corrupted, even if the webhooks are disabled.
+func validateAddress(cidr *net.IPNet, ip net.IP) error {
+	if !cidr.Contains(ip) {
+		return ErrNotInRange
+	}
+	// the network address is never allocated
+	if ip.Equal(cidr.IP) {
+		return ErrReserved
+	}
+	return nil
+}
+
+// unavailable returns the addresses of the range that can not be allocated dynamically,
+// the allocated ones, the network address and the reserved addresses.
+func unavailable(ipRange rangeObject, cidr *net.IPNet) sets.String {
+	addresses := sets.NewString(ipRange.GetAddresses()...)
+	addresses.Insert(cidr.IP.String())
+	for _, address := range ipRange.GetReserved() {
+		if ip := net.ParseIP(address); ip != nil && cidr.Contains(ip) {
+			addresses.Insert(ip.String())
+		}
+	}
+	return addresses
+}
+
+// get returns the object that stores the range, if the reader is a cache
+// and the object is not there yet it is obtained from the apiserver
+func (r *Range) get(ctx context.Context) (rangeObject, error) {
+	obj := r.newObject()
+	err := r.reader.Get(ctx, r.key, obj)
+	if apierrors.IsNotFound(err) && r.reader != client.Reader(r.client) {
+		return r.getLive(ctx)
+	}
+	return obj, err
+}
+
+// getLive returns the object that stores the range from the apiserver
+func (r *Range) getLive(ctx context.Context) (rangeObject, error) {
+	obj := r.newObject()
+	err := r.client.Get(ctx, r.key, obj)
+	return obj, err
+}
+
+// update modifies the object that stores the range. The object is read from the reader,
+// but if the reader is a cache it may be stale, so the object is read from the apiserver
+// if the update conflicts or the modification fails.
+func (r *Range) update(ctx context.Context, modify func(rangeObject) error) error {
+	live := r.reader == client.Reader(r.client)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		get := r.get
+		if live {
+			get = r.getLive
+		}
+		ipRange, err := get(ctx)
+		if err != nil {
+			return err
+		}
+		if err := modify(ipRange); err != nil {
+			if live {
+				return err
+			}
+			// confirm with the apiserver that the cache is not stale
+			live = true
+			if ipRange, err = r.getLive(ctx); err != nil {
+				return err
+			}
+			if err := modify(ipRange); err != nil {
+				return err
+			}
+		}
+		err = r.client.Update(ctx, ipRange)
+		if apierrors.IsConflict(err) {
+			// the cache has not observed the last version yet
+			live = true
+		}
+		return err
+	})
 }
 
 func (r *Range) Allocate(ip net.IP) error {
 	ctx := context.Background()
 	log := r.Log.WithValues("iprange", ip)
-	ipRange := &clusteripv1.IPRange{}
-	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
-	if err := r.client.Get(ctx, key, ipRange); err != nil {
-		log.Error(err, "unable to fetch IPRange")
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		_, cidr, err := net.ParseCIDR(ipRange.GetRange())
+		if err != nil {
+			return err
+		}
+		if err := validateAddress(cidr, ip); err != nil {
+			return err
+		}
+		addresses := sets.NewString(ipRange.GetAddresses()...)
+		if addresses.Has(ip.String()) {
+			return ErrAllocated
+		}
+		addresses.Insert(ip.String())
+		ipRange.SetAddresses(addresses.List())
 		return nil
-	}
-	addresses := sets.NewString(ipRange.Spec.Addresses...)
-	if addresses.Has(ip.String()) {
-		return fmt.Errorf("ip %s already allocated", ip.String())
-	}
-	addresses.Insert(ip.String())
-	ipRange.Spec.Addresses = addresses.List()
-	if err := r.client.Update(ctx, ipRange); err != nil {
-		log.Error(err, "unable to update IPRange")
-		return err
+	})
+	if err != nil {
+		logAllocationError(log, err, "unable to update IPRange")
+		return toError(err)
 	}
 	return nil
 }
 
+// logAllocationError logs the error of an allocation, the addresses rejected by the range
+// are expected and only logged in verbose mode, the failures of the apiserver are errors.
+func logAllocationError(log logr.Logger, err error, msg string) {
+	if errors.Is(err, ErrAllocated) || errors.Is(err, ErrNotInRange) || errors.Is(err, ErrReserved) || errors.Is(err, ErrQuotaExceeded) {
+		log.V(1).Info(msg, "reason", err.Error())
+		return
+	}
+	log.Error(err, msg)
+}
+
 func (r *Range) AllocateNext() (net.IP, error) {
 	ctx := context.Background()
 	log := r.Log.WithName("iprange")
-	ipRange := &clusteripv1.IPRange{}
-	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
-	if err := r.client.Get(ctx, key, ipRange); err != nil {
+	ipRange, err := r.get(ctx)
+	if err != nil {
 		log.Error(err, "unable to fetch IPRange")
-		return nil, err
+		return nil, toError(err)
 	}
 	// find an empty address within the range
-	// Range is validated by the webhook
-	_, cidr, _ := net.ParseCIDR(ipRange.Spec.Range)
-	addresses := sets.NewString(ipRange.Spec.Addresses...)
+	_, cidr, err := net.ParseCIDR(ipRange.GetRange())
+	if err != nil {
+		return nil, err
+	}
+	addresses := unavailable(ipRange, cidr)
 	max := utilnet.RangeSize(cidr)
 	if int64(len(addresses)) >= max {
 		return net.IP{}, ErrFull
@@ -113,18 +269,22 @@ func (r *Range) AllocateNext() (net.IP, error) {
 		at := (offset + i) % max
 		ip, err := utilnet.GetIndexedIP(cidr, int(at))
 		if err != nil {
-			return net.IP{}, ErrAllocated
+			return net.IP{}, err
 		}
 		if !addresses.Has(ip.String()) {
 			err := r.Allocate(ip)
 			// it can happen we fail to allocate
 			// because it was already allocated by
 			// other apiserver
-			// if err is already allocated continue
+			// if err is already allocated or the range
+			// was modified concurrently continue
 			// otherwise return the error
-			if err != nil {
+			if errors.Is(err, ErrAllocated) || apierrors.IsConflict(err) {
 				continue
 			}
+			if err != nil {
+				return net.IP{}, err
+			}
 			return ip, nil
 		}
 	}
@@ -135,41 +295,52 @@ func (r *Range) AllocateNext() (net.IP, error) {
 func (r *Range) Release(ip net.IP) error {
 	ctx := context.Background()
 	log := r.Log.WithValues("iprange", ip)
-	ipRange := &clusteripv1.IPRange{}
-	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
-	if err := r.client.Get(ctx, key, ipRange); err != nil {
-		log.Error(err, "unable to fetch IPRange")
-		return err
-	}
-	addresses := sets.NewString(ipRange.Spec.Addresses...)
-	// return if the address doesn't exist in the allocator
-	if !addresses.Has(ip.String()) {
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		addresses := sets.NewString(ipRange.GetAddresses()...)
+		// return if the address doesn't exist in the allocator
+		if !addresses.Has(ip.String()) {
+			return errNotAllocated
+		}
+		addresses.Delete(ip.String())
+		ipRange.SetAddresses(addresses.List())
+		dropReservations(ipRange, ip.String())
+		return nil
+	})
+	if err == errNotAllocated {
 		return nil
 	}
-	addresses.Delete(ip.String())
-	ipRange.Spec.Addresses = addresses.List()
-	if err := r.client.Update(ctx, ipRange); err != nil {
-		log.Error(err, "unable to fetch IPRange")
-		return err
+	if err != nil {
+		log.Error(err, "unable to update IPRange")
+		return toError(err)
 	}
 	return nil
 }
 
-func (r *Range) ForEach(func(net.IP)) {
-
+func (r *Range) ForEach(f func(net.IP)) {
+	ctx := context.Background()
+	log := r.Log.WithName("iprange")
+	ipRange, err := r.get(ctx)
+	if err != nil {
+		log.Error(err, "unable to fetch IPRange")
+		return
+	}
+	for _, address := range ipRange.GetAddresses() {
+		if ip := net.ParseIP(address); ip != nil {
+			f(ip)
+		}
+	}
 }
 
 func (r *Range) CIDR() net.IPNet {
 	ctx := context.Background()
 	log := r.Log.WithName("iprange")
-	ipRange := &clusteripv1.IPRange{}
-	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
-	if err := r.client.Get(ctx, key, ipRange); err != nil {
+	ipRange, err := r.get(ctx)
+	if err != nil {
 		log.Error(err, "unable to fetch IPRange")
 		return net.IPNet{}
 	}
 	// Range is validated by the webhook
-	_, subnet, _ := net.ParseCIDR(ipRange.Spec.Range)
+	_, subnet, _ := net.ParseCIDR(ipRange.GetRange())
 	return *subnet
 
 }
@@ -178,12 +349,20 @@ func (r *Range) CIDR() net.IPNet {
 func (r *Range) Has(ip net.IP) bool {
 	ctx := context.Background()
 	log := r.Log.WithName("iprange")
-	ipRange := &clusteripv1.IPRange{}
-	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
-	if err := r.client.Get(ctx, key, ipRange); err != nil {
+	ipRange, err := r.get(ctx)
+	if err != nil {
 		log.Error(err, "unable to fetch IPRange")
 		return false
 	}
-	addresses := sets.NewString(ipRange.Spec.Addresses...)
+	addresses := sets.NewString(ipRange.GetAddresses()...)
 	return addresses.Has(ip.String())
 }
+
+// Object returns the object that stores the range, i.e. to emit events on it
+func (r *Range) Object() (client.Object, error) {
+	ipRange, err := r.get(context.Background())
+	if err != nil {
+		return nil, toError(err)
+	}
+	return ipRange, nil
+}
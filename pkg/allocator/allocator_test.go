@@ -7,8 +7,11 @@ import (
 	"testing"
 
 	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
 
 	"k8s.io/client-go/deprecated/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 )
@@ -32,6 +35,9 @@ func TestMain(t *testing.T) {
 	if err := clusteripv1.AddToScheme(scheme.Scheme); err != nil {
 		t.Fatalf("Unable to add iprange scheme: (%v)", err)
 	}
+	if err := clusteripv1beta1.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("Unable to add clusteriprange scheme: (%v)", err)
+	}
 
 	// +kubebuilder:scaffold:scheme
 
@@ -40,7 +46,7 @@ func TestMain(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 	ip, subnet, _ := net.ParseCIDR("10.96.0.2/24")
-	r, err := NewAllocatorCIDRRange(subnet, cs)
+	r, err := NewAllocatorCIDRRange(key, subnet, cs)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -66,6 +72,88 @@ func TestMain(t *testing.T) {
 	}
 	t.Logf("new Range addresses %v", ipRange.Spec.Addresses)
 
+	// Cluster-scoped range
+	_, subnet, _ = net.ParseCIDR("2001:db2::/120")
+	cr, err := NewClusterAllocatorCIDRRange("ipv6", subnet, cs)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	alloc, err := cr.AllocateNext()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !cr.Has(alloc) || !subnet.Contains(alloc) {
+		t.Fatalf("expected %v to be allocated in %v", alloc, subnet)
+	}
+	clusterIPRange := &clusteripv1beta1.ClusterIPRange{}
+	if err := cs.Get(ctx, client.ObjectKey{Name: "ipv6"}, clusterIPRange); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(clusterIPRange.Spec.Addresses) != 1 {
+		t.Fatalf("expected one address allocated, got %v", clusterIPRange.Spec.Addresses)
+	}
+
 	// stop testEnv
 	err = testEnv.Stop()
 }
+
+// benchmarkAllocateNext allocates and releases addresses in parallel from the Range
+// returned by newRange, against a real apiserver.
+func benchmarkAllocateNext(b *testing.B, newRange func(cfg *rest.Config, cs client.Client, subnet *net.IPNet) (*Range, error)) {
+	testEnv := &envtest.Environment{
+		CRDDirectoryPaths: []string{filepath.Join("../..", "config", "crd", "bases")},
+	}
+	cfg, err := testEnv.Start()
+	if err != nil {
+		b.Fatalf("Unable to start test environment: (%v)", err)
+	}
+	defer testEnv.Stop()
+	if err := clusteripv1.AddToScheme(scheme.Scheme); err != nil {
+		b.Fatalf("Unable to add iprange scheme: (%v)", err)
+	}
+	cs, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/16")
+	r, err := newRange(cfg, cs, subnet)
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ip, err := r.AllocateNext()
+			if err != nil {
+				b.Errorf("unexpected error: %v", err)
+				continue
+			}
+			if err := r.Release(ip); err != nil {
+				b.Errorf("unexpected error: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkRangeAllocateNext(b *testing.B) {
+	benchmarkAllocateNext(b, func(cfg *rest.Config, cs client.Client, subnet *net.IPNet) (*Range, error) {
+		return NewAllocatorCIDRRange(client.ObjectKey{Namespace: "kube-system", Name: "allocator"}, subnet, cs)
+	})
+}
+
+func BenchmarkCachedRangeAllocateNext(b *testing.B) {
+	benchmarkAllocateNext(b, func(cfg *rest.Config, cs client.Client, subnet *net.IPNet) (*Range, error) {
+		informerCache, err := cache.New(cfg, cache.Options{Scheme: scheme.Scheme})
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		b.Cleanup(cancel)
+		go informerCache.Start(ctx)
+		if !informerCache.WaitForCacheSync(ctx) {
+			b.Fatalf("unable to sync the cache")
+		}
+		return NewCachedAllocatorCIDRRange(client.ObjectKey{Namespace: "kube-system", Name: "allocator"}, subnet, cs, informerCache)
+	})
+}
@@ -0,0 +1,273 @@
+// Package allocatortest provides the conformance tests that every allocator.Interface
+// implementation must pass.
+package allocatortest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+)
+
+// NewAllocatorFunc returns an empty allocator over the given net.IPNet
+type NewAllocatorFunc func(t *testing.T, cidr *net.IPNet) allocator.Interface
+
+// TestInterface runs the conformance tests against the allocators returned by newAllocator,
+// each test uses a new allocator.
+func TestInterface(t *testing.T, newAllocator NewAllocatorFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, newAllocator NewAllocatorFunc)
+	}{
+		{"CIDR", testCIDR},
+		{"Allocate", testAllocate},
+		{"DoubleAllocation", testDoubleAllocation},
+		{"InvalidAddress", testInvalidAddress},
+		{"ReleaseUnknown", testReleaseUnknown},
+		{"FullRange", testFullRange},
+		{"ForEach", testForEach},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newAllocator)
+		})
+	}
+}
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return subnet
+}
+
+func testCIDR(t *testing.T, newAllocator NewAllocatorFunc) {
+	for _, cidr := range []string{"10.96.0.0/24", "2001:db2::/120"} {
+		subnet := mustParseCIDR(t, cidr)
+		r := newAllocator(t, subnet)
+		got := r.CIDR()
+		if got.String() != subnet.String() {
+			t.Fatalf("expected CIDR %s, got %s", subnet, got.String())
+		}
+	}
+}
+
+func testAllocate(t *testing.T, newAllocator NewAllocatorFunc) {
+	for _, address := range []string{"10.96.0.10", "2001:db2::10"} {
+		ip := net.ParseIP(address)
+		cidr := "10.96.0.0/24"
+		if utilnet.IsIPv6(ip) {
+			cidr = "2001:db2::/120"
+		}
+		r := newAllocator(t, mustParseCIDR(t, cidr))
+		if r.Has(ip) {
+			t.Fatalf("expected %s to be free", ip)
+		}
+		if err := r.Allocate(ip); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !r.Has(ip) {
+			t.Fatalf("expected %s to be allocated", ip)
+		}
+		if err := r.Release(ip); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if r.Has(ip) {
+			t.Fatalf("expected %s to be released", ip)
+		}
+		// released addresses can be allocated again
+		if err := r.Allocate(ip); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func testDoubleAllocation(t *testing.T, newAllocator NewAllocatorFunc) {
+	r := newAllocator(t, mustParseCIDR(t, "10.96.0.0/24"))
+	ip := net.ParseIP("10.96.0.10")
+	if err := r.Allocate(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Allocate(ip); !errors.Is(err, allocator.ErrAllocated) {
+		t.Fatalf("expected ErrAllocated, got %v", err)
+	}
+	if !r.Has(ip) {
+		t.Fatalf("expected %s to be allocated", ip)
+	}
+}
+
+func testInvalidAddress(t *testing.T, newAllocator NewAllocatorFunc) {
+	r := newAllocator(t, mustParseCIDR(t, "10.96.0.0/24"))
+	for _, address := range []string{"10.96.1.1", "2001:db2::1"} {
+		ip := net.ParseIP(address)
+		if err := r.Allocate(ip); !errors.Is(err, allocator.ErrNotInRange) {
+			t.Fatalf("expected ErrNotInRange for %s, got %v", ip, err)
+		}
+		if r.Has(ip) {
+			t.Fatalf("expected %s not to be allocated", ip)
+		}
+	}
+	// the network address is never allocated
+	network := net.ParseIP("10.96.0.0")
+	if err := r.Allocate(network); !errors.Is(err, allocator.ErrReserved) {
+		t.Fatalf("expected ErrReserved, got %v", err)
+	}
+	if r.Has(network) {
+		t.Fatalf("expected %s not to be allocated", network)
+	}
+}
+
+func testReleaseUnknown(t *testing.T, newAllocator NewAllocatorFunc) {
+	r := newAllocator(t, mustParseCIDR(t, "10.96.0.0/24"))
+	allocated := net.ParseIP("10.96.0.10")
+	if err := r.Allocate(allocated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// releasing an address that is not allocated is a no-op
+	for _, address := range []string{"10.96.0.11", "10.96.1.1", "2001:db2::1"} {
+		if err := r.Release(net.ParseIP(address)); err != nil {
+			t.Fatalf("unexpected error releasing %s: %v", address, err)
+		}
+	}
+	if !r.Has(allocated) {
+		t.Fatalf("expected %s to be allocated", allocated)
+	}
+}
+
+func testFullRange(t *testing.T, newAllocator NewAllocatorFunc) {
+	subnet := mustParseCIDR(t, "10.96.0.0/28")
+	r := newAllocator(t, subnet)
+	max := utilnet.RangeSize(subnet)
+	allocated := sets.NewString()
+	for {
+		ip, err := r.AllocateNext()
+		if errors.Is(err, allocator.ErrFull) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !subnet.Contains(ip) {
+			t.Fatalf("allocated address %s does not belong to %s", ip, subnet)
+		}
+		if allocated.Has(ip.String()) {
+			t.Fatalf("address %s allocated twice", ip)
+		}
+		allocated.Insert(ip.String())
+		if int64(allocated.Len()) > max {
+			t.Fatalf("allocated %d addresses from a range of %d", allocated.Len(), max)
+		}
+	}
+	if allocated.Has(subnet.IP.String()) {
+		t.Fatalf("the network address %s was allocated", subnet.IP)
+	}
+	// only the network and the broadcast addresses may be left out
+	if int64(allocated.Len()) < max-2 {
+		t.Fatalf("expected at least %d addresses allocated, got %d", max-2, allocated.Len())
+	}
+	// a released address can be allocated again
+	released := net.ParseIP(allocated.List()[0])
+	if err := r.Release(released); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ip, err := r.AllocateNext()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(released) {
+		t.Fatalf("expected %s to be allocated, got %s", released, ip)
+	}
+	if _, err := r.AllocateNext(); !errors.Is(err, allocator.ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+}
+
+func testForEach(t *testing.T, newAllocator NewAllocatorFunc) {
+	r := newAllocator(t, mustParseCIDR(t, "10.96.0.0/24"))
+	expected := sets.NewString("10.96.0.1", "10.96.0.2", "10.96.0.200")
+	for _, address := range expected.List() {
+		if err := r.Allocate(net.ParseIP(address)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := r.Release(net.ParseIP("10.96.0.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected.Delete("10.96.0.2")
+	got := sets.NewString()
+	r.ForEach(func(ip net.IP) {
+		got.Insert(ip.String())
+	})
+	if !got.Equal(expected) {
+		t.Fatalf("expected %v, got %v", expected.List(), got.List())
+	}
+}
+
+func testConcurrency(t *testing.T, newAllocator NewAllocatorFunc) {
+	subnet := mustParseCIDR(t, "10.96.0.0/24")
+	r := newAllocator(t, subnet)
+	const workers = 8
+	const perWorker = 8
+
+	var mu sync.Mutex
+	allocated := map[string]int{}
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers*perWorker)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				ip, err := r.AllocateNext()
+				if err != nil {
+					errCh <- err
+					return
+				}
+				mu.Lock()
+				allocated[ip.String()]++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for address, n := range allocated {
+		if n > 1 {
+			t.Fatalf("address %s allocated %d times", address, n)
+		}
+	}
+	if len(allocated) != workers*perWorker {
+		t.Fatalf("expected %d addresses allocated, got %d", workers*perWorker, len(allocated))
+	}
+
+	// release concurrently half of the addresses
+	addresses := sets.StringKeySet(allocated).List()
+	for i, address := range addresses {
+		if i%2 == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(ip net.IP) {
+			defer wg.Done()
+			if err := r.Release(ip); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(net.ParseIP(address))
+	}
+	wg.Wait()
+	for i, address := range addresses {
+		if r.Has(net.ParseIP(address)) != (i%2 == 0) {
+			t.Fatalf("unexpected state for address %s", address)
+		}
+	}
+}
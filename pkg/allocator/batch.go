@@ -0,0 +1,136 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+)
+
+// BatchInterface manages the allocation of multiple IP addresses at once,
+// each operation succeeds or fails as a unit.
+type BatchInterface interface {
+	Interface
+	// AllocateMany allocates all the given addresses or none of them
+	AllocateMany([]net.IP) error
+	// AllocateN allocates n free addresses or none of them,
+	// it returns ErrInvalidCount if n is negative
+	AllocateN(n int) ([]net.IP, error)
+	// ReleaseMany releases all the given addresses, the ones not allocated are ignored
+	ReleaseMany([]net.IP) error
+}
+
+var _ BatchInterface = &Range{}
+
+// AllocateMany allocates all the addresses in a single write of the object that stores the range
+func (r *Range) AllocateMany(ips []net.IP) error {
+	ctx := context.Background()
+	log := r.Log.WithValues("ips", ips)
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		_, cidr, err := net.ParseCIDR(ipRange.GetRange())
+		if err != nil {
+			return err
+		}
+		addresses := sets.NewString(ipRange.GetAddresses()...)
+		for _, ip := range ips {
+			if err := validateAddress(cidr, ip); err != nil {
+				return err
+			}
+			if addresses.Has(ip.String()) {
+				return ErrAllocated
+			}
+			addresses.Insert(ip.String())
+		}
+		ipRange.SetAddresses(addresses.List())
+		return nil
+	})
+	if err != nil {
+		logAllocationError(log, err, "unable to allocate addresses")
+		return toError(err)
+	}
+	return nil
+}
+
+// AllocateN allocates n free addresses in a single write of the object that stores the range,
+// the range is not read nor written if there is nothing to allocate
+func (r *Range) AllocateN(n int) ([]net.IP, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidCount, n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	var ips []net.IP
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		ips = nil
+		_, cidr, err := net.ParseCIDR(ipRange.GetRange())
+		if err != nil {
+			return err
+		}
+		addresses := sets.NewString(ipRange.GetAddresses()...)
+		skip := unavailable(ipRange, cidr)
+		max := utilnet.RangeSize(cidr)
+		if int64(skip.Len()+n) > max {
+			return ErrFull
+		}
+		offset := rand.Int63n(max)
+		var i int64
+		for i = 0; i < max && len(ips) < n; i++ {
+			ip, err := utilnet.GetIndexedIP(cidr, int((offset+i)%max))
+			if err != nil {
+				return err
+			}
+			if skip.Has(ip.String()) {
+				continue
+			}
+			skip.Insert(ip.String())
+			addresses.Insert(ip.String())
+			ips = append(ips, ip)
+		}
+		if len(ips) < n {
+			return ErrFull
+		}
+		ipRange.SetAddresses(addresses.List())
+		return nil
+	})
+	if err != nil {
+		r.Log.Error(err, "unable to allocate addresses", "count", n)
+		return nil, toError(err)
+	}
+	return ips, nil
+}
+
+// ReleaseMany releases all the addresses in a single write of the object that stores the range
+func (r *Range) ReleaseMany(ips []net.IP) error {
+	ctx := context.Background()
+	log := r.Log.WithValues("ips", ips)
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		addresses := sets.NewString(ipRange.GetAddresses()...)
+		released := []string{}
+		for _, ip := range ips {
+			if addresses.Has(ip.String()) {
+				addresses.Delete(ip.String())
+				released = append(released, ip.String())
+			}
+		}
+		// there is nothing to release
+		if len(released) == 0 {
+			return errNotAllocated
+		}
+		ipRange.SetAddresses(addresses.List())
+		dropReservations(ipRange, released...)
+		return nil
+	})
+	if err == errNotAllocated {
+		return nil
+	}
+	if err != nil {
+		log.Error(err, "unable to release addresses")
+		return toError(err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+func TestRangeBatch(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/28")
+	r, err := NewAllocatorCIDRRange(testKey, subnet, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ips := []net.IP{net.ParseIP("10.96.0.1"), net.ParseIP("10.96.0.2")}
+	if err := r.AllocateMany(ips); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the batch fails as a unit
+	if err := r.AllocateMany([]net.IP{net.ParseIP("10.96.0.3"), net.ParseIP("10.96.0.2")}); !errors.Is(err, ErrAllocated) {
+		t.Fatalf("expected ErrAllocated, got %v", err)
+	}
+	if err := r.AllocateMany([]net.IP{net.ParseIP("10.96.0.4"), net.ParseIP("10.96.1.1")}); !errors.Is(err, ErrNotInRange) {
+		t.Fatalf("expected ErrNotInRange, got %v", err)
+	}
+	if err := r.AllocateMany([]net.IP{net.ParseIP("10.96.0.5"), net.ParseIP("10.96.0.5")}); !errors.Is(err, ErrAllocated) {
+		t.Fatalf("expected ErrAllocated for duplicated addresses, got %v", err)
+	}
+	for _, ip := range []string{"10.96.0.3", "10.96.0.4", "10.96.0.5"} {
+		if r.Has(net.ParseIP(ip)) {
+			t.Fatalf("expected %s not to be allocated after a failed batch", ip)
+		}
+	}
+
+	// 15 addresses minus the network address minus 2 allocated
+	if _, err := r.AllocateN(14); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	next, err := r.AllocateN(13)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(next) != 13 {
+		t.Fatalf("expected 13 addresses, got %v", next)
+	}
+	for _, ip := range next {
+		if ip.Equal(subnet.IP) {
+			t.Fatalf("the network address must not be allocated")
+		}
+		if !r.Has(ip) {
+			t.Fatalf("expected %v to be allocated", ip)
+		}
+	}
+
+	// the addresses not allocated are ignored
+	if err := r.ReleaseMany(append(next, net.ParseIP("10.96.1.1"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, ip := range next {
+		if r.Has(ip) {
+			t.Fatalf("expected %v to be released", ip)
+		}
+	}
+	if err := r.ReleaseMany(next); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.Has(ips[0]) || !r.Has(ips[1]) {
+		t.Fatalf("expected %v to be allocated", ips)
+	}
+}
+
+func TestRangeAllocateNCount(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/28")
+	r, err := NewAllocatorCIDRRange(testKey, subnet, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.AllocateN(-1); !errors.Is(err, ErrInvalidCount) {
+		t.Fatalf("expected ErrInvalidCount, got %v", err)
+	}
+	// nothing to allocate, the range is not read
+	ipRange := &clusteripv1.IPRange{ObjectMeta: metav1.ObjectMeta{Namespace: testKey.Namespace, Name: testKey.Name}}
+	if err := c.Delete(context.Background(), ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ips, err := r.AllocateN(0)
+	if err != nil || len(ips) != 0 {
+		t.Fatalf("expected no addresses and no error, got %v %v", ips, err)
+	}
+}
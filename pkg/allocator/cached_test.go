@@ -0,0 +1,71 @@
+package allocator
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+// staleReader returns always the same copy of the IPRange, as a cache that
+// has not observed the last updates
+type staleReader struct {
+	ipRange *clusteripv1.IPRange
+}
+
+func (s *staleReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	s.ipRange.DeepCopyInto(obj.(*clusteripv1.IPRange))
+	return nil
+}
+
+func (s *staleReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return nil
+}
+
+func TestCachedRangeStaleCache(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/24")
+	live, err := NewAllocatorCIDRRange(testKey, subnet, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stale := &staleReader{ipRange: &clusteripv1.IPRange{}}
+	if err := c.Get(ctx, live.key, stale.ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cached := &Range{
+		client:    c,
+		reader:    stale,
+		Log:       live.Log,
+		key:       live.key,
+		newObject: live.newObject,
+	}
+
+	// the cache does not observe the allocations of other writers
+	if err := live.Allocate(net.ParseIP("10.96.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cached.Has(net.ParseIP("10.96.0.1")) {
+		t.Fatalf("expected the cache to be stale")
+	}
+	// the update conflicts and is retried with the object from the apiserver
+	if err := cached.Allocate(net.ParseIP("10.96.0.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cached.Allocate(net.ParseIP("10.96.0.1")); err == nil {
+		t.Fatalf("expected error allocating an allocated address with a stale cache")
+	}
+	if !live.Has(net.ParseIP("10.96.0.1")) || !live.Has(net.ParseIP("10.96.0.2")) {
+		t.Fatalf("expected both addresses to be allocated")
+	}
+	if err := cached.Release(net.ParseIP("10.96.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if live.Has(net.ParseIP("10.96.0.1")) {
+		t.Fatalf("expected 10.96.0.1 to be released")
+	}
+}
@@ -0,0 +1,53 @@
+package allocator_test
+
+import (
+	"net"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+	"github.com/aojea/clusterip-webhook/pkg/allocator/allocatortest"
+)
+
+func newFakeClient() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta2.AddToScheme(scheme))
+	return fake.NewClientBuilder().WithScheme(scheme).Build()
+}
+
+func TestRangeConformance(t *testing.T) {
+	allocatortest.TestInterface(t, func(t *testing.T, cidr *net.IPNet) allocator.Interface {
+		r, err := allocator.NewAllocatorCIDRRange(client.ObjectKey{Namespace: "default", Name: "test"}, cidr, newFakeClient())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return r
+	})
+}
+
+func TestClusterRangeConformance(t *testing.T) {
+	allocatortest.TestInterface(t, func(t *testing.T, cidr *net.IPNet) allocator.Interface {
+		r, err := allocator.NewClusterAllocatorCIDRRange("test", cidr, newFakeClient())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return r
+	})
+}
+
+func TestServiceIPRangeConformance(t *testing.T) {
+	allocatortest.TestInterface(t, func(t *testing.T, cidr *net.IPNet) allocator.Interface {
+		return allocator.NewServiceIPRange("test", cidr, newFakeClient())
+	})
+}
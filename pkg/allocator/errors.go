@@ -0,0 +1,77 @@
+package allocator
+
+import (
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// The errors returned by the allocators can be matched with errors.Is
+var (
+	ErrFull              = errors.New("range is full")
+	ErrAllocated         = errors.New("provided IP is already allocated")
+	ErrMismatchedNetwork = errors.New("the provided network does not match the current range")
+	// ErrNotInRange is returned when the address does not belong to the range,
+	// it also matches ErrMismatchedNetwork.
+	ErrNotInRange = fmt.Errorf("provided IP is not in the valid range: %w", ErrMismatchedNetwork)
+	// ErrReserved is returned when the address can not be allocated, i.e. the network address
+	ErrReserved = errors.New("provided IP is reserved")
+	// ErrRangeNotFound is returned when the object that stores the range does not exist
+	ErrRangeNotFound = errors.New("range not found")
+	// ErrQuotaExceeded is returned when the Services of the namespace hold all the addresses
+	// of the range that the quota of the namespace allows
+	ErrQuotaExceeded = errors.New("namespace quota of the range exceeded")
+	// ErrInvalidCount is returned when a negative number of addresses is requested
+	ErrInvalidCount = errors.New("the number of addresses can not be negative")
+	// ErrTransient is returned when the operation failed but can be retried,
+	// i.e. the apiserver is not available or the object was modified concurrently
+	ErrTransient = errors.New("transient error, the operation can be retried")
+
+	// errNotAllocated stops the update of the range when the address to release is not allocated
+	errNotAllocated = errors.New("provided IP is not allocated")
+)
+
+// apiError classifies an error returned by the apiserver, it matches its
+// kind with errors.Is and unwraps to the apiserver error.
+type apiError struct {
+	kind error
+	err  error
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+func (e *apiError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// toError classifies the errors returned by the apiserver, the allocator errors
+// and the errors that can not be classified are returned as they are.
+func toError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsNotFound(err):
+		return &apiError{kind: ErrRangeNotFound, err: err}
+	case apierrors.IsConflict(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsTooManyRequests(err),
+		apierrors.IsServiceUnavailable(err),
+		apierrors.IsInternalError(err),
+		apierrors.IsUnexpectedServerError(err):
+		return &apiError{kind: ErrTransient, err: err}
+	}
+	return err
+}
+
+// IsTransient returns true if the operation that returned the error can be retried
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
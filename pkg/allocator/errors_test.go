@@ -0,0 +1,59 @@
+package allocator
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestToError(t *testing.T) {
+	gr := schema.GroupResource{Group: "clusterip.allocator.x-k8s.io", Resource: "ipranges"}
+	testCases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"not found", apierrors.NewNotFound(gr, "allocator"), ErrRangeNotFound},
+		{"conflict", apierrors.NewConflict(gr, "allocator", errors.New("modified")), ErrTransient},
+		{"timeout", apierrors.NewServerTimeout(gr, "update", 1), ErrTransient},
+		{"too many requests", apierrors.NewTooManyRequests("retry", 1), ErrTransient},
+		{"unavailable", apierrors.NewServiceUnavailable("unavailable"), ErrTransient},
+		{"allocated", ErrAllocated, ErrAllocated},
+		{"not in range", ErrNotInRange, ErrMismatchedNetwork},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := toError(tc.err)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, err)
+			}
+			// the apiserver errors are kept
+			if apierrors.ReasonForError(err) != apierrors.ReasonForError(tc.err) {
+				t.Fatalf("expected reason %s, got %s", apierrors.ReasonForError(tc.err), apierrors.ReasonForError(err))
+			}
+		})
+	}
+	if toError(nil) != nil {
+		t.Fatalf("expected nil error")
+	}
+}
+
+func TestRangeNotFound(t *testing.T) {
+	r := NewIPRangeAllocator(client.ObjectKey{Namespace: "kube-system", Name: "allocator"}, newFakeClient(), newFakeClient())
+	if err := r.Allocate(net.ParseIP("10.96.0.1")); !errors.Is(err, ErrRangeNotFound) {
+		t.Fatalf("expected ErrRangeNotFound, got %v", err)
+	}
+	if _, err := r.AllocateNext(); !errors.Is(err, ErrRangeNotFound) {
+		t.Fatalf("expected ErrRangeNotFound, got %v", err)
+	}
+	if err := r.Release(net.ParseIP("10.96.0.1")); !errors.Is(err, ErrRangeNotFound) {
+		t.Fatalf("expected ErrRangeNotFound, got %v", err)
+	}
+	if IsTransient(ErrRangeNotFound) {
+		t.Fatalf("ErrRangeNotFound is not transient")
+	}
+}
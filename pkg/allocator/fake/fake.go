@@ -0,0 +1,91 @@
+// Package fake provides an in-memory allocator.Interface to test the code that
+// allocates addresses without an apiserver.
+package fake
+
+import (
+	"net"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+)
+
+// Allocator is an in-memory allocator.Interface, it is safe for concurrent use.
+type Allocator struct {
+	mu        sync.Mutex
+	cidr      *net.IPNet
+	allocated sets.String
+}
+
+var _ allocator.Interface = &Allocator{}
+
+// NewAllocator returns an in-memory allocator over a net.IPNet
+func NewAllocator(cidr *net.IPNet) *Allocator {
+	return &Allocator{
+		cidr:      cidr,
+		allocated: sets.NewString(),
+	}
+}
+
+func (a *Allocator) Allocate(ip net.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.cidr.Contains(ip) {
+		return allocator.ErrNotInRange
+	}
+	if ip.Equal(a.cidr.IP) {
+		return allocator.ErrReserved
+	}
+	if a.allocated.Has(ip.String()) {
+		return allocator.ErrAllocated
+	}
+	a.allocated.Insert(ip.String())
+	return nil
+}
+
+// AllocateNext allocates the first free address of the range, the network address is never allocated
+func (a *Allocator) AllocateNext() (net.IP, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	max := utilnet.RangeSize(a.cidr)
+	var i int64
+	for i = 1; i < max; i++ {
+		ip, err := utilnet.GetIndexedIP(a.cidr, int(i))
+		if err != nil {
+			return nil, err
+		}
+		if !a.allocated.Has(ip.String()) {
+			a.allocated.Insert(ip.String())
+			return ip, nil
+		}
+	}
+	return nil, allocator.ErrFull
+}
+
+func (a *Allocator) Release(ip net.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allocated.Delete(ip.String())
+	return nil
+}
+
+func (a *Allocator) ForEach(f func(net.IP)) {
+	a.mu.Lock()
+	addresses := a.allocated.List()
+	a.mu.Unlock()
+	for _, address := range addresses {
+		f(net.ParseIP(address))
+	}
+}
+
+func (a *Allocator) CIDR() net.IPNet {
+	return *a.cidr
+}
+
+func (a *Allocator) Has(ip net.IP) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allocated.Has(ip.String())
+}
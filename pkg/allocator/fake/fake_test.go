@@ -0,0 +1,15 @@
+package fake
+
+import (
+	"net"
+	"testing"
+
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+	"github.com/aojea/clusterip-webhook/pkg/allocator/allocatortest"
+)
+
+func TestAllocatorConformance(t *testing.T) {
+	allocatortest.TestInterface(t, func(t *testing.T, cidr *net.IPNet) allocator.Interface {
+		return NewAllocator(cidr)
+	})
+}
@@ -0,0 +1,271 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+)
+
+// ReservationInterface allocates IP addresses in two phases, the addresses are
+// reserved first and they are released if they are not committed before they expire.
+type ReservationInterface interface {
+	Interface
+	// Reserve allocates the address until the reservation expires
+	Reserve(ip net.IP, ttl time.Duration) error
+	// ReserveNext allocates a free address until the reservation expires
+	ReserveNext(ttl time.Duration) (net.IP, error)
+	// Commit confirms the reservation of the address, it is allocated until it is released
+	Commit(ip net.IP) error
+	// Abort cancels the reservation of the address and releases it
+	Abort(ip net.IP) error
+}
+
+// StickyInterface hands back to a recreated Service the address it held before it was deleted
+type StickyInterface interface {
+	// ReserveSticky returns the address bound to the Service namespace/name by a sticky reservation,
+	// the reservation is extended so it does not expire before ttl. The address is nil if the
+	// Service has no sticky reservation.
+	ReserveSticky(namespace, name string, ttl time.Duration) (net.IP, error)
+}
+
+// NamespaceInterface reserves the addresses for the Services of a namespace. The quota of the
+// namespace is checked in the same write that reserves the address, so concurrent reservations
+// can not exceed it.
+type NamespaceInterface interface {
+	// ReserveForNamespace allocates the address for the namespace until the reservation expires
+	ReserveForNamespace(ip net.IP, namespace string, ttl time.Duration) error
+	// ReserveNextForNamespace allocates a free address for the namespace until the reservation expires
+	ReserveNextForNamespace(namespace string, ttl time.Duration) (net.IP, error)
+}
+
+var _ ReservationInterface = &Range{}
+var _ StickyInterface = &Range{}
+var _ NamespaceInterface = &Range{}
+
+// stickyObject is implemented by the objects that bind addresses to the Services
+type stickyObject interface {
+	StickyAddress(namespace, name string) (string, bool)
+	ExtendStickyReservation(address string, expires metav1.Time)
+}
+
+// namespaceObject is implemented by the objects that limit the addresses of the range
+// that the Services of a namespace can hold
+type namespaceObject interface {
+	QuotaFor(namespace string) (int64, bool)
+	NamespaceAddresses(namespace string) int64
+	SetReservationNamespace(address, namespace string)
+}
+
+// errNotReserved stops the update of the range when the address is not reserved
+var errNotReserved = errors.New("provided IP is not reserved")
+
+// dropReservations removes the reservations of the given addresses
+func dropReservations(ipRange rangeObject, ips ...string) {
+	reservations := ipRange.GetReservations()
+	for _, ip := range ips {
+		delete(reservations, ip)
+	}
+	ipRange.SetReservations(reservations)
+}
+
+// reserve adds the address to the allocated and to the reserved addresses of the range,
+// the reservation records the namespace if the object limits the addresses of the namespaces
+func reserve(ipRange rangeObject, ip, namespace string, ttl time.Duration) {
+	addresses := sets.NewString(ipRange.GetAddresses()...)
+	addresses.Insert(ip)
+	ipRange.SetAddresses(addresses.List())
+	reservations := ipRange.GetReservations()
+	reservations[ip] = metav1.NewTime(time.Now().Add(ttl))
+	ipRange.SetReservations(reservations)
+	if quota, ok := ipRange.(namespaceObject); ok && namespace != "" {
+		quota.SetReservationNamespace(ip, namespace)
+	}
+}
+
+// checkQuota returns ErrQuotaExceeded if the Services of the namespace hold all the addresses
+// of the range that the quota of the namespace allows
+func checkQuota(ipRange rangeObject, namespace string) error {
+	quota, ok := ipRange.(namespaceObject)
+	if !ok || namespace == "" {
+		return nil
+	}
+	limit, limited := quota.QuotaFor(namespace)
+	if !limited {
+		return nil
+	}
+	if allocated := quota.NamespaceAddresses(namespace); allocated >= limit {
+		return fmt.Errorf("%w: namespace %s holds %d addresses of %s/%s, the quota is %d",
+			ErrQuotaExceeded, namespace, allocated, ipRange.GetNamespace(), ipRange.GetName(), limit)
+	}
+	return nil
+}
+
+// Reserve allocates the address and records its reservation in a single write
+func (r *Range) Reserve(ip net.IP, ttl time.Duration) error {
+	return r.ReserveForNamespace(ip, "", ttl)
+}
+
+// ReserveForNamespace allocates the address for the namespace and records its reservation
+// in a single write, the namespace is not limited if it is empty
+func (r *Range) ReserveForNamespace(ip net.IP, namespace string, ttl time.Duration) error {
+	ctx := context.Background()
+	log := r.Log.WithValues("iprange", ip)
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		_, cidr, err := net.ParseCIDR(ipRange.GetRange())
+		if err != nil {
+			return err
+		}
+		if err := validateAddress(cidr, ip); err != nil {
+			return err
+		}
+		if sets.NewString(ipRange.GetAddresses()...).Has(ip.String()) {
+			return ErrAllocated
+		}
+		if err := checkQuota(ipRange, namespace); err != nil {
+			return err
+		}
+		reserve(ipRange, ip.String(), namespace, ttl)
+		return nil
+	})
+	if err != nil {
+		logAllocationError(log, err, "unable to reserve address")
+		return toError(err)
+	}
+	return nil
+}
+
+// ReserveNext allocates a free address and records its reservation in a single write
+func (r *Range) ReserveNext(ttl time.Duration) (net.IP, error) {
+	return r.ReserveNextForNamespace("", ttl)
+}
+
+// ReserveNextForNamespace allocates a free address for the namespace and records its reservation
+// in a single write, the namespace is not limited if it is empty
+func (r *Range) ReserveNextForNamespace(namespace string, ttl time.Duration) (net.IP, error) {
+	ctx := context.Background()
+	var ip net.IP
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		ip = nil
+		_, cidr, err := net.ParseCIDR(ipRange.GetRange())
+		if err != nil {
+			return err
+		}
+		if err := checkQuota(ipRange, namespace); err != nil {
+			return err
+		}
+		skip := unavailable(ipRange, cidr)
+		max := utilnet.RangeSize(cidr)
+		if int64(skip.Len()) >= max {
+			return ErrFull
+		}
+		offset := rand.Int63n(max)
+		var i int64
+		for i = 0; i < max; i++ {
+			candidate, err := utilnet.GetIndexedIP(cidr, int((offset+i)%max))
+			if err != nil {
+				return err
+			}
+			if skip.Has(candidate.String()) {
+				continue
+			}
+			ip = candidate
+			reserve(ipRange, ip.String(), namespace, ttl)
+			return nil
+		}
+		return ErrFull
+	})
+	if err != nil {
+		r.Log.Error(err, "unable to reserve next address")
+		return nil, toError(err)
+	}
+	return ip, nil
+}
+
+// Commit removes the reservation of the address, the address remains allocated.
+// Committing an address that is not reserved is a no-op.
+func (r *Range) Commit(ip net.IP) error {
+	ctx := context.Background()
+	log := r.Log.WithValues("iprange", ip)
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		if _, ok := ipRange.GetReservations()[ip.String()]; !ok {
+			return errNotReserved
+		}
+		dropReservations(ipRange, ip.String())
+		return nil
+	})
+	if err == errNotReserved {
+		return nil
+	}
+	if err != nil {
+		log.Error(err, "unable to commit address")
+		return toError(err)
+	}
+	return nil
+}
+
+// Abort removes the reservation of the address and releases it.
+// Aborting an address that is not reserved is a no-op, so committed addresses are not released.
+func (r *Range) Abort(ip net.IP) error {
+	ctx := context.Background()
+	log := r.Log.WithValues("iprange", ip)
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		if _, ok := ipRange.GetReservations()[ip.String()]; !ok {
+			return errNotReserved
+		}
+		addresses := sets.NewString(ipRange.GetAddresses()...)
+		addresses.Delete(ip.String())
+		ipRange.SetAddresses(addresses.List())
+		dropReservations(ipRange, ip.String())
+		return nil
+	})
+	if err == errNotReserved {
+		return nil
+	}
+	if err != nil {
+		log.Error(err, "unable to abort address")
+		return toError(err)
+	}
+	return nil
+}
+
+// ReserveSticky returns the address held for the Service and extends its sticky reservation,
+// so it is not released before the Service is created.
+func (r *Range) ReserveSticky(namespace, name string, ttl time.Duration) (net.IP, error) {
+	ctx := context.Background()
+	var ip net.IP
+	err := r.update(ctx, func(ipRange rangeObject) error {
+		ip = nil
+		sticky, ok := ipRange.(stickyObject)
+		if !ok {
+			return errNotReserved
+		}
+		address, ok := sticky.StickyAddress(namespace, name)
+		if !ok {
+			return errNotReserved
+		}
+		ip = net.ParseIP(address)
+		if ip == nil {
+			return errNotReserved
+		}
+		addresses := sets.NewString(ipRange.GetAddresses()...)
+		addresses.Insert(ip.String())
+		ipRange.SetAddresses(addresses.List())
+		sticky.ExtendStickyReservation(ip.String(), metav1.NewTime(time.Now().Add(ttl)))
+		return nil
+	})
+	if err == errNotReserved {
+		return nil, nil
+	}
+	if err != nil {
+		r.Log.Error(err, "unable to reserve sticky address", "service", namespace+"/"+name)
+		return nil, toError(err)
+	}
+	return ip, nil
+}
@@ -0,0 +1,204 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+func TestRangeReservation(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/29")
+	r, err := NewAllocatorCIDRRange(testKey, subnet, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reservations := func() map[string]bool {
+		ipRange := &clusteripv1.IPRange{}
+		if err := c.Get(context.Background(), r.key, ipRange); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		result := map[string]bool{}
+		for address, expires := range ipRange.GetReservations() {
+			if expires.Time.Before(time.Now()) {
+				t.Fatalf("reservation of %s already expired: %v", address, expires)
+			}
+			result[address] = true
+		}
+		return result
+	}
+
+	ip := net.ParseIP("10.96.0.1")
+	if err := r.Reserve(ip, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Reserve(ip, time.Minute); !errors.Is(err, ErrAllocated) {
+		t.Fatalf("expected ErrAllocated, got %v", err)
+	}
+	if err := r.Reserve(net.ParseIP("10.96.1.1"), time.Minute); !errors.Is(err, ErrNotInRange) {
+		t.Fatalf("expected ErrNotInRange, got %v", err)
+	}
+	if !r.Has(ip) || !reservations()[ip.String()] {
+		t.Fatalf("expected %s to be allocated and reserved", ip)
+	}
+	// committed addresses remain allocated
+	if err := r.Commit(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.Has(ip) || reservations()[ip.String()] {
+		t.Fatalf("expected %s to be allocated and not reserved", ip)
+	}
+	// aborting a committed address does not release it
+	if err := r.Abort(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.Has(ip) {
+		t.Fatalf("expected %s to be allocated", ip)
+	}
+
+	next, err := r.ReserveNext(time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next.Equal(subnet.IP) || next.Equal(ip) || !subnet.Contains(next) {
+		t.Fatalf("unexpected reserved address %s", next)
+	}
+	if !r.Has(next) || !reservations()[next.String()] {
+		t.Fatalf("expected %s to be allocated and reserved", next)
+	}
+	if err := r.Abort(next); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Has(next) || reservations()[next.String()] {
+		t.Fatalf("expected %s to be released", next)
+	}
+
+	// releasing a reserved address removes its reservation
+	if err := r.Reserve(next, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Release(next); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Has(next) || reservations()[next.String()] {
+		t.Fatalf("expected %s to be released", next)
+	}
+
+	// the range has 7 usable addresses and one is allocated
+	for i := 0; i < 6; i++ {
+		if _, err := r.ReserveNext(time.Minute); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := r.ReserveNext(time.Minute); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	if len(reservations()) != 6 {
+		t.Fatalf("expected 6 reservations, got %v", reservations())
+	}
+}
+
+func TestRangeReserveSticky(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/29")
+	r, err := NewAllocatorCIDRRange(testKey, subnet, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	ipRange := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, r.key, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expires := metav1.NewTime(time.Now().Add(time.Second))
+	ipRange.Spec.StickyReservations = []clusteripv1.StickyReservation{
+		{Address: "10.96.0.3", Namespace: "default", Name: "web", Expires: &expires},
+	}
+	if err := c.Update(ctx, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ip, err := r.ReserveSticky("default", "db", time.Minute)
+	if err != nil || ip != nil {
+		t.Fatalf("expected no sticky address, got %v %v", ip, err)
+	}
+	ip, err = r.ReserveSticky("default", "web", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.96.0.3")) || !r.Has(ip) {
+		t.Fatalf("expected 10.96.0.3 to be allocated, got %v", ip)
+	}
+	if err := c.Get(ctx, r.key, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ipRange.Spec.StickyReservations[0].Expires; !got.After(time.Now().Add(time.Minute / 2)) {
+		t.Fatalf("expected the sticky reservation to be extended, expires %v", got)
+	}
+}
+
+func TestRangeReserveForNamespace(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/29")
+	r, err := NewAllocatorCIDRRange(testKey, subnet, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	ipRange := &clusteripv1.IPRange{}
+	if err := c.Get(ctx, r.key, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ipRange.Spec.NamespaceQuotas = []clusteripv1.NamespaceQuota{{Namespace: "tenant-a", Limit: 2}}
+	// the address of a Service of the namespace
+	ipRange.Spec.Addresses = []string{"10.96.0.1"}
+	ipRange.Spec.Owners = []clusteripv1.AddressOwner{{Address: "10.96.0.1", Namespace: "tenant-a", Name: "web"}}
+	if err := c.Update(ctx, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ip, err := r.ReserveNextForNamespace("tenant-a", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// an address not allocated yet, the quota is checked after the allocated addresses
+	free := "10.96.0.5"
+	if ip.String() == free {
+		free = "10.96.0.6"
+	}
+	if err := r.ReserveForNamespace(net.ParseIP(free), "tenant-a", time.Minute); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := r.ReserveNextForNamespace("tenant-a", time.Minute); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	// the namespaces without quota are not limited
+	if err := r.ReserveForNamespace(net.ParseIP(free), "default", time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ipRange = &clusteripv1.IPRange{}
+	if err := c.Get(ctx, r.key, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	namespaces := map[string]string{}
+	for _, reservation := range ipRange.Spec.Reservations {
+		namespaces[reservation.Address] = reservation.Namespace
+	}
+	if namespaces[ip.String()] != "tenant-a" || namespaces[free] != "default" {
+		t.Fatalf("expected the reservations to record the namespace, got %v", ipRange.Spec.Reservations)
+	}
+	// the aborted reservation does not count against the quota anymore
+	if err := r.Abort(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.ReserveNextForNamespace("tenant-a", time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
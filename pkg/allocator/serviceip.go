@@ -0,0 +1,255 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+// ServiceIPRange is an allocator that stores each allocated address in its own ServiceIP object,
+// named after the address. The apiserver guarantees the names are unique, so there is no need
+// to serialize all the allocations on the resourceVersion of a single IPRange object.
+//
+// The ServiceIPs are released by the controller if no Service uses their address: the reserved
+// ServiceIPs once their reservation expires, and the ServiceIPs without owner after a grace period.
+type ServiceIPRange struct {
+	client client.Client
+	Log    logr.Logger
+	// name of the range, used to label the ServiceIPs allocated from it
+	name string
+	cidr *net.IPNet
+}
+
+var _ ReservationInterface = &ServiceIPRange{}
+
+// NewServiceIPRange creates an allocator over a net.IPNet that stores the
+// allocated addresses as ServiceIP objects
+func NewServiceIPRange(name string, cidr *net.IPNet, client client.Client) *ServiceIPRange {
+	return &ServiceIPRange{
+		client: client,
+		Log:    ctrl.Log.WithName("serviceiprange").WithValues("range", name),
+		name:   name,
+		cidr:   cidr,
+	}
+}
+
+func (r *ServiceIPRange) Allocate(ip net.IP) error {
+	return r.allocate(ip, nil, nil)
+}
+
+// AllocateService allocates the address to the Service, the ServiceIP is released
+// by the controller once the Service is deleted.
+func (r *ServiceIPRange) AllocateService(ip net.IP, svc *v1.Service) error {
+	return r.allocate(ip, &clusteripv1beta2.OwnerReference{
+		Kind:      "Service",
+		Namespace: svc.Namespace,
+		Name:      svc.Name,
+		UID:       svc.UID,
+	}, nil)
+}
+
+// Reserve allocates the address until the reservation expires, the controller commits
+// the reservation once a Service uses the address
+func (r *ServiceIPRange) Reserve(ip net.IP, ttl time.Duration) error {
+	expires := metav1.NewTime(time.Now().Add(ttl))
+	return r.allocate(ip, nil, &expires)
+}
+
+func (r *ServiceIPRange) allocate(ip net.IP, owner *clusteripv1beta2.OwnerReference, expires *metav1.Time) error {
+	ctx := context.Background()
+	log := r.Log.WithValues("ip", ip)
+	if err := validateAddress(r.cidr, ip); err != nil {
+		return err
+	}
+	serviceIP := &clusteripv1beta2.ServiceIP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   clusteripv1beta2.ServiceIPName(ip),
+			Labels: map[string]string{clusteripv1beta2.ServiceIPRangeLabel: r.name},
+		},
+		Spec: clusteripv1beta2.ServiceIPSpec{
+			Range: r.cidr.String(),
+			Owner: owner,
+		},
+	}
+	if expires != nil {
+		serviceIP.Annotations = map[string]string{
+			clusteripv1beta2.ServiceIPExpiresAnnotation: expires.UTC().Format(time.RFC3339),
+		}
+	}
+	if err := r.client.Create(ctx, serviceIP); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return ErrAllocated
+		}
+		log.Error(err, "unable to create ServiceIP")
+		return toError(err)
+	}
+	return nil
+}
+
+func (r *ServiceIPRange) AllocateNext() (net.IP, error) {
+	return r.allocateNext(r.Allocate)
+}
+
+// ReserveNext allocates a free address until the reservation expires
+func (r *ServiceIPRange) ReserveNext(ttl time.Duration) (net.IP, error) {
+	return r.allocateNext(func(ip net.IP) error {
+		return r.Reserve(ip, ttl)
+	})
+}
+
+// allocateNext allocates a free address with the allocate function,
+// the addresses allocated concurrently by other apiservers are skipped
+func (r *ServiceIPRange) allocateNext(allocate func(net.IP) error) (net.IP, error) {
+	ctx := context.Background()
+	allocated, err := r.list(ctx)
+	if err != nil {
+		r.Log.Error(err, "unable to list ServiceIPs")
+		return nil, toError(err)
+	}
+	max := utilnet.RangeSize(r.cidr)
+	if int64(allocated.Len()) >= max {
+		return net.IP{}, ErrFull
+	}
+
+	offset := rand.Int63n(max)
+	var i int64
+	for i = 0; i < max; i++ {
+		at := (offset + i) % max
+		ip, err := utilnet.GetIndexedIP(r.cidr, int(at))
+		if err != nil {
+			return net.IP{}, err
+		}
+		// the network address is reserved
+		if ip.Equal(r.cidr.IP) || allocated.Has(ip.String()) {
+			continue
+		}
+		err = allocate(ip)
+		// other apiserver may have allocated the address
+		if errors.Is(err, ErrAllocated) {
+			continue
+		}
+		if err != nil {
+			return net.IP{}, err
+		}
+		return ip, nil
+	}
+	return net.IP{}, ErrFull
+}
+
+// Commit removes the expiration of the reservation of the address, the ServiceIP is released
+// by the controller after the grace period if no Service uses it.
+// Committing an address that is not reserved is a no-op.
+func (r *ServiceIPRange) Commit(ip net.IP) error {
+	ctx := context.Background()
+	serviceIP, err := r.reserved(ctx, ip)
+	if err != nil || serviceIP == nil {
+		return err
+	}
+	delete(serviceIP.Annotations, clusteripv1beta2.ServiceIPExpiresAnnotation)
+	if err := r.client.Update(ctx, serviceIP); err != nil {
+		r.Log.Error(err, "unable to commit ServiceIP", "ip", ip)
+		return toError(err)
+	}
+	return nil
+}
+
+// Abort deletes the ServiceIP of the reserved address.
+// Aborting an address that is not reserved is a no-op, so committed addresses are not released.
+func (r *ServiceIPRange) Abort(ip net.IP) error {
+	ctx := context.Background()
+	serviceIP, err := r.reserved(ctx, ip)
+	if err != nil || serviceIP == nil {
+		return err
+	}
+	// the reservation may be committed meanwhile
+	precondition := client.Preconditions{UID: &serviceIP.UID, ResourceVersion: &serviceIP.ResourceVersion}
+	if err := r.client.Delete(ctx, serviceIP, precondition); err != nil && !apierrors.IsNotFound(err) {
+		r.Log.Error(err, "unable to abort ServiceIP", "ip", ip)
+		return toError(err)
+	}
+	return nil
+}
+
+// reserved returns the ServiceIP of the address if it is reserved, or nil otherwise
+func (r *ServiceIPRange) reserved(ctx context.Context, ip net.IP) (*clusteripv1beta2.ServiceIP, error) {
+	serviceIP := &clusteripv1beta2.ServiceIP{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: clusteripv1beta2.ServiceIPName(ip)}, serviceIP); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		r.Log.Error(err, "unable to get ServiceIP", "ip", ip)
+		return nil, toError(err)
+	}
+	if _, ok := serviceIP.Annotations[clusteripv1beta2.ServiceIPExpiresAnnotation]; !ok {
+		return nil, nil
+	}
+	return serviceIP, nil
+}
+
+func (r *ServiceIPRange) Release(ip net.IP) error {
+	ctx := context.Background()
+	serviceIP := &clusteripv1beta2.ServiceIP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: clusteripv1beta2.ServiceIPName(ip),
+		},
+	}
+	if err := r.client.Delete(ctx, serviceIP); err != nil && !apierrors.IsNotFound(err) {
+		r.Log.Error(err, "unable to delete ServiceIP", "ip", ip)
+		return toError(err)
+	}
+	return nil
+}
+
+func (r *ServiceIPRange) ForEach(f func(net.IP)) {
+	ctx := context.Background()
+	allocated, err := r.list(ctx)
+	if err != nil {
+		r.Log.Error(err, "unable to list ServiceIPs")
+		return
+	}
+	for _, address := range allocated.List() {
+		f(net.ParseIP(address))
+	}
+}
+
+func (r *ServiceIPRange) CIDR() net.IPNet {
+	return *r.cidr
+}
+
+// For testing
+func (r *ServiceIPRange) Has(ip net.IP) bool {
+	ctx := context.Background()
+	serviceIP := &clusteripv1beta2.ServiceIP{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: clusteripv1beta2.ServiceIPName(ip)}, serviceIP); err != nil {
+		return false
+	}
+	return true
+}
+
+// list returns the addresses allocated from the range
+func (r *ServiceIPRange) list(ctx context.Context) (sets.String, error) {
+	var serviceIPList clusteripv1beta2.ServiceIPList
+	if err := r.client.List(ctx, &serviceIPList, client.MatchingLabels{clusteripv1beta2.ServiceIPRangeLabel: r.name}); err != nil {
+		return nil, err
+	}
+	allocated := sets.NewString()
+	for _, serviceIP := range serviceIPList.Items {
+		if ip := clusteripv1beta2.ParseServiceIPName(serviceIP.Name); ip != nil {
+			allocated.Insert(ip.String())
+		}
+	}
+	return allocated, nil
+}
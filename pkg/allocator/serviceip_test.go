@@ -0,0 +1,153 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+// testKey is the IPRange the tests store the range in
+var testKey = client.ObjectKey{Namespace: "default", Name: "test"}
+
+func newFakeClient() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta1.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1beta2.AddToScheme(scheme))
+	return fake.NewClientBuilder().WithScheme(scheme).Build()
+}
+
+func TestServiceIPRange(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/28")
+	r := NewServiceIPRange("ipv4", subnet, c)
+
+	ip := net.ParseIP("10.96.0.1")
+	if err := r.Allocate(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Allocate(ip); !errors.Is(err, ErrAllocated) {
+		t.Fatalf("expected ErrAllocated, got %v", err)
+	}
+	if err := r.Allocate(net.ParseIP("10.96.1.1")); !errors.Is(err, ErrNotInRange) {
+		t.Fatalf("expected ErrNotInRange, got %v", err)
+	}
+	// other range can not allocate the same address
+	other := NewServiceIPRange("other", subnet, c)
+	if err := other.Allocate(ip); !errors.Is(err, ErrAllocated) {
+		t.Fatalf("expected ErrAllocated, got %v", err)
+	}
+
+	// the network address is reserved, 14 addresses left
+	for i := 0; i < 14; i++ {
+		if _, err := r.AllocateNext(); err != nil {
+			t.Fatalf("unexpected error allocating address %d: %v", i, err)
+		}
+	}
+	if _, err := r.AllocateNext(); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	count := 0
+	r.ForEach(func(net.IP) { count++ })
+	if count != 15 {
+		t.Fatalf("expected 15 addresses allocated, got %d", count)
+	}
+
+	if err := r.Release(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Has(ip) {
+		t.Fatalf("expected %v to be released", ip)
+	}
+	// releasing an address not allocated is not an error
+	if err := r.Release(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kubernetes", UID: "123"}}
+	if err := r.AllocateService(ip, svc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.Has(ip) {
+		t.Fatalf("expected %v to be allocated", ip)
+	}
+}
+
+func TestServiceIPRangeReservation(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/28")
+	r := NewServiceIPRange("ipv4", subnet, c)
+
+	expires := func(ip net.IP) (string, bool) {
+		serviceIP := &clusteripv1beta2.ServiceIP{}
+		if err := c.Get(context.Background(), client.ObjectKey{Name: clusteripv1beta2.ServiceIPName(ip)}, serviceIP); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		value, ok := serviceIP.Annotations[clusteripv1beta2.ServiceIPExpiresAnnotation]
+		return value, ok
+	}
+
+	ip := net.ParseIP("10.96.0.1")
+	if err := r.Reserve(ip, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Reserve(ip, time.Minute); !errors.Is(err, ErrAllocated) {
+		t.Fatalf("expected ErrAllocated, got %v", err)
+	}
+	value, ok := expires(ip)
+	if !ok {
+		t.Fatalf("expected %s to be reserved", ip)
+	}
+	if at, err := time.Parse(time.RFC3339, value); err != nil || !at.After(time.Now()) {
+		t.Fatalf("expected the reservation to expire in the future, got %q", value)
+	}
+	// committed addresses remain allocated
+	if err := r.Commit(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := expires(ip); ok || !r.Has(ip) {
+		t.Fatalf("expected %s to be allocated and not reserved", ip)
+	}
+	// aborting a committed address does not release it
+	if err := r.Abort(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.Has(ip) {
+		t.Fatalf("expected %s to be allocated", ip)
+	}
+
+	next, err := r.ReserveNext(time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := expires(next); !ok {
+		t.Fatalf("expected %s to be reserved", next)
+	}
+	if err := r.Abort(next); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Has(next) {
+		t.Fatalf("expected %s to be released", next)
+	}
+	// committing and aborting an address not allocated is a no-op
+	if err := r.Commit(next); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Abort(next); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package allocator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// SnapshotVersion is the version of the format of the snapshots
+const SnapshotVersion = "v1"
+
+// Snapshot is the portable representation of the addresses allocated from a range
+type Snapshot struct {
+	// Version of the snapshot format
+	Version string `json:"version"`
+	// Range in CIDR format
+	Range string `json:"range"`
+	// Addresses allocated from the range
+	Addresses []string `json:"addresses"`
+	// Timestamp is the time the snapshot was taken
+	Timestamp metav1.Time `json:"timestamp"`
+}
+
+// SnapshotInterface exports and restores the addresses allocated from a range
+type SnapshotInterface interface {
+	Interface
+	// Snapshot returns the addresses allocated from the range
+	Snapshot() (*Snapshot, error)
+	// Restore replaces the addresses allocated from the range with the ones in the snapshot
+	Restore(*Snapshot) error
+}
+
+var _ SnapshotInterface = &Range{}
+
+// Snapshot returns the addresses allocated from the range, the reserved addresses
+// pending to be committed are included.
+func (r *Range) Snapshot() (*Snapshot, error) {
+	ctx := context.Background()
+	ipRange, err := r.getLive(ctx)
+	if err != nil {
+		r.Log.Error(err, "unable to fetch IPRange")
+		return nil, toError(err)
+	}
+	return &Snapshot{
+		Version:   SnapshotVersion,
+		Range:     ipRange.GetRange(),
+		Addresses: sets.NewString(ipRange.GetAddresses()...).List(),
+		Timestamp: metav1.Now(),
+	}, nil
+}
+
+// Restore replaces the addresses allocated from the range with the ones in the snapshot
+// in a single write, the snapshot must have been taken from the same network.
+func (r *Range) Restore(snapshot *Snapshot) error {
+	ctx := context.Background()
+	ips, err := snapshot.ips()
+	if err != nil {
+		return err
+	}
+	err = r.update(ctx, func(ipRange rangeObject) error {
+		_, cidr, err := net.ParseCIDR(ipRange.GetRange())
+		if err != nil {
+			return err
+		}
+		if cidr.String() != snapshot.Range {
+			return ErrMismatchedNetwork
+		}
+		addresses := sets.NewString()
+		for _, ip := range ips {
+			if err := validateAddress(cidr, ip); err != nil {
+				return fmt.Errorf("%w: %s", err, ip)
+			}
+			addresses.Insert(ip.String())
+		}
+		ipRange.SetAddresses(addresses.List())
+		ipRange.SetReservations(nil)
+		return nil
+	})
+	if err != nil {
+		r.Log.Error(err, "unable to restore IPRange")
+		return toError(err)
+	}
+	return nil
+}
+
+// ips returns the addresses of the snapshot
+func (s *Snapshot) ips() ([]net.IP, error) {
+	if s.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %q", s.Version)
+	}
+	if _, _, err := net.ParseCIDR(s.Range); err != nil {
+		return nil, fmt.Errorf("invalid snapshot range: %v", err)
+	}
+	ips := make([]net.IP, 0, len(s.Addresses))
+	for _, address := range s.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid snapshot address %q", address)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// CompareServices compares the addresses of the snapshot with the ClusterIPs of the Services
+// that belong to the range, it returns the ClusterIPs missing in the snapshot mapped to the
+// Service namespace/name, and the addresses of the snapshot without Service.
+func (s *Snapshot) CompareServices(services []v1.Service) (missing map[string]string, orphan []string, err error) {
+	_, cidr, err := net.ParseCIDR(s.Range)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot range: %v", err)
+	}
+	addresses := sets.NewString(s.Addresses...)
+	svcIPs := sets.NewString()
+	missing = map[string]string{}
+	for _, svc := range services {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil || !cidr.Contains(ip) {
+			continue
+		}
+		svcIPs.Insert(ip.String())
+		if !addresses.Has(ip.String()) {
+			missing[ip.String()] = svc.Namespace + "/" + svc.Name
+		}
+	}
+	return missing, addresses.Difference(svcIPs).List(), nil
+}
+
+// WriteSnapshot writes the snapshot in JSON format
+func WriteSnapshot(w io.Writer, snapshot *Snapshot) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+// ReadSnapshot reads a snapshot in JSON format
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	if _, err := snapshot.ips(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
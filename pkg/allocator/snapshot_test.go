@@ -0,0 +1,112 @@
+package allocator
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRangeSnapshotRestore(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/24")
+	r, err := NewAllocatorCIDRRange(testKey, subnet, newFakeClient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.AllocateMany([]net.IP{net.ParseIP("10.96.0.1"), net.ParseIP("10.96.0.20")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	snapshot, err := r.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, snapshot); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	restored, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// restore into a new range
+	fresh, err := NewAllocatorCIDRRange(testKey, subnet, newFakeClient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fresh.Allocate(net.ParseIP("10.96.0.30")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fresh.Restore(restored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for address, allocated := range map[string]bool{"10.96.0.1": true, "10.96.0.20": true, "10.96.0.30": false} {
+		if fresh.Has(net.ParseIP(address)) != allocated {
+			t.Fatalf("expected %s allocated %v", address, allocated)
+		}
+	}
+
+	// the snapshot must be taken from the same network
+	_, other, _ := net.ParseCIDR("10.97.0.0/24")
+	mismatched, err := NewAllocatorCIDRRange(testKey, other, newFakeClient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mismatched.Restore(restored); !errors.Is(err, ErrMismatchedNetwork) {
+		t.Fatalf("expected ErrMismatchedNetwork, got %v", err)
+	}
+	restored.Addresses = append(restored.Addresses, "10.96.0.0")
+	if err := fresh.Restore(restored); !errors.Is(err, ErrReserved) {
+		t.Fatalf("expected ErrReserved, got %v", err)
+	}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"invalid json", `{`},
+		{"unsupported version", `{"version":"v2","range":"10.96.0.0/24"}`},
+		{"invalid range", `{"version":"v1","range":"10.96.0.0"}`},
+		{"invalid address", `{"version":"v1","range":"10.96.0.0/24","addresses":["10.96.0"]}`},
+	}
+	for _, tc := range testCases {
+		if _, err := ReadSnapshot(strings.NewReader(tc.data)); err == nil {
+			t.Fatalf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestSnapshotCompareServices(t *testing.T) {
+	snapshot := &Snapshot{
+		Version:   SnapshotVersion,
+		Range:     "10.96.0.0/24",
+		Addresses: []string{"10.96.0.1", "10.96.0.2"},
+	}
+	newService := func(name, clusterIP string) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       v1.ServiceSpec{ClusterIP: clusterIP},
+		}
+	}
+	missing, orphan, err := snapshot.CompareServices([]v1.Service{
+		newService("restored", "10.96.0.1"),
+		newService("missing", "10.96.0.3"),
+		newService("other-range", "10.97.0.1"),
+		newService("headless", v1.ClusterIPNone),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(missing) != 1 || missing["10.96.0.3"] != "default/missing" {
+		t.Fatalf("unexpected missing addresses %v", missing)
+	}
+	if len(orphan) != 1 || orphan[0] != "10.96.0.2" {
+		t.Fatalf("unexpected orphan addresses %v", orphan)
+	}
+}
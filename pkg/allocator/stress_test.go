@@ -0,0 +1,179 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/deprecated/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+// TestRangeStress allocates and releases addresses from several goroutines and several
+// Range instances, each one with its own client as if they were different apiservers,
+// and checks that no address is allocated twice and that every release is stored.
+func TestRangeStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping stress test in short mode")
+	}
+	const (
+		instances  = 4
+		workers    = 8
+		iterations = 6
+	)
+	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	testEnv := &envtest.Environment{
+		CRDDirectoryPaths: []string{filepath.Join("../..", "config", "crd", "bases")},
+	}
+	cfg, err := testEnv.Start()
+	if err != nil {
+		t.Fatalf("Unable to start test environment: (%v)", err)
+	}
+	defer testEnv.Stop()
+	if err := clusteripv1.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("Unable to add iprange scheme: (%v)", err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/24")
+	ranges := make([]*Range, instances)
+	for i := range ranges {
+		cs, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if i == 0 {
+			if ranges[i], err = NewAllocatorCIDRRange(key, subnet, cs); err != nil {
+				t.Fatalf(err.Error())
+			}
+			continue
+		}
+		// the last instance reads from an informer cache that may be stale
+		reader := client.Reader(cs)
+		if i == instances-1 {
+			informerCache, err := cache.New(cfg, cache.Options{Scheme: scheme.Scheme})
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			go informerCache.Start(ctx)
+			if !informerCache.WaitForCacheSync(ctx) {
+				t.Fatalf("unable to sync the cache")
+			}
+			reader = informerCache
+		}
+		ranges[i] = NewIPRangeAllocator(key, cs, reader)
+		ranges[i].Log = ranges[i].Log.WithValues("instance", i)
+	}
+
+	// allocate addresses from all the instances in parallel,
+	// recording the worker and the instance that allocated each address
+	var mu sync.Mutex
+	allocated := map[string]string{}
+	allocatedBy := map[string]int{}
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(instance int, r *Range, worker string) {
+				defer wg.Done()
+				for j := 0; j < iterations; j++ {
+					ip, err := r.AllocateNext()
+					if err != nil {
+						t.Errorf("worker %s unexpected error: %v", worker, err)
+						return
+					}
+					mu.Lock()
+					if other, ok := allocated[ip.String()]; ok {
+						t.Errorf("address %s allocated by worker %s and worker %s", ip, other, worker)
+					}
+					allocated[ip.String()] = worker
+					allocatedBy[ip.String()] = instance
+					mu.Unlock()
+				}
+			}(i, r, fmt.Sprintf("%d/%d", i, w))
+		}
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	if len(allocated) != instances*workers*iterations {
+		t.Fatalf("expected %d addresses allocated, got %d", instances*workers*iterations, len(allocated))
+	}
+	checkStored := func(expected sets.String) {
+		ipRange := &clusteripv1.IPRange{}
+		if err := ranges[0].client.Get(ctx, key, ipRange); err != nil {
+			t.Fatalf(err.Error())
+		}
+		stored := sets.NewString(ipRange.Spec.Addresses...)
+		if !stored.Equal(expected) {
+			t.Fatalf("stored addresses differ, missing %v unexpected %v",
+				expected.Difference(stored).List(), stored.Difference(expected).List())
+		}
+	}
+	expected := sets.StringKeySet(allocated)
+	checkStored(expected)
+
+	// release half of the addresses in parallel, each one from a different instance than the one that allocated it
+	addresses := expected.List()
+	for i, address := range addresses {
+		if i%2 == 0 {
+			continue
+		}
+		expected.Delete(address)
+		wg.Add(1)
+		go func(r *Range, ip net.IP) {
+			defer wg.Done()
+			if err := r.Release(ip); err != nil {
+				t.Errorf("unexpected error releasing %s: %v", ip, err)
+			}
+		}(ranges[(allocatedBy[address]+1)%instances], net.ParseIP(address))
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	checkStored(expected)
+
+	// allocate and release concurrently
+	releases := expected.List()[:instances*workers]
+	expected.Delete(releases...)
+	for i, r := range ranges {
+		for w := 0; w < workers; w++ {
+			release := releases[i*workers+w]
+			wg.Add(1)
+			go func(r *Range, release net.IP) {
+				defer wg.Done()
+				ip, err := r.AllocateNext()
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				mu.Lock()
+				if expected.Has(ip.String()) {
+					t.Errorf("address %s allocated twice", ip)
+				}
+				expected.Insert(ip.String())
+				mu.Unlock()
+				if err := r.Release(release); err != nil {
+					t.Errorf("unexpected error releasing %s: %v", release, err)
+				}
+			}(r, net.ParseIP(release))
+		}
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	checkStored(expected)
+}
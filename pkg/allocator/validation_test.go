@@ -0,0 +1,81 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+func TestRangeValidation(t *testing.T) {
+	c := newFakeClient()
+	_, subnet, _ := net.ParseCIDR("10.96.0.0/29")
+	r, err := NewAllocatorCIDRRange(testKey, subnet, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// reserve an address in v1beta2, it is kept in the conversion annotation of v1
+	ipRange := &clusteripv1.IPRange{}
+	if err := c.Get(context.Background(), r.key, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hub := &clusteripv1beta2.IPRange{}
+	if err := ipRange.ConvertTo(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hub.Spec.Reserved = []string{"10.96.0.3"}
+	if err := ipRange.ConvertFrom(hub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Update(context.Background(), ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := r.Allocate(net.ParseIP("10.96.1.1")); !errors.Is(err, ErrNotInRange) {
+		t.Fatalf("expected ErrNotInRange, got %v", err)
+	}
+	if err := r.Allocate(net.ParseIP("10.96.0.0")); !errors.Is(err, ErrReserved) {
+		t.Fatalf("expected ErrReserved, got %v", err)
+	}
+	if err := r.AllocateMany([]net.IP{net.ParseIP("10.96.0.1"), net.ParseIP("10.96.0.0")}); !errors.Is(err, ErrReserved) {
+		t.Fatalf("expected ErrReserved, got %v", err)
+	}
+	// the rejected addresses are not stored
+	if err := c.Get(context.Background(), r.key, ipRange); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ipRange.Spec.Addresses) != 0 {
+		t.Fatalf("expected no addresses allocated, got %v", ipRange.Spec.Addresses)
+	}
+
+	// the reserved addresses are never allocated dynamically
+	ips, err := r.AllocateN(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		ip, err := r.AllocateNext()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ips = append(ips, ip)
+	}
+	for _, ip := range ips {
+		if ip.Equal(subnet.IP) || ip.Equal(net.ParseIP("10.96.0.3")) {
+			t.Fatalf("unexpected address allocated %s", ip)
+		}
+	}
+	if _, err := r.AllocateNext(); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	if _, err := r.ReserveNext(0); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	// but they can be allocated explicitly
+	if err := r.Allocate(net.ParseIP("10.96.0.3")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
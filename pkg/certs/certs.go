@@ -0,0 +1,495 @@
+// Package certs manages a self-signed certificate for the webhook server, so the manager can
+// run without cert-manager. The CA and the serving certificate are kept in a Secret shared by
+// all the replicas, the CA is injected in the webhook configurations and the conversion webhook
+// of the CRDs, and both are rotated before they expire.
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of the Secret, the serving certificate uses the keys of a kubernetes.io/tls Secret.
+// The CA bundle contains the current CA first and the previous ones until they expire.
+const (
+	CABundleKey = "ca.crt"
+	CAKeyKey    = "ca.key"
+)
+
+// DefaultInterval is the time between the checks of the certificates, the certificates
+// are rotated when less than a third of their validity remains.
+const DefaultInterval = time.Hour
+
+const (
+	// time to retry a failed check
+	retryInterval = 10 * time.Second
+	// the certificates are valid from a bit earlier, the clocks of the apiservers may be behind
+	clockSkew = 5 * time.Minute
+)
+
+var crdGVK = schema.GroupVersionKind{
+	Group:   "apiextensions.k8s.io",
+	Version: "v1",
+	Kind:    "CustomResourceDefinition",
+}
+
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;create;update,namespace=alloc-system
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;update
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;update
+
+// Rotator keeps the certificate of the webhook server, every replica runs it: the first one
+// creates the Secret and the one that finds the certificates about to expire rotates them,
+// the writes are guarded by the resourceVersion of the Secret. Every replica writes the
+// serving certificate to the directory of its webhook server, that reloads it.
+type Rotator struct {
+	// Client should not be a cache, the Rotator runs before the manager starts
+	Client client.Client
+	Log    logr.Logger
+	// Secret with the CA and the serving certificate
+	Secret types.NamespacedName
+	// Service of the webhook server, its DNS names are the names of the serving certificate
+	Service types.NamespacedName
+	// CertDir is the directory of the tls.crt and tls.key files of the webhook server
+	CertDir string
+	// webhook configurations and CRDs the CA bundle is injected in
+	MutatingWebhookConfigurations   []string
+	ValidatingWebhookConfigurations []string
+	CRDs                            []string
+	// Validity of the CA and the serving certificate
+	Validity time.Duration
+	// Interval between the checks, DefaultInterval if zero
+	Interval time.Duration
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// Start checks the certificates every interval until the context is done.
+func (r *Rotator) Start(ctx context.Context) error {
+	interval := r.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	for {
+		delay := interval
+		if err := r.Sync(ctx); err != nil {
+			r.Log.Error(err, "unable to sync the webhook certificates")
+			delay = retryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// NeedLeaderElection returns false, every replica serves the webhooks with the certificate.
+func (r *Rotator) NeedLeaderElection() bool {
+	return false
+}
+
+// Sync creates or rotates the certificates in the Secret, injects the CA bundle and writes the
+// serving certificate to CertDir. The CA bundle is injected before the serving certificate
+// signed by a new CA is used.
+func (r *Rotator) Sync(ctx context.Context) error {
+	secret, err := r.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+	caBundle := secret.Data[CABundleKey]
+	for _, name := range r.MutatingWebhookConfigurations {
+		if err := r.injectMutating(ctx, name, caBundle); err != nil {
+			return fmt.Errorf("unable to inject the CA bundle in MutatingWebhookConfiguration %s: %v", name, err)
+		}
+	}
+	for _, name := range r.ValidatingWebhookConfigurations {
+		if err := r.injectValidating(ctx, name, caBundle); err != nil {
+			return fmt.Errorf("unable to inject the CA bundle in ValidatingWebhookConfiguration %s: %v", name, err)
+		}
+	}
+	for _, name := range r.CRDs {
+		if err := r.injectCRD(ctx, name, caBundle); err != nil {
+			return fmt.Errorf("unable to inject the CA bundle in CustomResourceDefinition %s: %v", name, err)
+		}
+	}
+	return r.writeCertDir(secret)
+}
+
+// ensureSecret returns the Secret with valid certificates, creating or updating it if needed
+func (r *Rotator) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	var secret *corev1.Secret
+	// another replica may create or rotate the certificates at the same time
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		secret = &corev1.Secret{}
+		err := r.Client.Get(ctx, r.Secret, secret)
+		if apierrors.IsNotFound(err) {
+			data, _, err := r.renew(nil)
+			if err != nil {
+				return err
+			}
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      r.Secret.Name,
+					Namespace: r.Secret.Namespace,
+				},
+				Type: corev1.SecretTypeTLS,
+				Data: data,
+			}
+			r.Log.Info("creating the webhook certificates", "secret", r.Secret)
+			return r.Client.Create(ctx, secret)
+		}
+		if err != nil {
+			return err
+		}
+		data, changed, err := r.renew(secret.Data)
+		if err != nil || !changed {
+			return err
+		}
+		secret.Data = data
+		r.Log.Info("rotating the webhook certificates", "secret", r.Secret)
+		return r.Client.Update(ctx, secret)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to sync the certificates in Secret %s: %v", r.Secret, err)
+	}
+	return secret, nil
+}
+
+// renew returns the data of the Secret with the certificates that are missing, invalid or
+// about to expire replaced, and whether it changed
+func (r *Rotator) renew(data map[string][]byte) (map[string][]byte, bool, error) {
+	now := r.clock()
+	changed := false
+	bundle := data[CABundleKey]
+	ca, err := parseKeyPair(firstCertificate(bundle), data[CAKeyKey])
+	if err != nil || needsRotation(ca.cert, now) {
+		ca, err = newCA(r.Service.String(), now, r.Validity)
+		if err != nil {
+			return nil, false, err
+		}
+		// the previous CA is trusted until it expires, the other replicas may be
+		// serving a certificate it signed
+		bundle = append(append([]byte{}, ca.certPEM...), bundle...)
+		changed = true
+	}
+	// drop the expired and invalid CAs
+	if pruned := pruneBundle(bundle, now); !bytes.Equal(pruned, bundle) {
+		bundle = pruned
+		changed = true
+	}
+	dnsNames := r.dnsNames()
+	cert, err := parseKeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil || needsRotation(cert.cert, now) || !hasNames(cert.cert, dnsNames) ||
+		cert.cert.CheckSignatureFrom(ca.cert) != nil {
+		cert, err = newServingCert(ca, dnsNames, now, r.Validity)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	if !changed {
+		return data, false, nil
+	}
+	return map[string][]byte{
+		CABundleKey:             bundle,
+		CAKeyKey:                ca.keyPEM,
+		corev1.TLSCertKey:       cert.certPEM,
+		corev1.TLSPrivateKeyKey: cert.keyPEM,
+	}, true, nil
+}
+
+// dnsNames returns the names the apiserver may use to reach the Service
+func (r *Rotator) dnsNames() []string {
+	name := r.Service.Name
+	namespaced := name + "." + r.Service.Namespace
+	return []string{
+		name,
+		namespaced,
+		namespaced + ".svc",
+		namespaced + ".svc.cluster.local",
+	}
+}
+
+func (r *Rotator) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// writeCertDir writes the serving certificate of the Secret to CertDir if it changed. Each file
+// is replaced atomically, the key is written first so the webhook server reloads a valid pair
+// once the certificate is written.
+func (r *Rotator) writeCertDir(secret *corev1.Secret) error {
+	if err := os.MkdirAll(r.CertDir, 0700); err != nil {
+		return err
+	}
+	for _, key := range []string{corev1.TLSPrivateKeyKey, corev1.TLSCertKey} {
+		path := filepath.Join(r.CertDir, key)
+		current, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Equal(current, secret.Data[key]) {
+			continue
+		}
+		tmp, err := ioutil.TempFile(r.CertDir, "."+key)
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(secret.Data[key])
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("unable to write %s: %v", path, err)
+		}
+		r.Log.Info("updated the webhook certificate", "file", path)
+	}
+	return nil
+}
+
+func (r *Rotator) injectMutating(ctx context.Context, name string, caBundle []byte) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cfg := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: name}, cfg); err != nil {
+			return err
+		}
+		changed := false
+		for i := range cfg.Webhooks {
+			if !bytes.Equal(cfg.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				cfg.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return r.Client.Update(ctx, cfg)
+	})
+}
+
+func (r *Rotator) injectValidating(ctx context.Context, name string, caBundle []byte) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cfg := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: name}, cfg); err != nil {
+			return err
+		}
+		changed := false
+		for i := range cfg.Webhooks {
+			if !bytes.Equal(cfg.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				cfg.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return r.Client.Update(ctx, cfg)
+	})
+}
+
+// injectCRD sets the CA bundle of the conversion webhook of the CRD, the CRD is unstructured
+// to not depend on the apiextensions types
+func (r *Rotator) injectCRD(ctx context.Context, name string, caBundle []byte) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		crd := &unstructured.Unstructured{}
+		crd.SetGroupVersionKind(crdGVK)
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: name}, crd); err != nil {
+			return err
+		}
+		strategy, _, err := unstructured.NestedString(crd.Object, "spec", "conversion", "strategy")
+		if err != nil {
+			return err
+		}
+		if strategy != "Webhook" {
+			r.Log.V(1).Info("the CRD does not use a conversion webhook", "crd", name)
+			return nil
+		}
+		encoded := base64.StdEncoding.EncodeToString(caBundle)
+		current, _, err := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+		if err != nil {
+			return err
+		}
+		if current == encoded {
+			return nil
+		}
+		if err := unstructured.SetNestedField(crd.Object, encoded, "spec", "conversion", "webhook", "clientConfig", "caBundle"); err != nil {
+			return err
+		}
+		return r.Client.Update(ctx, crd)
+	})
+}
+
+// keyPair is a parsed certificate with its private key and their PEM encoding
+type keyPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func parseKeyPair(certPEM, keyPEM []byte) (*keyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil || keyBlock.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("no private key found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.X.Cmp(key.X) != 0 || pub.Y.Cmp(key.Y) != 0 {
+		return nil, fmt.Errorf("the private key does not match the certificate")
+	}
+	return &keyPair{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+func newCA(name string, now time.Time, validity time.Duration) (*keyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name + "-ca"},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return newKeyPair(template, nil)
+}
+
+// newServingCert returns a certificate for the DNS names signed by the CA, it does not
+// outlive the CA
+func newServingCert(ca *keyPair, dnsNames []string, now time.Time, validity time.Duration) (*keyPair, error) {
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-clockSkew),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return newKeyPair(template, ca)
+}
+
+// newKeyPair generates a key and a certificate from the template signed by the parent,
+// the certificate is self-signed if the parent is nil
+func newKeyPair(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// needsRotation returns true if less than a third of the validity of the certificate remains
+func needsRotation(cert *x509.Certificate, now time.Time) bool {
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Sub(now) < validity/3
+}
+
+func hasNames(cert *x509.Certificate, dnsNames []string) bool {
+	if len(cert.DNSNames) != len(dnsNames) {
+		return false
+	}
+	for i := range dnsNames {
+		if cert.DNSNames[i] != dnsNames[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// firstCertificate returns the first PEM block of the bundle, the current CA
+func firstCertificate(bundle []byte) []byte {
+	block, _ := pem.Decode(bundle)
+	if block == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// pruneBundle returns the certificates of the bundle that have not expired
+func pruneBundle(bundle []byte, now time.Time) []byte {
+	var pruned []byte
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return pruned
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || now.After(cert.NotAfter) {
+			continue
+		}
+		pruned = append(pruned, pem.EncodeToMemory(block)...)
+	}
+}
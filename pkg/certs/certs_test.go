@@ -0,0 +1,289 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+const validity = 90 * 24 * time.Hour
+
+func newTestRotator(t *testing.T, now *time.Time) (*Rotator, client.Client) {
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(crdGVK)
+	crd.SetName("ipranges.clusterip.allocator.x-k8s.io")
+	if err := unstructured.SetNestedField(crd.Object, "Webhook", "spec", "conversion", "strategy"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := unstructured.SetNestedField(crd.Object, "Cg==", "spec", "conversion", "webhook", "clientConfig", "caBundle"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "mutating"},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "a"}, {Name: "b"}},
+		},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "validating"},
+			Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "a"}},
+		},
+		crd,
+	).Build()
+
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &Rotator{
+		Client:                          c,
+		Log:                             zap.New(zap.UseDevMode(true)),
+		Secret:                          types.NamespacedName{Namespace: "alloc-system", Name: "webhook-cert"},
+		Service:                         types.NamespacedName{Namespace: "alloc-system", Name: "webhook-service"},
+		CertDir:                         filepath.Join(dir, "serving-certs"),
+		MutatingWebhookConfigurations:   []string{"mutating"},
+		ValidatingWebhookConfigurations: []string{"validating"},
+		CRDs:                            []string{"ipranges.clusterip.allocator.x-k8s.io"},
+		Validity:                        validity,
+		now:                             func() time.Time { return *now },
+	}, c
+}
+
+// cleanup removes the directory of the certificates of the test rotator
+func cleanup(r *Rotator) {
+	os.RemoveAll(filepath.Dir(r.CertDir))
+}
+
+// verify checks the certificate in CertDir is trusted by the CA bundle for the Service at the time
+func verify(t *testing.T, r *Rotator, caBundle []byte, now time.Time) *x509.Certificate {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(r.CertDir, "tls.crt"), filepath.Join(r.CertDir, "tls.key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verifyCert(t, cert, caBundle, now)
+	return cert
+}
+
+func verifyCert(t *testing.T, cert *x509.Certificate, caBundle []byte, now time.Time) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caBundle) {
+		t.Fatalf("invalid CA bundle")
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		DNSName:     "webhook-service.alloc-system.svc",
+		Roots:       roots,
+		CurrentTime: now,
+	})
+	if err != nil {
+		t.Fatalf("the certificate is not trusted: %v", err)
+	}
+}
+
+func countCertificates(bundle []byte) int {
+	n := 0
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestRotatorSync(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	r, c := newTestRotator(t, &now)
+	defer cleanup(r)
+
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, r.Secret, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secret.Type != corev1.SecretTypeTLS {
+		t.Fatalf("expected a %s Secret, got %s", corev1.SecretTypeTLS, secret.Type)
+	}
+	caBundle := secret.Data[CABundleKey]
+	if n := countCertificates(caBundle); n != 1 {
+		t.Fatalf("expected one CA, got %d", n)
+	}
+	verify(t, r, caBundle, now)
+
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "mutating"}, mutating); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, w := range mutating.Webhooks {
+		if !bytes.Equal(w.ClientConfig.CABundle, caBundle) {
+			t.Fatalf("CA bundle not injected in webhook %s", w.Name)
+		}
+	}
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "validating"}, validating); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(validating.Webhooks[0].ClientConfig.CABundle, caBundle) {
+		t.Fatalf("CA bundle not injected in webhook %s", validating.Webhooks[0].Name)
+	}
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(crdGVK)
+	if err := c.Get(ctx, client.ObjectKey{Name: r.CRDs[0]}, crd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	encoded, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+	if encoded != base64.StdEncoding.EncodeToString(caBundle) {
+		t.Fatalf("CA bundle not injected in the CRD, got %q", encoded)
+	}
+
+	// the certificates are reused while they are valid
+	resourceVersion := secret.ResourceVersion
+	now = now.Add(validity / 2)
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Get(ctx, r.Secret, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secret.ResourceVersion != resourceVersion {
+		t.Fatalf("the Secret was updated")
+	}
+
+	// another replica writes the certificates of the Secret
+	other := *r
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	other.CertDir = dir
+	if err := other.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, key := range []string{"tls.crt", "tls.key"} {
+		a, _ := ioutil.ReadFile(filepath.Join(r.CertDir, key))
+		b, _ := ioutil.ReadFile(filepath.Join(other.CertDir, key))
+		if !bytes.Equal(a, b) {
+			t.Fatalf("the replicas use different %s", key)
+		}
+	}
+}
+
+func TestRotatorRotation(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now()
+	now := start
+	r, c := newTestRotator(t, &now)
+	defer cleanup(r)
+
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, r.Secret, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldCert := verify(t, r, secret.Data[CABundleKey], now)
+
+	// less than a third of the validity remains, the CA and the certificate are rotated
+	now = start.Add(validity * 7 / 10)
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Get(ctx, r.Secret, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	caBundle := secret.Data[CABundleKey]
+	if n := countCertificates(caBundle); n != 2 {
+		t.Fatalf("expected the new and the previous CA, got %d", n)
+	}
+	newCert := verify(t, r, caBundle, now)
+	if newCert.SerialNumber.Cmp(oldCert.SerialNumber) == 0 {
+		t.Fatalf("the certificate was not rotated")
+	}
+	// the replicas that did not reload the certificate yet are still trusted
+	verifyCert(t, oldCert, caBundle, now)
+
+	// the previous CA expired and is dropped from the bundle
+	now = start.Add(validity * 11 / 10)
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Get(ctx, r.Secret, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	caBundle = secret.Data[CABundleKey]
+	if n := countCertificates(caBundle); n != 1 {
+		t.Fatalf("expected one CA, got %d", n)
+	}
+	verify(t, r, caBundle, now)
+}
+
+func TestRotatorServiceChange(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	r, c := newTestRotator(t, &now)
+	defer cleanup(r)
+
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, r.Secret, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	caBundle := secret.Data[CABundleKey]
+
+	// the certificate is issued again for the new names by the same CA
+	r.Service.Name = "webhook"
+	if err := r.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Get(ctx, r.Secret, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(caBundle, secret.Data[CABundleKey]) {
+		t.Fatalf("the CA was rotated")
+	}
+	cert, err := parseKeyPair(secret.Data["tls.crt"], secret.Data["tls.key"])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cert.cert.DNSNames[0] != "webhook" {
+		t.Fatalf("expected a certificate for the new Service, got %v", cert.cert.DNSNames)
+	}
+}
+
+func TestRotatorMissingWebhookConfiguration(t *testing.T) {
+	now := time.Now()
+	r, _ := newTestRotator(t, &now)
+	defer cleanup(r)
+	r.MutatingWebhookConfigurations = []string{"missing"}
+	if err := r.Sync(context.Background()); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
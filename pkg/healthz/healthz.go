@@ -0,0 +1,52 @@
+// Package healthz implements the readiness checks of the manager, they are served
+// by the manager health probe endpoint.
+package healthz
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+// timeout of each check, the probes of the kubelet time out after 1 second by default
+const timeout = 800 * time.Millisecond
+
+// IPRangeChecker fails if the IPRanges can not be listed, the reader should not be a cache so
+// the apiserver is reached. The IPRanges may not exist yet, they are created through the webhook.
+func IPRangeChecker(reader client.Reader) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		var rangeList clusteripv1.IPRangeList
+		if err := reader.List(ctx, &rangeList, client.Limit(1)); err != nil {
+			return fmt.Errorf("unable to list IPRanges: %v", err)
+		}
+		return nil
+	}
+}
+
+// WebhookTLSChecker fails until the webhook server listening on host:port completes a TLS handshake,
+// so the serving certificate has been loaded. The certificate is not verified.
+func WebhookTLSChecker(host string, port int) healthz.Checker {
+	if host == "" {
+		host = "localhost"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	return func(_ *http.Request) error {
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return fmt.Errorf("webhook server %s is not serving TLS: %v", addr, err)
+		}
+		return conn.Close()
+	}
+}
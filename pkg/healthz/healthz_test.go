@@ -0,0 +1,61 @@
+package healthz
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+func TestIPRangeChecker(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	if err := IPRangeChecker(c)(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the IPRange kind is not registered
+	c = fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build()
+	if err := IPRangeChecker(c)(req); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestWebhookTLSChecker(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	if err := WebhookTLSChecker(host, portNumber)(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a server without TLS
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	host, port, _ = net.SplitHostPort(plain.Listener.Addr().String())
+	portNumber, _ = strconv.Atoi(port)
+	if err := WebhookTLSChecker(host, portNumber)(req); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// nothing listening
+	plain.Close()
+	if err := WebhookTLSChecker(host, portNumber)(req); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
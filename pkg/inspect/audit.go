@@ -0,0 +1,283 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+// Objects are the objects that allocate the ClusterIPs and the Services that use them
+type Objects struct {
+	IPRanges        []clusteripv1.IPRange
+	ClusterIPRanges []clusteripv1beta1.ClusterIPRange
+	ServiceIPs      []clusteripv1beta2.ServiceIP
+	Services        []v1.Service
+}
+
+// Finding is an address that is not consistent between the IPRanges and the Services
+type Finding struct {
+	Address string `json:"address"`
+	// IPRanges namespace/name, and ClusterIPRanges and ServiceIPs kind/name, that allocate the address
+	IPRanges []string `json:"ipRanges,omitempty"`
+	// Services namespace/name that use the address
+	Services []string `json:"services,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+// Report is the result of the audit of the IPRanges, the ClusterIPRanges, the ServiceIPs and the Services
+type Report struct {
+	Timestamp       metav1.Time `json:"timestamp"`
+	IPRanges        int         `json:"ipRanges"`
+	ClusterIPRanges int         `json:"clusterIPRanges"`
+	ServiceIPs      int         `json:"serviceIPs"`
+	Services        int         `json:"services"`
+	// Duplicates are the addresses allocated by several IPRanges or used by several Services
+	Duplicates []Finding `json:"duplicates"`
+	// Leaks are the addresses allocated that no Service uses and are not reserved nor held
+	Leaks []Finding `json:"leaks"`
+	// Orphans are the ClusterIPs of the Services that belong to an IPRange but are not allocated
+	Orphans []Finding `json:"orphans"`
+	// OutOfRange are the addresses that do not belong to the IPRange that allocates them,
+	// or the ClusterIPs that do not belong to any IPRange
+	OutOfRange []Finding `json:"outOfRange"`
+	// WrongFamily are the addresses of an IP family different from their IPRange or Service
+	WrongFamily []Finding `json:"wrongFamily"`
+}
+
+// Consistent returns true if the audit did not find any problem
+func (r *Report) Consistent() bool {
+	return len(r.Duplicates) == 0 && len(r.Leaks) == 0 && len(r.Orphans) == 0 &&
+		len(r.OutOfRange) == 0 && len(r.WrongFamily) == 0
+}
+
+// allocation is an object that allocates addresses of a range
+type allocation struct {
+	name      string
+	cidr      string
+	addresses []string
+	// reserved are the addresses waiting for a Service to be created
+	reserved []string
+}
+
+// allocations returns the addresses allocated by the IPRanges, the ClusterIPRanges and the ServiceIPs
+func allocations(objects *Objects) []allocation {
+	var result []allocation
+	for _, ipRange := range objects.IPRanges {
+		reserved := sets.StringKeySet(ipRange.GetReservations())
+		for _, reservation := range ipRange.Spec.StickyReservations {
+			reserved.Insert(reservation.Address)
+		}
+		result = append(result, allocation{
+			name:      ipRange.Namespace + "/" + ipRange.Name,
+			cidr:      ipRange.Spec.Range,
+			addresses: ipRange.Spec.Addresses,
+			reserved:  reserved.List(),
+		})
+	}
+	for _, ipRange := range objects.ClusterIPRanges {
+		result = append(result, allocation{
+			name:      "clusteriprange/" + ipRange.Name,
+			cidr:      ipRange.Spec.Range,
+			addresses: ipRange.Spec.Addresses,
+			reserved:  sets.StringKeySet(ipRange.GetReservations()).List(),
+		})
+	}
+	for _, serviceIP := range objects.ServiceIPs {
+		ip := clusteripv1beta2.ParseServiceIPName(serviceIP.Name)
+		if ip == nil {
+			continue
+		}
+		serviceIPAllocation := allocation{
+			name:      "serviceip/" + serviceIP.Name,
+			cidr:      serviceIP.Spec.Range,
+			addresses: []string{ip.String()},
+		}
+		if _, ok := serviceIP.Annotations[clusteripv1beta2.ServiceIPExpiresAnnotation]; ok {
+			serviceIPAllocation.reserved = serviceIPAllocation.addresses
+		}
+		result = append(result, serviceIPAllocation)
+	}
+	return result
+}
+
+// Audit compares the addresses of all the IPRanges, ClusterIPRanges and ServiceIPs with the ClusterIPs
+// of all the Services, the objects are not modified.
+func Audit(objects *Objects) *Report {
+	report := &Report{
+		Timestamp:       metav1.Now(),
+		IPRanges:        len(objects.IPRanges),
+		ClusterIPRanges: len(objects.ClusterIPRanges),
+		ServiceIPs:      len(objects.ServiceIPs),
+		Services:        len(objects.Services),
+		Duplicates:      []Finding{},
+		Leaks:           []Finding{},
+		Orphans:         []Finding{},
+		OutOfRange:      []Finding{},
+		WrongFamily:     []Finding{},
+	}
+
+	// addresses allocated by the IPRanges, the ClusterIPRanges and the ServiceIPs
+	var cidrs []*net.IPNet
+	allocatedBy := map[string][]string{}
+	reserved := sets.NewString()
+	for _, ipRange := range allocations(objects) {
+		name := ipRange.name
+		_, cidr, err := net.ParseCIDR(ipRange.cidr)
+		if err != nil {
+			// the range is validated by the webhook
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+		for _, address := range ipRange.addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				continue
+			}
+			switch {
+			case utilnet.IsIPv6(ip) != utilnet.IsIPv6CIDR(cidr):
+				report.WrongFamily = append(report.WrongFamily, Finding{
+					Address: ip.String(), IPRanges: []string{name}, Reason: "IP family does not match the range " + cidr.String(),
+				})
+			case !cidr.Contains(ip):
+				report.OutOfRange = append(report.OutOfRange, Finding{
+					Address: ip.String(), IPRanges: []string{name}, Reason: "address does not belong to the range " + cidr.String(),
+				})
+			}
+			allocatedBy[ip.String()] = append(allocatedBy[ip.String()], name)
+		}
+		for _, address := range ipRange.reserved {
+			if ip := net.ParseIP(address); ip != nil {
+				reserved.Insert(ip.String())
+			}
+		}
+	}
+
+	// addresses used by the Services
+	usedBy := map[string][]string{}
+	for _, svc := range objects.Services {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil {
+			continue
+		}
+		name := svc.Namespace + "/" + svc.Name
+		usedBy[ip.String()] = append(usedBy[ip.String()], name)
+		if svc.Spec.IPFamily != nil && (*svc.Spec.IPFamily == v1.IPv6Protocol) != utilnet.IsIPv6(ip) {
+			report.WrongFamily = append(report.WrongFamily, Finding{
+				Address: ip.String(), Services: []string{name}, Reason: "IP family does not match the Service family " + string(*svc.Spec.IPFamily),
+			})
+		}
+	}
+
+	for _, address := range sets.StringKeySet(usedBy).Union(sets.StringKeySet(allocatedBy)).List() {
+		finding := Finding{Address: address, IPRanges: allocatedBy[address], Services: usedBy[address]}
+		sort.Strings(finding.IPRanges)
+		sort.Strings(finding.Services)
+		if len(finding.IPRanges) > 1 || len(finding.Services) > 1 {
+			duplicate := finding
+			duplicate.Reason = "address is allocated or used more than once"
+			report.Duplicates = append(report.Duplicates, duplicate)
+		}
+		switch {
+		case len(finding.Services) == 0:
+			// the reservations are waiting for the Service to be created
+			if !reserved.Has(address) {
+				finding.Reason = "address is allocated but not used by any Service"
+				report.Leaks = append(report.Leaks, finding)
+			}
+		case len(finding.IPRanges) == 0:
+			ip := net.ParseIP(address)
+			sameFamily := false
+			contained := false
+			for _, cidr := range cidrs {
+				if utilnet.IsIPv6CIDR(cidr) == utilnet.IsIPv6(ip) {
+					sameFamily = true
+				}
+				if cidr.Contains(ip) {
+					contained = true
+				}
+			}
+			switch {
+			case contained:
+				finding.Reason = "address is used but not allocated"
+				report.Orphans = append(report.Orphans, finding)
+			case !sameFamily && len(cidrs) > 0:
+				finding.Reason = "there is no range of the IP family of the address"
+				report.WrongFamily = append(report.WrongFamily, finding)
+			default:
+				finding.Reason = "address does not belong to any range"
+				report.OutOfRange = append(report.OutOfRange, finding)
+			}
+		}
+	}
+
+	for _, findings := range [][]Finding{report.OutOfRange, report.WrongFamily} {
+		sort.SliceStable(findings, func(i, j int) bool { return findings[i].Address < findings[j].Address })
+	}
+	return report
+}
+
+// ReadObjects reads the IPRanges, the ClusterIPRanges, the ServiceIPs and the Services of a JSON List, i.e. the output of
+// "kubectl get ipranges.clusterip.allocator.x-k8s.io,clusteripranges,serviceips,services -A -o json"
+func ReadObjects(r io.Reader) (*Objects, error) {
+	list := &metav1.List{}
+	if err := json.NewDecoder(r).Decode(list); err != nil {
+		return nil, err
+	}
+	objects := &Objects{}
+	for i, item := range list.Items {
+		typeMeta := metav1.TypeMeta{}
+		if err := json.Unmarshal(item.Raw, &typeMeta); err != nil {
+			return nil, fmt.Errorf("invalid item %d: %v", i, err)
+		}
+		switch typeMeta.GroupVersionKind() {
+		case clusteripv1.GroupVersion.WithKind("IPRange"):
+			ipRange := clusteripv1.IPRange{}
+			if err := json.Unmarshal(item.Raw, &ipRange); err != nil {
+				return nil, fmt.Errorf("invalid IPRange %d: %v", i, err)
+			}
+			objects.IPRanges = append(objects.IPRanges, ipRange)
+		case clusteripv1beta2.GroupVersion.WithKind("IPRange"):
+			hub := &clusteripv1beta2.IPRange{}
+			if err := json.Unmarshal(item.Raw, hub); err != nil {
+				return nil, fmt.Errorf("invalid IPRange %d: %v", i, err)
+			}
+			ipRange := clusteripv1.IPRange{}
+			if err := ipRange.ConvertFrom(hub); err != nil {
+				return nil, fmt.Errorf("invalid IPRange %d: %v", i, err)
+			}
+			objects.IPRanges = append(objects.IPRanges, ipRange)
+		case clusteripv1beta1.GroupVersion.WithKind("ClusterIPRange"):
+			ipRange := clusteripv1beta1.ClusterIPRange{}
+			if err := json.Unmarshal(item.Raw, &ipRange); err != nil {
+				return nil, fmt.Errorf("invalid ClusterIPRange %d: %v", i, err)
+			}
+			objects.ClusterIPRanges = append(objects.ClusterIPRanges, ipRange)
+		case clusteripv1beta2.GroupVersion.WithKind("ServiceIP"):
+			serviceIP := clusteripv1beta2.ServiceIP{}
+			if err := json.Unmarshal(item.Raw, &serviceIP); err != nil {
+				return nil, fmt.Errorf("invalid ServiceIP %d: %v", i, err)
+			}
+			objects.ServiceIPs = append(objects.ServiceIPs, serviceIP)
+		case v1.SchemeGroupVersion.WithKind("Service"):
+			svc := v1.Service{}
+			if err := json.Unmarshal(item.Raw, &svc); err != nil {
+				return nil, fmt.Errorf("invalid Service %d: %v", i, err)
+			}
+			objects.Services = append(objects.Services, svc)
+		default:
+			return nil, fmt.Errorf("unsupported object %d of kind %s", i, typeMeta.GroupVersionKind())
+		}
+	}
+	return objects, nil
+}
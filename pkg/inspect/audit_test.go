@@ -0,0 +1,165 @@
+package inspect
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	clusteripv1beta1 "github.com/aojea/clusterip-webhook/api/v1beta1"
+	clusteripv1beta2 "github.com/aojea/clusterip-webhook/api/v1beta2"
+)
+
+func addresses(findings []Finding) []string {
+	var result []string
+	for _, finding := range findings {
+		result = append(result, finding.Address)
+	}
+	return result
+}
+
+func TestAudit(t *testing.T) {
+	ipv4 := newRange("10.0.0.0/24", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.1.1", "2001:db2::1")
+	ipv4.SetReservations(map[string]metav1.Time{"10.0.0.4": metav1.NewTime(time.Now().Add(time.Minute))})
+	other := newRange("10.0.0.0/24", "10.0.0.1")
+	other.Name = "other"
+	ipv6 := v1.IPv6Protocol
+	wrongFamily := newService("ipv6", "10.0.0.9")
+	wrongFamily.Spec.IPFamily = &ipv6
+
+	report := Audit(&Objects{IPRanges: []clusteripv1.IPRange{*ipv4, *other}, Services: []v1.Service{
+		newService("a", "10.0.0.1"),
+		newService("b", "10.0.0.2"),
+		newService("c", "10.0.0.2"),
+		newService("d", "10.0.0.5"),
+		newService("e", "10.0.5.5"),
+		newService("f", "2001:db2::2"),
+		newService("headless", v1.ClusterIPNone),
+		wrongFamily,
+	}})
+	for name, tc := range map[string]struct {
+		findings []Finding
+		expected []string
+	}{
+		"duplicates":  {report.Duplicates, []string{"10.0.0.1", "10.0.0.2"}},
+		"leaks":       {report.Leaks, []string{"10.0.0.3", "10.0.1.1", "2001:db2::1"}},
+		"orphans":     {report.Orphans, []string{"10.0.0.5", "10.0.0.9"}},
+		"outOfRange":  {report.OutOfRange, []string{"10.0.1.1", "10.0.5.5"}},
+		"wrongFamily": {report.WrongFamily, []string{"10.0.0.9", "2001:db2::1", "2001:db2::2"}},
+	} {
+		if got := addresses(tc.findings); strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", name, tc.expected, got)
+		}
+	}
+	if report.Consistent() {
+		t.Fatalf("expected the report to be inconsistent")
+	}
+
+	report = Audit(&Objects{IPRanges: []clusteripv1.IPRange{*newRange("10.0.0.0/24", "10.0.0.1")}, Services: []v1.Service{newService("a", "10.0.0.1")}})
+	if !report.Consistent() {
+		t.Fatalf("expected the report to be consistent, got %+v", report)
+	}
+}
+
+func TestAuditClusterScoped(t *testing.T) {
+	clusterRange := clusteripv1beta1.ClusterIPRange{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec:       clusteripv1beta1.ClusterIPRangeSpec{Range: "10.1.0.0/24", Addresses: []string{"10.1.0.1", "10.1.0.2", "10.1.0.3"}},
+	}
+	clusterRange.SetReservations(map[string]metav1.Time{"10.1.0.3": metav1.NewTime(time.Now().Add(time.Minute))})
+	serviceIP := func(name string, reserved bool) clusteripv1beta2.ServiceIP {
+		serviceIP := clusteripv1beta2.ServiceIP{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       clusteripv1beta2.ServiceIPSpec{Range: "10.2.0.0/24"},
+		}
+		if reserved {
+			serviceIP.Annotations = map[string]string{clusteripv1beta2.ServiceIPExpiresAnnotation: time.Now().Add(time.Minute).Format(time.RFC3339)}
+		}
+		return serviceIP
+	}
+
+	report := Audit(&Objects{
+		ClusterIPRanges: []clusteripv1beta1.ClusterIPRange{clusterRange},
+		ServiceIPs:      []clusteripv1beta2.ServiceIP{serviceIP("10.2.0.1", false), serviceIP("10.2.0.2", false), serviceIP("10.2.0.3", true)},
+		Services: []v1.Service{
+			newService("a", "10.1.0.1"),
+			newService("b", "10.1.0.4"),
+			newService("c", "10.2.0.1"),
+			newService("d", "10.2.0.4"),
+		},
+	})
+	for name, tc := range map[string]struct {
+		findings []Finding
+		expected []string
+	}{
+		"leaks":   {report.Leaks, []string{"10.1.0.2", "10.2.0.2"}},
+		"orphans": {report.Orphans, []string{"10.1.0.4", "10.2.0.4"}},
+	} {
+		if got := addresses(tc.findings); strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", name, tc.expected, got)
+		}
+	}
+	if got := report.Leaks[1].IPRanges; len(got) != 1 || got[0] != "serviceip/10.2.0.2" {
+		t.Errorf("expected the leak to be allocated by the ServiceIP, got %v", got)
+	}
+	if report.ClusterIPRanges != 1 || report.ServiceIPs != 3 {
+		t.Errorf("unexpected counts %+v", report)
+	}
+}
+
+func TestReadObjects(t *testing.T) {
+	ipRange := newRange("10.0.0.0/24", "10.0.0.1")
+	ipRange.TypeMeta = metav1.TypeMeta{APIVersion: clusteripv1.GroupVersion.String(), Kind: "IPRange"}
+	hub := &clusteripv1beta2.IPRange{
+		TypeMeta:   metav1.TypeMeta{APIVersion: clusteripv1beta2.GroupVersion.String(), Kind: "IPRange"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "hub"},
+		Spec:       clusteripv1beta2.IPRangeSpec{Range: "10.3.0.0/24", Addresses: []clusteripv1beta2.IPAddress{{Address: "10.3.0.1"}}},
+	}
+	clusterRange := &clusteripv1beta1.ClusterIPRange{
+		TypeMeta:   metav1.TypeMeta{APIVersion: clusteripv1beta1.GroupVersion.String(), Kind: "ClusterIPRange"},
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec:       clusteripv1beta1.ClusterIPRangeSpec{Range: "10.1.0.0/24"},
+	}
+	serviceIP := &clusteripv1beta2.ServiceIP{
+		TypeMeta:   metav1.TypeMeta{APIVersion: clusteripv1beta2.GroupVersion.String(), Kind: "ServiceIP"},
+		ObjectMeta: metav1.ObjectMeta{Name: "10.2.0.1"},
+		Spec:       clusteripv1beta2.ServiceIPSpec{Range: "10.2.0.0/24"},
+	}
+	svc := newService("a", "10.0.0.1")
+	svc.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+	list := &metav1.List{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "List"}}
+	for _, obj := range []interface{}{ipRange, hub, clusterRange, serviceIP, svc} {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		list.Items = append(list.Items, runtime.RawExtension{Raw: raw})
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	objects, err := ReadObjects(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(objects.IPRanges) != 2 || objects.IPRanges[0].Spec.Range != "10.0.0.0/24" || len(objects.Services) != 1 || objects.Services[0].Spec.ClusterIP != "10.0.0.1" {
+		t.Fatalf("unexpected objects %+v", objects)
+	}
+	// the v1beta2 IPRanges are converted to v1
+	if converted := objects.IPRanges[1]; converted.Name != "hub" || len(converted.Spec.Addresses) != 1 || converted.Spec.Addresses[0] != "10.3.0.1" {
+		t.Fatalf("unexpected converted IPRange %+v", converted)
+	}
+	if len(objects.ClusterIPRanges) != 1 || objects.ClusterIPRanges[0].Name != "cluster" || len(objects.ServiceIPs) != 1 || objects.ServiceIPs[0].Name != "10.2.0.1" {
+		t.Fatalf("unexpected objects %+v", objects)
+	}
+
+	if _, err := ReadObjects(strings.NewReader(`{"kind":"List","items":[{"apiVersion":"v1","kind":"Pod"}]}`)); err == nil {
+		t.Fatalf("expected error for unsupported objects")
+	}
+}
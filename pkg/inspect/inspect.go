@@ -0,0 +1,216 @@
+// Package inspect reports the state of the IPRanges and compares it with the ClusterIPs
+// of the Services, it only reads the objects so it can be used with any client.
+package inspect
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+// Address is an address allocated from an IPRange
+type Address struct {
+	Address string `json:"address"`
+	// Service namespace/name that uses the address, empty if no Service uses it
+	Service string `json:"service,omitempty"`
+	// Expires is set if the address is reserved and the reservation is not committed yet
+	Expires *metav1.Time `json:"expires,omitempty"`
+}
+
+// Usage describes the utilisation of an IPRange
+type Usage struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Range     string `json:"range"`
+	// Size is the number of addresses that can be allocated, the network address is excluded
+	Size int64 `json:"size"`
+	// Allocated is the number of allocated addresses, including the reserved ones
+	Allocated int `json:"allocated"`
+	// Reserved is the number of reservations pending to be committed
+	Reserved int `json:"reserved"`
+	// Free is the number of addresses that can still be allocated
+	Free int64 `json:"free"`
+	// Utilisation is the percentage of the range allocated
+	Utilisation float64 `json:"utilisation"`
+	// FreeBlocks is the number of contiguous blocks of free addresses
+	FreeBlocks int `json:"freeBlocks"`
+	// LargestFreeBlock is the size of the largest contiguous block of free addresses
+	LargestFreeBlock int64 `json:"largestFreeBlock"`
+	// Fragmentation is the percentage of the free addresses out of the largest free block,
+	// 0 means that all the free addresses are contiguous
+	Fragmentation float64 `json:"fragmentation"`
+	// Addresses allocated from the range with their owners
+	Addresses []Address `json:"addresses,omitempty"`
+}
+
+// Diff is the difference between the addresses of an IPRange and the ClusterIPs of the Services
+type Diff struct {
+	// Missing are the ClusterIPs of the range that are not allocated, mapped to the Service namespace/name
+	Missing map[string]string `json:"missing,omitempty"`
+	// Orphan are the allocated addresses that are not used by any Service nor reserved nor held
+	Orphan []string `json:"orphan,omitempty"`
+}
+
+// Empty returns true if the IPRange is in sync with the Services
+func (d *Diff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Orphan) == 0
+}
+
+// serviceIPs returns the ClusterIPs of the Services mapped to the Service namespace/name,
+// if several Services use the same address the first one in namespace/name order is used.
+func serviceIPs(services []v1.Service) map[string]string {
+	names := make([]string, 0, len(services))
+	byName := map[string]string{}
+	for _, svc := range services {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil {
+			continue
+		}
+		name := svc.Namespace + "/" + svc.Name
+		names = append(names, name)
+		byName[name] = ip.String()
+	}
+	sort.Strings(names)
+	owners := map[string]string{}
+	for _, name := range names {
+		if _, ok := owners[byName[name]]; !ok {
+			owners[byName[name]] = name
+		}
+	}
+	return owners
+}
+
+// Describe returns the utilisation of the IPRange and the Services that use its addresses
+func Describe(ipRange *clusteripv1.IPRange, services []v1.Service) (*Usage, error) {
+	_, cidr, err := net.ParseCIDR(ipRange.Spec.Range)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %v", ipRange.Spec.Range, err)
+	}
+	usage := &Usage{
+		Namespace: ipRange.Namespace,
+		Name:      ipRange.Name,
+		Range:     cidr.String(),
+		// the network address is never allocated
+		Size: utilnet.RangeSize(cidr) - 1,
+	}
+	if usage.Size < 0 {
+		usage.Size = 0
+	}
+
+	owners := serviceIPs(services)
+	reservations := ipRange.GetReservations()
+	var offsets []*big.Int
+	base := utilnet.BigForIP(cidr.IP)
+	for _, address := range sets.NewString(ipRange.Spec.Addresses...).List() {
+		ip := net.ParseIP(address)
+		if ip == nil || !cidr.Contains(ip) {
+			continue
+		}
+		allocated := Address{Address: ip.String(), Service: owners[ip.String()]}
+		if expires, ok := reservations[ip.String()]; ok {
+			allocated.Expires = expires.DeepCopy()
+			usage.Reserved++
+		}
+		usage.Addresses = append(usage.Addresses, allocated)
+		offsets = append(offsets, new(big.Int).Sub(utilnet.BigForIP(ip), base))
+	}
+	usage.Allocated = len(usage.Addresses)
+	usage.Free = usage.Size - int64(usage.Allocated)
+	if usage.Free < 0 {
+		usage.Free = 0
+	}
+	if usage.Size > 0 {
+		usage.Utilisation = 100 * float64(usage.Allocated) / float64(usage.Size)
+	}
+
+	// the free blocks are the gaps between the allocated addresses,
+	// the network address at offset 0 is never free
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Cmp(offsets[j]) < 0 })
+	ones, bits := cidr.Mask.Size()
+	last := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)), big.NewInt(1))
+	previous := big.NewInt(0)
+	for _, offset := range append(offsets, new(big.Int).Add(last, big.NewInt(1))) {
+		gap := new(big.Int).Sub(offset, previous)
+		gap.Sub(gap, big.NewInt(1))
+		if gap.Sign() > 0 {
+			usage.FreeBlocks++
+			size := int64(math.MaxInt64)
+			if gap.IsInt64() {
+				size = gap.Int64()
+			}
+			if size > usage.LargestFreeBlock {
+				usage.LargestFreeBlock = size
+			}
+		}
+		previous = offset
+	}
+	if usage.Free > 0 {
+		usage.Fragmentation = 100 * (1 - float64(usage.LargestFreeBlock)/float64(usage.Free))
+		if usage.Fragmentation < 0 {
+			usage.Fragmentation = 0
+		}
+	}
+	return usage, nil
+}
+
+// Check compares the addresses of the IPRange with the ClusterIPs of the Services that belong to the range
+func Check(ipRange *clusteripv1.IPRange, services []v1.Service) (*Diff, error) {
+	_, cidr, err := net.ParseCIDR(ipRange.Spec.Range)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %v", ipRange.Spec.Range, err)
+	}
+	addresses := sets.NewString()
+	for _, address := range ipRange.Spec.Addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			addresses.Insert(ip.String())
+		}
+	}
+	diff := &Diff{Missing: map[string]string{}}
+	svcIPs := sets.NewString()
+	for ip, svc := range serviceIPs(services) {
+		if !cidr.Contains(net.ParseIP(ip)) {
+			continue
+		}
+		svcIPs.Insert(ip)
+		if !addresses.Has(ip) {
+			diff.Missing[ip] = svc
+		}
+	}
+	// the reservations are waiting for the Service to be created
+	reserved := sets.StringKeySet(ipRange.GetReservations())
+	for _, reservation := range ipRange.Spec.StickyReservations {
+		reserved.Insert(reservation.Address)
+	}
+	diff.Orphan = addresses.Difference(svcIPs).Difference(reserved).List()
+	return diff, nil
+}
+
+// WhoHas returns the IPRanges namespace/name that contain the address and
+// the Services namespace/name that use it
+func WhoHas(ip net.IP, ranges []clusteripv1.IPRange, services []v1.Service) (allocatedBy []string, usedBy []string) {
+	for _, ipRange := range ranges {
+		for _, address := range ipRange.Spec.Addresses {
+			if ip.Equal(net.ParseIP(address)) {
+				allocatedBy = append(allocatedBy, ipRange.Namespace+"/"+ipRange.Name)
+				break
+			}
+		}
+	}
+	for _, svc := range services {
+		if ip.Equal(net.ParseIP(svc.Spec.ClusterIP)) {
+			usedBy = append(usedBy, svc.Namespace+"/"+svc.Name)
+		}
+	}
+	sort.Strings(allocatedBy)
+	sort.Strings(usedBy)
+	return allocatedBy, usedBy
+}
@@ -0,0 +1,101 @@
+package inspect
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+func newRange(cidr string, addresses ...string) *clusteripv1.IPRange {
+	return &clusteripv1.IPRange{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "allocator"},
+		Spec:       clusteripv1.IPRangeSpec{Range: cidr, Addresses: addresses},
+	}
+}
+
+func newService(name, clusterIP string) v1.Service {
+	return v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       v1.ServiceSpec{ClusterIP: clusterIP},
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	ipRange := newRange("10.0.0.0/28", "10.0.0.1", "10.0.0.2", "10.0.0.8", "10.0.0.15")
+	ipRange.SetReservations(map[string]metav1.Time{"10.0.0.8": metav1.NewTime(time.Now().Add(time.Minute))})
+	usage, err := Describe(ipRange, []v1.Service{newService("a", "10.0.0.1"), newService("b", "10.0.0.2")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if usage.Size != 15 || usage.Allocated != 4 || usage.Reserved != 1 || usage.Free != 11 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	// free blocks 10.0.0.3-7 and 10.0.0.9-14
+	if usage.FreeBlocks != 2 || usage.LargestFreeBlock != 6 {
+		t.Fatalf("expected 2 free blocks and the largest of 6, got %d and %d", usage.FreeBlocks, usage.LargestFreeBlock)
+	}
+	if usage.Fragmentation <= 0 {
+		t.Fatalf("expected the range to be fragmented")
+	}
+	owners := map[string]string{}
+	for _, address := range usage.Addresses {
+		owners[address.Address] = address.Service
+		if (address.Expires != nil) != (address.Address == "10.0.0.8") {
+			t.Fatalf("unexpected reservation for %s", address.Address)
+		}
+	}
+	if owners["10.0.0.1"] != "default/a" || owners["10.0.0.2"] != "default/b" || owners["10.0.0.15"] != "" {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+
+	// an empty range has one free block without the network address
+	usage, err = Describe(newRange("2001:db2::/64"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if usage.FreeBlocks != 1 || usage.Fragmentation != 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ipRange := newRange("10.0.0.0/24", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.5")
+	ipRange.SetReservations(map[string]metav1.Time{"10.0.0.3": metav1.NewTime(time.Now().Add(time.Minute))})
+	// the address is held for a deleted Service
+	ipRange.Spec.StickyReservations = []clusteripv1.StickyReservation{{Address: "10.0.0.5", Namespace: "default", Name: "d"}}
+	diff, err := Check(ipRange, []v1.Service{
+		newService("a", "10.0.0.1"),
+		newService("b", "10.0.0.4"),
+		newService("c", "10.0.1.1"),
+		newService("headless", v1.ClusterIPNone),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(diff.Missing) != 1 || diff.Missing["10.0.0.4"] != "default/b" {
+		t.Fatalf("unexpected missing addresses %v", diff.Missing)
+	}
+	if len(diff.Orphan) != 1 || diff.Orphan[0] != "10.0.0.2" {
+		t.Fatalf("unexpected orphan addresses %v", diff.Orphan)
+	}
+	if diff.Empty() {
+		t.Fatalf("expected differences")
+	}
+}
+
+func TestWhoHas(t *testing.T) {
+	ranges := []clusteripv1.IPRange{*newRange("10.0.0.0/24", "10.0.0.1")}
+	allocatedBy, usedBy := WhoHas(net.ParseIP("10.0.0.1"), ranges, []v1.Service{newService("a", "10.0.0.1"), newService("b", "10.0.0.2")})
+	if len(allocatedBy) != 1 || allocatedBy[0] != "kube-system/allocator" || len(usedBy) != 1 || usedBy[0] != "default/a" {
+		t.Fatalf("unexpected result %v %v", allocatedBy, usedBy)
+	}
+	allocatedBy, usedBy = WhoHas(net.ParseIP("10.0.0.3"), ranges, nil)
+	if len(allocatedBy) != 0 || len(usedBy) != 0 {
+		t.Fatalf("unexpected result %v %v", allocatedBy, usedBy)
+	}
+}
@@ -0,0 +1,150 @@
+// Package migrate seeds the IPRanges from the ClusterIPs allocated by the apiserver
+// built-in allocator, so the Services range configuration can be moved out of the apiserver.
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilnet "k8s.io/utils/net"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+)
+
+// Conflict is a Service ClusterIP that can not be migrated
+type Conflict struct {
+	// Service namespace/name
+	Service   string `json:"service"`
+	ClusterIP string `json:"clusterIP"`
+	Reason    string `json:"reason"`
+}
+
+// Range is an IPRange to create with its addresses pre-allocated
+type Range struct {
+	Key       client.ObjectKey
+	CIDR      *net.IPNet
+	Addresses sets.String
+}
+
+// Plan contains the IPRanges to create and the ClusterIPs that can not be migrated
+type Plan struct {
+	Ranges    []*Range
+	Conflicts []Conflict
+}
+
+// NewPlan assigns the ClusterIPs of the Services to the range that contains them, the first range
+// is stored in the namespace/name IPRange and the others in namespace/name-<family>, i.e. allocator-ipv6.
+func NewPlan(key client.ObjectKey, cidrs []*net.IPNet, services []v1.Service) (*Plan, error) {
+	plan := &Plan{}
+	for i, cidr := range cidrs {
+		for _, other := range plan.Ranges {
+			if utilnet.IsIPv6CIDR(cidr) == utilnet.IsIPv6CIDR(other.CIDR) {
+				return nil, fmt.Errorf("only one range per IP family is supported: %s and %s", other.CIDR, cidr)
+			}
+		}
+		rangeKey := key
+		if i > 0 {
+			family := "ipv4"
+			if utilnet.IsIPv6CIDR(cidr) {
+				family = "ipv6"
+			}
+			rangeKey.Name = key.Name + "-" + family
+		}
+		plan.Ranges = append(plan.Ranges, &Range{Key: rangeKey, CIDR: cidr, Addresses: sets.NewString()})
+	}
+
+	// process the Services in order so the reported conflicts are stable
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Namespace+"/"+services[i].Name < services[j].Namespace+"/"+services[j].Name
+	})
+	owners := map[string]string{}
+	for _, svc := range services {
+		// the apiserver only supports one ClusterIP per Service
+		clusterIP := svc.Spec.ClusterIP
+		if clusterIP == "" || clusterIP == v1.ClusterIPNone {
+			continue
+		}
+		name := svc.Namespace + "/" + svc.Name
+		conflict := func(reason string) {
+			plan.Conflicts = append(plan.Conflicts, Conflict{Service: name, ClusterIP: clusterIP, Reason: reason})
+		}
+		ip := net.ParseIP(clusterIP)
+		if ip == nil {
+			conflict("invalid IP address")
+			continue
+		}
+		if owner, ok := owners[ip.String()]; ok {
+			conflict("already allocated to Service " + owner)
+			continue
+		}
+		owners[ip.String()] = name
+		r := plan.rangeFor(ip)
+		if r == nil {
+			conflict(allocator.ErrNotInRange.Error())
+			continue
+		}
+		if ip.Equal(r.CIDR.IP) {
+			conflict(allocator.ErrReserved.Error())
+			continue
+		}
+		r.Addresses.Insert(ip.String())
+	}
+	return plan, nil
+}
+
+// rangeFor returns the range that contains the address
+func (p *Plan) rangeFor(ip net.IP) *Range {
+	for _, r := range p.Ranges {
+		if r.CIDR.Contains(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Apply creates the IPRanges of the plan and allocates their addresses,
+// the addresses are added to the IPRanges that already exist.
+func (p *Plan) Apply(ctx context.Context, c client.Client) error {
+	for _, r := range p.Ranges {
+		// the addresses can not be allocated on creation
+		ipRange := &clusteripv1.IPRange{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: r.Key.Namespace,
+				Name:      r.Key.Name,
+			},
+			Spec: clusteripv1.IPRangeSpec{
+				Range: r.CIDR.String(),
+			},
+		}
+		if err := c.Create(ctx, ipRange); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("unable to create IPRange %s: %v", r.Key, err)
+		}
+		existing := allocator.NewIPRangeAllocator(r.Key, c, c)
+		snapshot, err := existing.Snapshot()
+		if err != nil {
+			return fmt.Errorf("unable to read IPRange %s: %v", r.Key, err)
+		}
+		if snapshot.Range != r.CIDR.String() {
+			return fmt.Errorf("IPRange %s already exists with range %s: %w", r.Key, snapshot.Range, allocator.ErrMismatchedNetwork)
+		}
+		var ips []net.IP
+		for _, address := range r.Addresses.Difference(sets.NewString(snapshot.Addresses...)).List() {
+			ips = append(ips, net.ParseIP(address))
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		if err := existing.AllocateMany(ips); err != nil {
+			return fmt.Errorf("unable to allocate the addresses of IPRange %s: %v", r.Key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+)
+
+func newService(name, clusterIP string) v1.Service {
+	return v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       v1.ServiceSpec{ClusterIP: clusterIP},
+	}
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		result = append(result, subnet)
+	}
+	return result
+}
+
+func TestNewPlan(t *testing.T) {
+	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
+	plan, err := NewPlan(key, parseCIDRs("10.96.0.0/24", "2001:db2::/120"), []v1.Service{
+		newService("a", "10.96.0.1"),
+		newService("b", "2001:db2::1"),
+		newService("c", "10.96.0.1"),
+		newService("d", "10.97.0.1"),
+		newService("e", "10.96.0.0"),
+		newService("headless", v1.ClusterIPNone),
+		newService("external", ""),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(plan.Ranges) != 2 {
+		t.Fatalf("expected 2 ranges, got %d", len(plan.Ranges))
+	}
+	if plan.Ranges[0].Key != key || plan.Ranges[1].Key.Name != "allocator-ipv6" {
+		t.Fatalf("unexpected range names %v %v", plan.Ranges[0].Key, plan.Ranges[1].Key)
+	}
+	if !plan.Ranges[0].Addresses.Equal(setOf("10.96.0.1")) || !plan.Ranges[1].Addresses.Equal(setOf("2001:db2::1")) {
+		t.Fatalf("unexpected addresses %v %v", plan.Ranges[0].Addresses.List(), plan.Ranges[1].Addresses.List())
+	}
+	expected := []string{"default/c", "default/d", "default/e"}
+	if len(plan.Conflicts) != len(expected) {
+		t.Fatalf("expected conflicts for %v, got %v", expected, plan.Conflicts)
+	}
+	for i := range expected {
+		if plan.Conflicts[i].Service != expected[i] {
+			t.Fatalf("expected conflicts for %v, got %v", expected, plan.Conflicts)
+		}
+	}
+
+	if _, err := NewPlan(key, parseCIDRs("10.96.0.0/24", "10.97.0.0/24"), nil); err == nil {
+		t.Fatalf("expected error for two ranges of the same family")
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	existing := &clusteripv1.IPRange{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "allocator"},
+		Spec:       clusteripv1.IPRangeSpec{Range: "10.96.0.0/24", Addresses: []string{"10.96.0.1"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing).Build()
+
+	key := client.ObjectKey{Namespace: "kube-system", Name: "allocator"}
+	plan, err := NewPlan(key, parseCIDRs("10.96.0.0/24", "2001:db2::/120"), []v1.Service{
+		newService("a", "10.96.0.1"),
+		newService("b", "10.96.0.2"),
+		newService("c", "2001:db2::1"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plan.Apply(ctx, c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, expected := range map[string][]string{
+		"allocator":      {"10.96.0.1", "10.96.0.2"},
+		"allocator-ipv6": {"2001:db2::1"},
+	} {
+		ipRange := &clusteripv1.IPRange{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "kube-system", Name: name}, ipRange); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !setOf(ipRange.Spec.Addresses...).Equal(setOf(expected...)) {
+			t.Fatalf("IPRange %s expected addresses %v, got %v", name, expected, ipRange.Spec.Addresses)
+		}
+	}
+
+	// the existing IPRange has a different range
+	plan, err = NewPlan(key, parseCIDRs("10.97.0.0/24"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plan.Apply(ctx, c); err == nil {
+		t.Fatalf("expected error for a mismatched range")
+	}
+}
+
+func setOf(items ...string) sets.String {
+	return sets.NewString(items...)
+}
@@ -0,0 +1,445 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+)
+
+// ServicePath is the path where the Service webhook is served
+const ServicePath = "/mutate-v1-service"
+
+// Event reasons emitted on the IPRange by the Service webhook.
+const (
+	ReasonAddressReserved = "AddressReserved"
+	ReasonIPRangeFull     = "IPRangeFull"
+)
+
+var (
+	// ErrNamespaceNotAllowed is returned when the namespace policy of the range
+	// does not allow the Service namespace to allocate addresses from it
+	ErrNamespaceNotAllowed = errors.New("namespace is not allowed to allocate addresses from the range")
+	// ErrQuotaExceeded is returned when the Service namespace holds all the addresses of the range its quota allows
+	ErrQuotaExceeded = allocator.ErrQuotaExceeded
+)
+
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+
+// +kubebuilder:webhook:path=/mutate-v1-service,mutating=true,failurePolicy=fail,groups="",resources=services,verbs=create;update,versions=v1,name=mservice.kb.io
+
+// ServiceAllocator reserves the ClusterIP of the Services, the reservation is
+// committed by the Service controller once the Service exists, if the Service
+// is not created the reservation expires and the address is released.
+//
+// If Allocator is not set the address is reserved from the IPRanges that select the Service,
+// in priority order, falling back to the next IPRange if a range has no free addresses.
+type ServiceAllocator struct {
+	// Allocator is the only range used by the Services, the IPRanges are ignored if it is set
+	Allocator allocator.ReservationInterface
+	// Client updates the IPRanges that the addresses are reserved from
+	Client client.Client
+	// TTL is the time an address is reserved before it is committed
+	TTL time.Duration
+	Log logr.Logger
+	// Recorder emits the events on the object that stores the range,
+	// the Service may not exist yet so the events are not emitted on it.
+	Recorder record.EventRecorder
+	// Reader lists the IPRanges and gets the Namespaces of the Services to match the namespace selector
+	// of the range
+	Reader  client.Reader
+	decoder *admission.Decoder
+}
+
+// objectGetter is implemented by the allocators stored in an API object
+type objectGetter interface {
+	Object() (client.Object, error)
+}
+
+// namespacePolicy is implemented by the objects that restrict the namespaces
+// that can allocate addresses from the range
+type namespacePolicy interface {
+	HasNamespacePolicy() bool
+	AllowsNamespace(namespace string, labels map[string]string) (bool, error)
+}
+
+// namespaceQuota is implemented by the objects that limit the addresses of the range
+// that the Services of a namespace can hold
+type namespaceQuota interface {
+	QuotaFor(namespace string) (int64, bool)
+	NamespaceAddresses(namespace string) int64
+}
+
+// stickyReservations is implemented by the objects that hold addresses for the Services
+// with a given namespace and name
+type stickyReservations interface {
+	StickyAddress(namespace, name string) (string, bool)
+}
+
+var _ admission.Handler = &ServiceAllocator{}
+var _ admission.DecoderInjector = &ServiceAllocator{}
+
+// SetupWithManager registers the Service webhook in the manager webhook server
+func (a *ServiceAllocator) SetupWithManager(mgr ctrl.Manager) {
+	mgr.GetWebhookServer().Register(ServicePath, &webhook.Admission{Handler: a})
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (a *ServiceAllocator) InjectDecoder(d *admission.Decoder) error {
+	a.decoder = d
+	return nil
+}
+
+// Handle reserves the ClusterIP of the Services that need one.
+// Dry-run requests never persist the reservation.
+func (a *ServiceAllocator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := a.Log.WithValues("service", req.Namespace+"/"+req.Name, "operation", req.Operation)
+
+	svc := &v1.Service{}
+	if err := a.decoder.Decode(req, svc); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !needsClusterIP(svc) {
+		return admission.Allowed("")
+	}
+	if req.Operation == admissionv1.Update {
+		old := &v1.Service{}
+		if err := a.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		// the ClusterIP is immutable once it is allocated
+		if needsClusterIP(old) {
+			return admission.Allowed("")
+		}
+	}
+
+	ranges, err := a.ranges(ctx, svc)
+	if err != nil {
+		return toResponse(err)
+	}
+
+	dryRun := req.DryRun != nil && *req.DryRun
+	if svc.Spec.ClusterIP != "" {
+		ip := net.ParseIP(svc.Spec.ClusterIP)
+		if ip == nil {
+			// the apiserver validates the Service
+			return admission.Allowed("")
+		}
+		// the address is reserved from the range with the highest priority that contains it,
+		// unless an overlapping range already allocates it
+		var r allocator.ReservationInterface
+		for _, candidate := range ranges {
+			if cidr := candidate.CIDR(); !cidr.Contains(ip) {
+				continue
+			}
+			if r == nil {
+				r = candidate
+			} else if candidate.Has(ip) {
+				return toResponse(allocator.ErrAllocated)
+			}
+		}
+		if r == nil {
+			return toResponse(allocator.ErrNotInRange)
+		}
+		obj, err := rangeObject(r)
+		if err != nil {
+			return toResponse(err)
+		}
+		// the address held by the sticky reservation of the Service is already allocated
+		if ip.Equal(stickyAddress(obj, req.Namespace, req.Name)) {
+			if dryRun {
+				return admission.Allowed("")
+			}
+			if _, err := a.reserveSticky(r, req.Namespace, req.Name); err != nil {
+				return toResponse(err)
+			}
+			log.Info("reserved sticky address", "ip", ip)
+			a.eventf(obj, v1.EventTypeNormal, ReasonAddressReserved, "Sticky address %s reserved for Service %s/%s", ip, req.Namespace, req.Name)
+			return admission.Allowed("")
+		}
+		if err := CheckNamespace(ctx, a.Reader, obj, req.Namespace); err != nil {
+			return toResponse(err)
+		}
+		if dryRun {
+			if r.Has(ip) {
+				return toResponse(allocator.ErrAllocated)
+			}
+			return admission.Allowed("")
+		}
+		if err := a.reserve(r, ip, req.Namespace); err != nil {
+			return toResponse(err)
+		}
+		log.Info("reserved address", "ip", ip)
+		a.eventf(obj, v1.EventTypeNormal, ReasonAddressReserved, "Address %s reserved for Service %s/%s", ip, req.Namespace, req.Name)
+		return admission.Allowed("")
+	}
+
+	// the objects that store the ranges are read once per request
+	objects := make([]client.Object, len(ranges))
+	objectErrs := make([]error, len(ranges))
+	for i, r := range ranges {
+		objects[i], objectErrs[i] = rangeObject(r)
+	}
+
+	// a recreated Service gets back the address held by its sticky reservation
+	for i, r := range ranges {
+		if stickyAddress(objects[i], req.Namespace, req.Name) == nil {
+			continue
+		}
+		if dryRun {
+			return admission.Allowed("")
+		}
+		ip, err := a.reserveSticky(r, req.Namespace, req.Name)
+		if err != nil {
+			return toResponse(err)
+		}
+		// the reservation was removed
+		if ip == nil {
+			continue
+		}
+		log.Info("reserved sticky address", "ip", ip)
+		a.eventf(objects[i], v1.EventTypeNormal, ReasonAddressReserved, "Sticky address %s reserved for Service %s/%s", ip, req.Namespace, req.Name)
+		return a.patchClusterIP(req, svc, r, ip)
+	}
+
+	// try the ranges in priority order, the last error is returned if none can allocate the address
+	for i, r := range ranges {
+		err = objectErrs[i]
+		if err == nil {
+			err = CheckNamespace(ctx, a.Reader, objects[i], req.Namespace)
+		}
+		if err != nil {
+			cidr := r.CIDR()
+			log.V(1).Info("range not usable", "range", cidr.String(), "reason", err.Error())
+			continue
+		}
+		// the apiserver allocates an address that is not persisted
+		if dryRun {
+			return admission.Allowed("")
+		}
+		var ip net.IP
+		ip, err = a.reserveNext(r, req.Namespace)
+		if errors.Is(err, allocator.ErrFull) {
+			a.eventf(objects[i], v1.EventTypeWarning, ReasonIPRangeFull, "No free addresses for Service %s/%s", req.Namespace, req.Name)
+			continue
+		}
+		// other Service of the namespace reserved an address since the quota was checked
+		if errors.Is(err, allocator.ErrQuotaExceeded) {
+			continue
+		}
+		if err != nil {
+			return toResponse(err)
+		}
+		log.Info("reserved address", "ip", ip)
+		a.eventf(objects[i], v1.EventTypeNormal, ReasonAddressReserved, "Address %s reserved for Service %s/%s", ip, req.Namespace, req.Name)
+		return a.patchClusterIP(req, svc, r, ip)
+	}
+	return toResponse(err)
+}
+
+// patchClusterIP sets the reserved address as the ClusterIP of the Service,
+// the reservation is aborted if the Service can not be patched
+func (a *ServiceAllocator) patchClusterIP(req admission.Request, svc *v1.Service, r allocator.ReservationInterface, ip net.IP) admission.Response {
+	svc.Spec.ClusterIP = ip.String()
+	marshaled, err := json.Marshal(svc)
+	if err != nil {
+		if err := r.Abort(ip); err != nil {
+			a.Log.Error(err, "unable to abort reservation", "ip", ip)
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// rangeObject returns the object that stores the range, it is nil if the allocator has none
+func rangeObject(r allocator.ReservationInterface) (client.Object, error) {
+	getter, ok := r.(objectGetter)
+	if !ok {
+		return nil, nil
+	}
+	return getter.Object()
+}
+
+// reserve reserves the address for a Service of the namespace, the allocators that support it
+// check the quota of the namespace in the same write that reserves the address
+func (a *ServiceAllocator) reserve(r allocator.ReservationInterface, ip net.IP, namespace string) error {
+	if quota, ok := r.(allocator.NamespaceInterface); ok {
+		return quota.ReserveForNamespace(ip, namespace, a.TTL)
+	}
+	return r.Reserve(ip, a.TTL)
+}
+
+// reserveNext reserves a free address for a Service of the namespace, the allocators that support
+// it check the quota of the namespace in the same write that reserves the address
+func (a *ServiceAllocator) reserveNext(r allocator.ReservationInterface, namespace string) (net.IP, error) {
+	if quota, ok := r.(allocator.NamespaceInterface); ok {
+		return quota.ReserveNextForNamespace(namespace, a.TTL)
+	}
+	return r.ReserveNext(a.TTL)
+}
+
+// stickyAddress returns the address of the range held by the sticky reservation of the Service,
+// it is nil if the Service has none
+func stickyAddress(obj client.Object, namespace, name string) net.IP {
+	// the Services created with generateName have no name yet
+	if name == "" {
+		return nil
+	}
+	sticky, ok := obj.(stickyReservations)
+	if !ok {
+		return nil
+	}
+	address, ok := sticky.StickyAddress(namespace, name)
+	if !ok {
+		return nil
+	}
+	return net.ParseIP(address)
+}
+
+// reserveSticky extends the sticky reservation of the Service, so the address is not released
+// before the Service is created, and returns the address
+func (a *ServiceAllocator) reserveSticky(r allocator.ReservationInterface, namespace, name string) (net.IP, error) {
+	sticky, ok := r.(allocator.StickyInterface)
+	if !ok {
+		return nil, nil
+	}
+	return sticky.ReserveSticky(namespace, name, a.TTL)
+}
+
+// ranges returns the allocators the Service can reserve its address from, sorted by priority
+func (a *ServiceAllocator) ranges(ctx context.Context, svc *v1.Service) ([]allocator.ReservationInterface, error) {
+	if a.Allocator != nil {
+		return []allocator.ReservationInterface{a.Allocator}, nil
+	}
+	var rangeList clusteripv1.IPRangeList
+	if err := a.Reader.List(ctx, &rangeList); err != nil {
+		return nil, fmt.Errorf("%w: unable to list IPRanges: %v", allocator.ErrTransient, err)
+	}
+	var ranges []allocator.ReservationInterface
+	for _, ipRange := range SelectRanges(rangeList.Items, svc, a.Log) {
+		ranges = append(ranges, allocator.NewIPRangeAllocator(client.ObjectKeyFromObject(ipRange), a.Client, a.Reader))
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%w: no IPRange selects the Service", allocator.ErrRangeNotFound)
+	}
+	return ranges, nil
+}
+
+// SelectRanges returns the IPRanges of the list the Service can allocate its address from, sorted
+// by priority. The IPRanges being deleted and the IPRanges that don't select the Service are skipped.
+// The list is sorted in place.
+func SelectRanges(ipRanges []clusteripv1.IPRange, svc *v1.Service, log logr.Logger) []*clusteripv1.IPRange {
+	sort.Sort(clusteripv1.ByPriority(ipRanges))
+	var selected []*clusteripv1.IPRange
+	for i := range ipRanges {
+		ipRange := &ipRanges[i]
+		// the ranges being deleted do not allocate new addresses
+		if !ipRange.DeletionTimestamp.IsZero() {
+			continue
+		}
+		ok, err := ipRange.SelectsService(svc.Labels)
+		if err != nil {
+			// the selector is validated by the IPRange webhook
+			log.Error(err, "invalid service selector", "iprange", ipRange.Namespace+"/"+ipRange.Name)
+			continue
+		}
+		if ok {
+			selected = append(selected, ipRange)
+		}
+	}
+	return selected
+}
+
+// CheckNamespace returns an error if the Services of the namespace can not allocate addresses
+// from the range stored in obj, because of the namespace policy or the namespace quota of the range.
+// The reader gets the labels of the namespace, they are empty if it is nil.
+func CheckNamespace(ctx context.Context, reader client.Reader, obj client.Object, namespace string) error {
+	if policy, ok := obj.(namespacePolicy); ok && policy.HasNamespacePolicy() {
+		var nsLabels map[string]string
+		if reader != nil {
+			ns := &v1.Namespace{}
+			if err := reader.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+				return fmt.Errorf("unable to get namespace %s: %v", namespace, err)
+			}
+			nsLabels = ns.Labels
+		}
+		allowed, err := policy.AllowsNamespace(namespace, nsLabels)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("%w: namespace %s, IPRange %s/%s", ErrNamespaceNotAllowed, namespace, obj.GetNamespace(), obj.GetName())
+		}
+	}
+	// the quota is checked again by the allocator when the address is reserved
+	if quota, ok := obj.(namespaceQuota); ok {
+		limit, limited := quota.QuotaFor(namespace)
+		if !limited {
+			return nil
+		}
+		if allocated := quota.NamespaceAddresses(namespace); allocated >= limit {
+			return fmt.Errorf("%w: namespace %s holds %d addresses of IPRange %s/%s, the quota is %d",
+				ErrQuotaExceeded, namespace, allocated, obj.GetNamespace(), obj.GetName(), limit)
+		}
+	}
+	return nil
+}
+
+// eventf emits an event on the object that stores the range, if the allocator has one
+func (a *ServiceAllocator) eventf(obj client.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if obj == nil || a.Recorder == nil {
+		return
+	}
+	a.Recorder.Eventf(obj, eventType, reason, messageFmt, args...)
+}
+
+// needsClusterIP returns true if the Service is allocated a ClusterIP
+func needsClusterIP(svc *v1.Service) bool {
+	return svc.Spec.Type != v1.ServiceTypeExternalName && svc.Spec.ClusterIP != v1.ClusterIPNone
+}
+
+// toResponse rejects the request with the status code that corresponds to the allocator error
+func toResponse(err error) admission.Response {
+	var code int32
+	var reason metav1.StatusReason
+	switch {
+	case errors.Is(err, allocator.ErrAllocated):
+		code, reason = http.StatusConflict, metav1.StatusReasonConflict
+	case errors.Is(err, allocator.ErrMismatchedNetwork), errors.Is(err, allocator.ErrReserved):
+		code, reason = http.StatusUnprocessableEntity, metav1.StatusReasonInvalid
+	case errors.Is(err, allocator.ErrFull), errors.Is(err, ErrNamespaceNotAllowed), errors.Is(err, ErrQuotaExceeded),
+		errors.Is(err, allocator.ErrRangeNotFound):
+		code, reason = http.StatusForbidden, metav1.StatusReasonForbidden
+	case allocator.IsTransient(err):
+		code, reason = http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable
+	default:
+		code, reason = http.StatusInternalServerError, metav1.StatusReasonInternalError
+	}
+	return admission.Response{
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Code:    code,
+				Reason:  reason,
+				Message: err.Error(),
+			},
+		},
+	}
+}
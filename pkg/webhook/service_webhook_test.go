@@ -0,0 +1,431 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	clusteripv1 "github.com/aojea/clusterip-webhook/api/v1"
+	"github.com/aojea/clusterip-webhook/pkg/allocator"
+)
+
+func newIPRange() *clusteripv1.IPRange {
+	return &clusteripv1.IPRange{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "allocator"},
+		Spec:       clusteripv1.IPRangeSpec{Range: "10.96.0.0/28"},
+	}
+}
+
+func newServiceAllocator(t *testing.T) (*ServiceAllocator, *allocator.Range) {
+	return newServiceAllocatorWithObjects(t, newIPRange())
+}
+
+// newServiceAllocatorWithObjects returns a ServiceAllocator over the IPRange, the objects are added to the client
+func newServiceAllocatorWithObjects(t *testing.T, ipRange *clusteripv1.IPRange, objs ...client.Object) (*ServiceAllocator, *allocator.Range) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(clusteripv1.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(objs, ipRange)...).Build()
+	r := allocator.NewIPRangeAllocator(client.ObjectKeyFromObject(ipRange), c, c)
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := &ServiceAllocator{
+		Allocator: r,
+		TTL:       time.Minute,
+		Log:       ctrl.Log.WithName("test"),
+		Recorder:  record.NewFakeRecorder(100),
+		Reader:    c,
+	}
+	if err := a.InjectDecoder(decoder); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return a, r
+}
+
+func newRequest(t *testing.T, operation admissionv1.Operation, dryRun bool, svc, old *v1.Service) admission.Request {
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: operation,
+		Namespace: svc.Namespace,
+		Name:      svc.Name,
+		DryRun:    &dryRun,
+	}}
+	raw, err := json.Marshal(svc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req.Object.Raw = raw
+	if old != nil {
+		if req.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return req
+}
+
+func newService(clusterIP string, svcType v1.ServiceType) *v1.Service {
+	return &v1.Service{
+		TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec:       v1.ServiceSpec{ClusterIP: clusterIP, Type: svcType},
+	}
+}
+
+func TestServiceAllocatorClusterIP(t *testing.T) {
+	a, r := newServiceAllocator(t)
+	ctx := context.Background()
+	ip := net.ParseIP("10.96.0.2")
+
+	// dry-run requests do not reserve the address
+	resp := a.Handle(ctx, newRequest(t, admissionv1.Create, true, newService(ip.String(), v1.ServiceTypeClusterIP), nil))
+	if !resp.Allowed || r.Has(ip) {
+		t.Fatalf("expected dry-run to be allowed without reserving, got %v", resp.Result)
+	}
+	resp = a.Handle(ctx, newRequest(t, admissionv1.Create, false, newService(ip.String(), v1.ServiceTypeClusterIP), nil))
+	if !resp.Allowed || !r.Has(ip) {
+		t.Fatalf("expected %s to be reserved, got %v", ip, resp.Result)
+	}
+	// the address is already allocated
+	for _, dryRun := range []bool{true, false} {
+		resp = a.Handle(ctx, newRequest(t, admissionv1.Create, dryRun, newService(ip.String(), v1.ServiceTypeClusterIP), nil))
+		if resp.Allowed {
+			t.Fatalf("expected the request to be denied, dry-run %v", dryRun)
+		}
+	}
+	// the address does not belong to the range
+	resp = a.Handle(ctx, newRequest(t, admissionv1.Create, false, newService("10.96.1.2", v1.ServiceTypeClusterIP), nil))
+	if resp.Allowed {
+		t.Fatalf("expected the request to be denied")
+	}
+}
+
+func TestServiceAllocatorNext(t *testing.T) {
+	a, r := newServiceAllocator(t)
+	ctx := context.Background()
+
+	resp := a.Handle(ctx, newRequest(t, admissionv1.Create, true, newService("", v1.ServiceTypeClusterIP), nil))
+	if !resp.Allowed || len(resp.Patches) != 0 {
+		t.Fatalf("expected dry-run to be allowed without patches, got %v %v", resp.Result, resp.Patches)
+	}
+	resp = a.Handle(ctx, newRequest(t, admissionv1.Create, false, newService("", v1.ServiceTypeClusterIP), nil))
+	if !resp.Allowed || len(resp.Patches) != 1 || resp.Patches[0].Path != "/spec/clusterIP" {
+		t.Fatalf("expected the ClusterIP to be patched, got %v %v", resp.Result, resp.Patches)
+	}
+	ip := net.ParseIP(resp.Patches[0].Value.(string))
+	if !r.Has(ip) {
+		t.Fatalf("expected %s to be reserved", ip)
+	}
+
+	// Services without ClusterIP are not allocated
+	for _, svc := range []*v1.Service{newService("", v1.ServiceTypeExternalName), newService(v1.ClusterIPNone, v1.ServiceTypeClusterIP)} {
+		resp = a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+		if !resp.Allowed || len(resp.Patches) != 0 {
+			t.Fatalf("expected no allocation, got %v %v", resp.Result, resp.Patches)
+		}
+	}
+
+	// ExternalName Services updated to ClusterIP are allocated
+	resp = a.Handle(ctx, newRequest(t, admissionv1.Update, false, newService("", v1.ServiceTypeClusterIP), newService("", v1.ServiceTypeExternalName)))
+	if !resp.Allowed || len(resp.Patches) != 1 {
+		t.Fatalf("expected the ClusterIP to be patched, got %v %v", resp.Result, resp.Patches)
+	}
+	// the ClusterIP of the Services is immutable
+	resp = a.Handle(ctx, newRequest(t, admissionv1.Update, false, newService(ip.String(), v1.ServiceTypeClusterIP), newService(ip.String(), v1.ServiceTypeClusterIP)))
+	if !resp.Allowed || len(resp.Patches) != 0 {
+		t.Fatalf("expected no allocation, got %v %v", resp.Result, resp.Patches)
+	}
+}
+
+func TestServiceAllocatorEvents(t *testing.T) {
+	a, _ := newServiceAllocator(t)
+	ctx := context.Background()
+	recorder := a.Recorder.(*record.FakeRecorder)
+
+	// the range has 15 addresses without the network address
+	for i := 0; i < 15; i++ {
+		resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, newService("", v1.ServiceTypeClusterIP), nil))
+		if !resp.Allowed {
+			t.Fatalf("expected the request to be allowed, got %v", resp.Result)
+		}
+		if event := <-recorder.Events; !strings.HasPrefix(event, "Normal "+ReasonAddressReserved) {
+			t.Fatalf("unexpected event %q", event)
+		}
+	}
+	resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, newService("", v1.ServiceTypeClusterIP), nil))
+	if resp.Allowed {
+		t.Fatalf("expected the request to be denied")
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning "+ReasonIPRangeFull) {
+		t.Fatalf("unexpected event %q", event)
+	}
+	// dry-run requests don't emit events
+	a.Handle(ctx, newRequest(t, admissionv1.Create, true, newService("10.96.0.1", v1.ServiceTypeClusterIP), nil))
+	if len(recorder.Events) != 0 {
+		t.Fatalf("unexpected event %q", <-recorder.Events)
+	}
+}
+
+func TestServiceAllocatorSelectors(t *testing.T) {
+	web := &clusteripv1.IPRange{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "web"},
+		Spec: clusteripv1.IPRangeSpec{
+			Range:           "10.97.0.0/30",
+			Priority:        10,
+			ServiceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+	}
+	a, _ := newServiceAllocatorWithObjects(t, newIPRange(), web)
+	// the Services allocate from the IPRanges that select them
+	a.Allocator = nil
+	a.Client = a.Reader.(client.Client)
+	ctx := context.Background()
+	recorder := a.Recorder.(*record.FakeRecorder)
+	_, webCIDR, _ := net.ParseCIDR(web.Spec.Range)
+
+	svc := newService("", v1.ServiceTypeClusterIP)
+	svc.Labels = map[string]string{"app": "web"}
+	// the web range has 3 addresses without the network address
+	for i := 0; i < 4; i++ {
+		resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+		if !resp.Allowed || len(resp.Patches) != 1 {
+			t.Fatalf("expected the ClusterIP to be patched, got %v %v", resp.Result, resp.Patches)
+		}
+		ip := net.ParseIP(resp.Patches[0].Value.(string))
+		if webCIDR.Contains(ip) != (i < 3) {
+			t.Fatalf("unexpected address %s for Service %d", ip, i)
+		}
+	}
+	// the full range is skipped
+	full := false
+	for len(recorder.Events) > 0 {
+		if strings.HasPrefix(<-recorder.Events, "Warning "+ReasonIPRangeFull) {
+			full = true
+		}
+	}
+	if !full {
+		t.Fatalf("expected an %s event", ReasonIPRangeFull)
+	}
+
+	// the Services not selected by the web range allocate from the default range
+	svc.Labels = nil
+	resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+	if !resp.Allowed || len(resp.Patches) != 1 || webCIDR.Contains(net.ParseIP(resp.Patches[0].Value.(string))) {
+		t.Fatalf("expected an address of the default range, got %v %v", resp.Result, resp.Patches)
+	}
+	// and can not request the addresses of the web range
+	svc.Spec.ClusterIP = "10.97.0.2"
+	resp = a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+	if resp.Allowed {
+		t.Fatalf("expected the request to be denied")
+	}
+}
+
+func TestServiceAllocatorNoRange(t *testing.T) {
+	ipRange := newIPRange()
+	ipRange.Spec.ServiceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	a, _ := newServiceAllocatorWithObjects(t, ipRange)
+	a.Allocator = nil
+	a.Client = a.Reader.(client.Client)
+
+	resp := a.Handle(context.Background(), newRequest(t, admissionv1.Create, false, newService("", v1.ServiceTypeClusterIP), nil))
+	if resp.Allowed || resp.Result.Code != http.StatusForbidden {
+		t.Fatalf("expected the request to be denied, got %v", resp.Result)
+	}
+}
+
+func TestServiceAllocatorStickyReservations(t *testing.T) {
+	ipRange := newIPRange()
+	ipRange.Spec.Addresses = []string{"10.96.0.5"}
+	expires := metav1.NewTime(time.Now().Add(time.Second))
+	ipRange.Spec.StickyReservations = []clusteripv1.StickyReservation{
+		{Address: "10.96.0.5", Namespace: "default", Name: "test", Expires: &expires},
+	}
+	a, _ := newServiceAllocatorWithObjects(t, ipRange)
+	ctx := context.Background()
+
+	// the address is held for the Service default/test
+	other := newService("10.96.0.5", v1.ServiceTypeClusterIP)
+	other.Name = "other"
+	if resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, other, nil)); resp.Allowed {
+		t.Fatalf("expected the request to be denied")
+	}
+	for _, dryRun := range []bool{true, false} {
+		resp := a.Handle(ctx, newRequest(t, admissionv1.Create, dryRun, newService("10.96.0.5", v1.ServiceTypeClusterIP), nil))
+		if !resp.Allowed {
+			t.Fatalf("expected the request to be allowed, dry-run %v, got %v", dryRun, resp.Result)
+		}
+	}
+	resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, newService("", v1.ServiceTypeClusterIP), nil))
+	if !resp.Allowed || len(resp.Patches) != 1 || resp.Patches[0].Value.(string) != "10.96.0.5" {
+		t.Fatalf("expected the sticky address to be patched, got %v %v", resp.Result, resp.Patches)
+	}
+	// the reservation is extended until the Service is created
+	got := &clusteripv1.IPRange{}
+	if err := a.Reader.Get(ctx, client.ObjectKeyFromObject(ipRange), got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Spec.StickyReservations[0].Expires.After(time.Now().Add(a.TTL / 2)) {
+		t.Fatalf("expected the sticky reservation to be extended, got %v", got.Spec.StickyReservations[0].Expires)
+	}
+}
+
+func TestServiceAllocatorNamespacePolicy(t *testing.T) {
+	ipRange := newIPRange()
+	ipRange.Spec.AllowedNamespaces = []string{"tenant-a"}
+	ipRange.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "b"}}
+	a, r := newServiceAllocatorWithObjects(t, ipRange,
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-a"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-b", Labels: map[string]string{"tenant": "b"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	)
+	ctx := context.Background()
+
+	for namespace, allowed := range map[string]bool{"tenant-a": true, "tenant-b": true, "default": false} {
+		for _, clusterIP := range []string{"", "10.96.0.9"} {
+			svc := newService(clusterIP, v1.ServiceTypeClusterIP)
+			svc.Namespace = namespace
+			svc.Name = "test-" + clusterIP
+			resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+			if resp.Allowed != allowed {
+				t.Fatalf("namespace %s ClusterIP %q expected allowed %v, got %v", namespace, clusterIP, allowed, resp.Result)
+			}
+			if !allowed && resp.Result.Code != http.StatusForbidden {
+				t.Fatalf("expected code %d, got %d", http.StatusForbidden, resp.Result.Code)
+			}
+			if !allowed {
+				continue
+			}
+			// release the address so the next Services can allocate it
+			allocated := clusterIP
+			if allocated == "" {
+				allocated = resp.Patches[0].Value.(string)
+			}
+			if err := r.Release(net.ParseIP(allocated)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+}
+
+func TestServiceAllocatorNamespaceQuota(t *testing.T) {
+	ipRange := newIPRange()
+	ipRange.Spec.NamespaceQuotas = []clusteripv1.NamespaceQuota{{Namespace: "tenant-a", Limit: 2}}
+	ipRange.Spec.DefaultNamespaceQuota = pointer.Int64Ptr(0)
+	// the address of a Service of the namespace
+	ipRange.Spec.Addresses = []string{"10.96.0.9"}
+	ipRange.Spec.Owners = []clusteripv1.AddressOwner{{Address: "10.96.0.9", Namespace: "tenant-a", Name: "held"}}
+	a, r := newServiceAllocatorWithObjects(t, ipRange)
+	ctx := context.Background()
+
+	svc := newService("", v1.ServiceTypeClusterIP)
+	svc.Namespace = "tenant-a"
+	resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+	if !resp.Allowed {
+		t.Fatalf("expected the request to be allowed, got %v", resp.Result)
+	}
+	// the reservation counts against the quota before the Service is created
+	obj, err := r.Object()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reservations := obj.(*clusteripv1.IPRange).Spec.Reservations
+	if len(reservations) != 1 || reservations[0].Namespace != "tenant-a" {
+		t.Fatalf("expected a reservation for namespace tenant-a, got %v", reservations)
+	}
+	// the namespace holds 2 addresses
+	for _, dryRun := range []bool{true, false} {
+		resp = a.Handle(ctx, newRequest(t, admissionv1.Create, dryRun, svc, nil))
+		if resp.Allowed || resp.Result.Code != http.StatusForbidden {
+			t.Fatalf("expected the request to be forbidden, got %v", resp.Result)
+		}
+	}
+	// the other namespaces can not allocate with the default quota
+	svc.Namespace = "default"
+	resp = a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+	if resp.Allowed || resp.Result.Code != http.StatusForbidden {
+		t.Fatalf("expected the request to be forbidden, got %v", resp.Result)
+	}
+}
+
+func TestServiceAllocatorNamespaceQuotaParallel(t *testing.T) {
+	ipRange := newIPRange()
+	ipRange.Spec.NamespaceQuotas = []clusteripv1.NamespaceQuota{{Namespace: "tenant-a", Limit: 2}}
+	a, r := newServiceAllocatorWithObjects(t, ipRange)
+	ctx := context.Background()
+
+	// the Services are created in parallel, none of them exists when the others are admitted
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			svc := newService("", v1.ServiceTypeClusterIP)
+			svc.Namespace = "tenant-a"
+			svc.Name = fmt.Sprintf("svc-%d", i)
+			resp := a.Handle(ctx, newRequest(t, admissionv1.Create, false, svc, nil))
+			if resp.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	obj, err := r.Object()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	held := obj.(*clusteripv1.IPRange).NamespaceAddresses("tenant-a")
+	if allowed > 2 || held != int64(allowed) {
+		t.Fatalf("expected at most 2 addresses for the namespace, %d Services allowed and %d addresses held", allowed, held)
+	}
+}
+
+func TestToResponse(t *testing.T) {
+	testCases := []struct {
+		err  error
+		code int32
+	}{
+		{allocator.ErrAllocated, http.StatusConflict},
+		{allocator.ErrNotInRange, http.StatusUnprocessableEntity},
+		{allocator.ErrMismatchedNetwork, http.StatusUnprocessableEntity},
+		{allocator.ErrReserved, http.StatusUnprocessableEntity},
+		{allocator.ErrFull, http.StatusForbidden},
+		{fmt.Errorf("%w: namespace default", ErrNamespaceNotAllowed), http.StatusForbidden},
+		{fmt.Errorf("%w: namespace default", ErrQuotaExceeded), http.StatusForbidden},
+		{fmt.Errorf("%w: etcd timeout", allocator.ErrTransient), http.StatusServiceUnavailable},
+		{allocator.ErrRangeNotFound, http.StatusForbidden},
+		{fmt.Errorf("unexpected"), http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		resp := toResponse(tc.err)
+		if resp.Allowed {
+			t.Fatalf("expected %v to deny the request", tc.err)
+		}
+		if resp.Result.Code != tc.code {
+			t.Fatalf("expected code %d for %v, got %d", tc.code, tc.err, resp.Result.Code)
+		}
+	}
+}